@@ -0,0 +1,217 @@
+// API keys for MarketX
+// Machine integrations such as the WeChat service call the api with keys
+// created by admins. Keys carry scopes and an optional expiry, only their
+// sha256 hashes are stored, and rotating a key keeps the old one working
+// for apiKeyRotateGrace so clients can switch over without downtime.
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeWechatRead  = "wechat:read"
+	ScopeWechatWrite = "wechat:write"
+	apiKeyPrefixLen  = 8
+	apiKeyTouchEvery = time.Minute
+)
+
+// ApiScopes are the scopes keys can be given
+var ApiScopes = map[string]bool{
+	ScopeWechatRead:  true,
+	ScopeWechatWrite: true,
+}
+
+// legacyTokenScopes are granted to the deprecated MX_WECHAT_TOKENS
+var legacyTokenScopes = []string{ScopeWechatRead, ScopeWechatWrite}
+
+// hashApiKey returns the stored form of a key
+func hashApiKey(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// newApiKey generates a random key
+func newApiKey() string {
+	b := make([]byte, TokenMinMax/2)
+	crand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// parseScopes reads a comma separated list of scopes
+func parseScopes(s string) ([]string, bool) {
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || seen[scope] {
+			continue
+		}
+		if !ApiScopes[scope] {
+			return nil, false
+		}
+		seen[scope] = true
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes, len(scopes) > 0
+}
+
+// apiKeyActive checks whether k can still be used at now
+func apiKeyActive(k *ApiKey, now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// apiKeyHasScope checks whether k was given scope
+func apiKeyHasScope(k *ApiKey, scope string) bool {
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// requestApiKey returns the key of r, from a bearer Authorization header
+// or the token field
+func requestApiKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth,
+		"Bearer ") {
+		return auth[7:]
+	}
+	return r.FormValue("token")
+}
+
+// legacyTokensAccepted checks whether the deprecated MX_WECHAT_TOKENS still
+// work at now, which they only do until MX_WECHAT_TOKENS_UNTIL
+func legacyTokensAccepted(now time.Time) bool {
+	until, err := time.Parse(time.RFC3339, wechatTokensUntil)
+	return err == nil && now.Before(until)
+}
+
+// legacyTokenKey returns a key of the deprecated MX_WECHAT_TOKENS matching
+// key, or nil
+func legacyTokenKey(key, ip string, now time.Time) *ApiKey {
+	if len(wechatTokens) == 0 || !legacyTokensAccepted(now) {
+		return nil
+	}
+	for _, t := range wechatTokens {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(t)) == 1 {
+			serverLog.Warn("deprecated MX_WECHAT_TOKENS token used, "+
+				"replace it with an api key", LogFields{"ip": ip,
+				"until": wechatTokensUntil})
+			return &ApiKey{Name: "MX_WECHAT_TOKENS",
+				Scopes: strings.Join(legacyTokenScopes, ",")}
+		}
+	}
+	return nil
+}
+
+// checkApiKey finds the active key of key from ip and checks it has scope
+func checkApiKey(key, scope, ip string) (*ApiKey, ErrorCode) {
+	if _, ok := CheckLength(true, key, TokenMinMax, TokenMinMax); !ok {
+		return nil, ErrorCodeTokenError
+	}
+	now := time.Now()
+	k := legacyTokenKey(key, ip, now)
+	if k == nil {
+		k = &ApiKey{}
+		if dbConn.First(k, "key_hash = ?",
+			hashApiKey(key)).RecordNotFound() || !apiKeyActive(k, now) {
+			return nil, ErrorCodeTokenError
+		}
+		if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyTouchEvery ||
+			k.LastUsedIp != ip {
+			dbConn.Model(k).UpdateColumns(map[string]interface{}{
+				"last_used_at": now, "last_used_ip": ip})
+		}
+	}
+	if !apiKeyHasScope(k, scope) {
+		return nil, ErrorCodeNoPermission
+	}
+	return k, ErrorCodeNone
+}
+
+// createApiKey creates a key, returning it once as only its hash is kept
+func createApiKey(name string, scopes []string, expiresAt *time.Time,
+	createdBy uint) (*ApiKey, string, error) {
+	key := newApiKey()
+	k := &ApiKey{Name: name, Prefix: key[:apiKeyPrefixLen],
+		KeyHash: hashApiKey(key), Scopes: strings.Join(scopes, ","),
+		ExpiresAt: expiresAt, CreatedBy: createdBy}
+	if err := dbConn.Create(k).Error; err != nil {
+		return nil, "", err
+	}
+	return k, key, nil
+}
+
+// rotateApiKey replaces old with a new key of the same name, scopes and
+// expiry, old expires after apiKeyRotateGrace
+func rotateApiKey(old *ApiKey, createdBy uint) (*ApiKey, string, error) {
+	key := newApiKey()
+	k := &ApiKey{Name: old.Name, Prefix: key[:apiKeyPrefixLen],
+		KeyHash: hashApiKey(key), Scopes: old.Scopes,
+		ExpiresAt: old.ExpiresAt, CreatedBy: createdBy}
+	grace := time.Now().Add(apiKeyRotateGrace)
+	if old.ExpiresAt != nil && old.ExpiresAt.Before(grace) {
+		grace = *old.ExpiresAt
+	}
+	tx := dbConn.Begin()
+	if tx.Error != nil {
+		return nil, "", tx.Error
+	}
+	if err := tx.Create(k).Error; err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	if err := tx.Model(old).UpdateColumn("expires_at",
+		grace).Error; err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, "", err
+	}
+	return k, key, nil
+}
+
+// revokeApiKey stops a key from working
+func revokeApiKey(id uint) (bool, error) {
+	res := dbConn.Model(&ApiKey{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		UpdateColumn("revoked_at", time.Now())
+	return res.RowsAffected > 0, res.Error
+}
+
+// apiKeyInfo returns the fields of k shown to admins
+func apiKeyInfo(k *ApiKey, now time.Time) map[string]interface{} {
+	info := map[string]interface{}{
+		"id":           k.ID,
+		"name":         k.Name,
+		"prefix":       k.Prefix,
+		"scopes":       strings.Split(k.Scopes, ","),
+		"created_at":   unixTime(k.CreatedAt),
+		"created_by":   k.CreatedBy,
+		"expires_at":   0,
+		"revoked_at":   0,
+		"last_used_at": 0,
+		"last_used_ip": k.LastUsedIp,
+		"active":       apiKeyActive(k, now),
+	}
+	if k.ExpiresAt != nil {
+		info["expires_at"] = unixTime(*k.ExpiresAt)
+	}
+	if k.RevokedAt != nil {
+		info["revoked_at"] = unixTime(*k.RevokedAt)
+	}
+	if k.LastUsedAt != nil {
+		info["last_used_at"] = unixTime(*k.LastUsedAt)
+	}
+	return info
+}
@@ -0,0 +1,95 @@
+// Testing for api keys
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiKeyHash(t *testing.T) {
+	a, b := newApiKey(), newApiKey()
+	if uint64(len(a)) != TokenMinMax || a == b {
+		t.Fatalf("[ApiKey] Bad keys %v %v\n", a, b)
+	}
+	if h := hashApiKey(a); len(h) != 64 || h == a || h == hashApiKey(b) {
+		t.Fatalf("[ApiKey] Bad key hash %v\n", h)
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, ok := parseScopes("wechat:write, wechat:read,wechat:write")
+	if !ok || !reflect.DeepEqual(scopes, []string{ScopeWechatRead,
+		ScopeWechatWrite}) {
+		t.Fatalf("[ApiKey] Bad parsed scopes %v\n", scopes)
+	}
+	for _, bad := range []string{"", " , ", "wechat:read,admin"} {
+		if _, ok := parseScopes(bad); ok {
+			t.Fatalf("[ApiKey] Bad scopes %q accepted\n", bad)
+		}
+	}
+}
+
+func TestApiKeyActive(t *testing.T) {
+	now := time.Now()
+	k := &ApiKey{Scopes: ScopeWechatRead}
+	if !apiKeyActive(k, now) || !apiKeyHasScope(k, ScopeWechatRead) ||
+		apiKeyHasScope(k, ScopeWechatWrite) {
+		t.Fatal("[ApiKey] Bad key without expiry\n")
+	}
+	exp := now.Add(time.Minute)
+	k.ExpiresAt = &exp
+	if !apiKeyActive(k, now) || apiKeyActive(k, exp) {
+		t.Fatal("[ApiKey] Expiry is not applied\n")
+	}
+	k.RevokedAt = &now
+	if apiKeyActive(k, now) {
+		t.Fatal("[ApiKey] Revoked key is active\n")
+	}
+}
+
+func TestRequestApiKey(t *testing.T) {
+	r := httptest.NewRequest("POST", "/wechat",
+		strings.NewReader(url.Values{"token": {"form"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if k := requestApiKey(r); k != "form" {
+		t.Fatalf("[ApiKey] Bad form key %v\n", k)
+	}
+	r.Header.Set("Authorization", "Bearer header")
+	if k := requestApiKey(r); k != "header" {
+		t.Fatalf("[ApiKey] Bad header key %v\n", k)
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	token := strings.Repeat("a", int(TokenMinMax))
+	defer func(tokens []string, until string) {
+		wechatTokens, wechatTokensUntil = tokens, until
+	}(wechatTokens, wechatTokensUntil)
+	wechatTokens = []string{token}
+
+	// Refused without a sunset date, and after it
+	for _, until := range []string{"", "2000-01-01T00:00:00Z"} {
+		wechatTokensUntil = until
+		if legacyTokenKey(token, "", time.Now()) != nil {
+			t.Fatalf("[ApiKey] Legacy token accepted until %q\n", until)
+		}
+	}
+	wechatTokensUntil = time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	if _, ec := checkApiKey("short", ScopeWechatRead, ""); ec !=
+		ErrorCodeTokenError {
+		t.Fatalf("[ApiKey] Short key accepted: %v\n", ec)
+	}
+	k, ec := checkApiKey(token, ScopeWechatWrite, "")
+	if ec != ErrorCodeNone || k.ID != 0 {
+		t.Fatalf("[ApiKey] Legacy token refused: %v\n", ec)
+	}
+	if _, ec := checkApiKey(token, "other:write", ""); ec !=
+		ErrorCodeNoPermission {
+		t.Fatalf("[ApiKey] Legacy token has other scopes: %v\n", ec)
+	}
+}
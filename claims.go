@@ -0,0 +1,160 @@
+// JWT claims for MarketX
+// Access tokens carry the registered claims (iss, aud, sub, exp, iat, nbf,
+// jti) with the session in sid and the user level, so other services can
+// verify them with standard libraries. Tokens with the legacy user_id and
+// expire claims are still accepted until the transition window closes.
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	JwtClaimsStandard = "standard"
+	JwtClaimsLegacy   = "legacy"
+	jwtLeeway         = 30 * time.Second
+)
+
+// jwtParser only checks signatures, parseAuthClaims checks the claims
+var jwtParser = &jwt.Parser{SkipClaimsValidation: true}
+
+// authClaims are the token values checkAuth needs, session is 0 for
+// tokens from before sessions
+type authClaims struct {
+	userId  uint
+	session uint
+}
+
+// newAccessClaims returns the access token claims of u in session s in the
+// configured format
+func newAccessClaims(u *User, s *Session, now time.Time) jwt.MapClaims {
+	exp := now.Add(accessTokenDuration).Unix()
+	if jwtClaimsFormat == JwtClaimsLegacy {
+		return jwt.MapClaims{
+			"user_id":    u.ID,
+			"session_id": s.ID,
+			"expire":     exp,
+		}
+	}
+	return jwt.MapClaims{
+		"iss":        jwtIssuer,
+		"aud":        jwtAudience,
+		"sub":        strconv.FormatUint(uint64(u.ID), 10),
+		"iat":        now.Unix(),
+		"nbf":        now.Unix(),
+		"exp":        exp,
+		"jti":        newRequestId(),
+		"sid":        s.ID,
+		"user_level": u.UserLevel,
+	}
+}
+
+// claimTime reads a numeric date claim
+func claimTime(c jwt.MapClaims, name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// claimId reads a numeric id claim, found is false if it is not there
+func claimId(c jwt.MapClaims, name string) (id uint, found, ok bool) {
+	v, found := c[name]
+	if !found {
+		return 0, false, true
+	}
+	f, ok := v.(float64)
+	return uint(f), true, ok && f >= 0
+}
+
+// claimAudience checks that aud, a string or a list, names aud
+func claimAudience(c jwt.MapClaims, aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// legacyClaimsAccepted checks whether the transition window for legacy
+// claims is still open at now
+func legacyClaimsAccepted(now time.Time) bool {
+	if jwtLegacyClaimsUntil == "" {
+		return true
+	}
+	until, err := time.Parse(time.RFC3339, jwtLegacyClaimsUntil)
+	return err == nil && now.Before(until)
+}
+
+// parseAuthClaims validates the claims of a verified token at now
+func parseAuthClaims(c jwt.MapClaims, now time.Time) (authClaims,
+	ErrorCode) {
+	if _, found := c["sub"]; !found {
+		return parseLegacyClaims(c, now)
+	}
+
+	var ac authClaims
+	if iss, _ := c["iss"].(string); iss != jwtIssuer ||
+		!claimAudience(c, jwtAudience) {
+		return ac, ErrorCodeJwtError
+	}
+	exp, ok := claimTime(c, "exp")
+	if !ok {
+		return ac, ErrorCodeJwtStoreError
+	}
+	if now.After(exp) {
+		return ac, ErrorCodeJwtExpired
+	}
+	// Allow for clock differences between instances
+	if nbf, ok := claimTime(c, "nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return ac, ErrorCodeJwtError
+	}
+
+	sub, _ := c["sub"].(string)
+	uid, err := strconv.ParseUint(sub, 10, 64)
+	if err != nil {
+		return ac, ErrorCodeJwtStoreError
+	}
+	sid, _, ok := claimId(c, "sid")
+	if !ok {
+		return ac, ErrorCodeJwtStoreError
+	}
+	ac.userId, ac.session = uint(uid), sid
+	return ac, ErrorCodeNone
+}
+
+// parseLegacyClaims validates the user_id, session_id and expire claims
+func parseLegacyClaims(c jwt.MapClaims, now time.Time) (authClaims,
+	ErrorCode) {
+	var ac authClaims
+	if !legacyClaimsAccepted(now) {
+		return ac, ErrorCodeJwtExpired
+	}
+	exp, ok := claimTime(c, "expire")
+	if !ok {
+		return ac, ErrorCodeJwtStoreError
+	}
+	if now.After(exp) {
+		return ac, ErrorCodeJwtExpired
+	}
+	uid, found, ok := claimId(c, "user_id")
+	if !found || !ok {
+		return ac, ErrorCodeJwtStoreError
+	}
+	sid, _, ok := claimId(c, "session_id")
+	if !ok {
+		return ac, ErrorCodeJwtStoreError
+	}
+	ac.userId, ac.session = uid, sid
+	return ac, ErrorCodeNone
+}
@@ -0,0 +1,95 @@
+// Testing for jwt claims
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// roundTripClaims signs and parses claims like a client would send them
+func roundTripClaims(t *testing.T, c jwt.MapClaims) jwt.MapClaims {
+	s, err := jwtKeys.sign(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwtParser.Parse(s, jwtKeys.verifyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Claims.(jwt.MapClaims)
+}
+
+func TestAuthClaims(t *testing.T) {
+	defer useTestKeyring(t)()
+	u := &User{UserLevel: UserLevelAdmin}
+	u.ID = 3
+	s := &Session{}
+	s.ID = 9
+	now := time.Now()
+
+	c := roundTripClaims(t, newAccessClaims(u, s, now))
+	for _, name := range []string{"iss", "aud", "sub", "exp", "iat", "nbf",
+		"jti", "sid", "user_level"} {
+		if c[name] == nil {
+			t.Fatalf("[Claims] Missing %v claim in %v\n", name, c)
+		}
+	}
+	if ac, ec := parseAuthClaims(c, now); ec != ErrorCodeNone ||
+		ac.userId != 3 || ac.session != 9 {
+		t.Fatalf("[Claims] Bad standard claims %v %v\n", ac, ec)
+	}
+	if _, ec := parseAuthClaims(c,
+		now.Add(accessTokenDuration+time.Second)); ec != ErrorCodeJwtExpired {
+		t.Fatalf("[Claims] Expired token gives %v\n", ec)
+	}
+	if _, ec := parseAuthClaims(c, now.Add(-time.Minute)); ec !=
+		ErrorCodeJwtError {
+		t.Fatalf("[Claims] Token before nbf gives %v\n", ec)
+	}
+	c["aud"] = []interface{}{"other", jwtAudience}
+	if _, ec := parseAuthClaims(c, now); ec != ErrorCodeNone {
+		t.Fatalf("[Claims] Audience list gives %v\n", ec)
+	}
+	c["aud"] = "other"
+	if _, ec := parseAuthClaims(c, now); ec != ErrorCodeJwtError {
+		t.Fatalf("[Claims] Wrong audience gives %v\n", ec)
+	}
+	c["aud"], c["iss"] = jwtAudience, "other"
+	if _, ec := parseAuthClaims(c, now); ec != ErrorCodeJwtError {
+		t.Fatalf("[Claims] Wrong issuer gives %v\n", ec)
+	}
+}
+
+func TestLegacyClaims(t *testing.T) {
+	defer useTestKeyring(t)()
+	now := time.Now()
+	c := roundTripClaims(t, jwt.MapClaims{"user_id": 5,
+		"expire": now.Add(time.Minute).Unix()})
+	if ac, ec := parseAuthClaims(c, now); ec != ErrorCodeNone ||
+		ac.userId != 5 || ac.session != 0 {
+		t.Fatalf("[Claims] Bad legacy claims %v %v\n", ac, ec)
+	}
+	if _, ec := parseAuthClaims(c, now.Add(2*time.Minute)); ec !=
+		ErrorCodeJwtExpired {
+		t.Fatalf("[Claims] Expired legacy token gives %v\n", ec)
+	}
+
+	defer func(until string) {
+		jwtLegacyClaimsUntil = until
+	}(jwtLegacyClaimsUntil)
+	jwtLegacyClaimsUntil = now.Add(-time.Hour).Format(time.RFC3339)
+	if _, ec := parseAuthClaims(c, now); ec != ErrorCodeJwtExpired {
+		t.Fatalf("[Claims] Legacy token after the window gives %v\n", ec)
+	}
+
+	defer func(format string) {
+		jwtClaimsFormat = format
+	}(jwtClaimsFormat)
+	jwtClaimsFormat = JwtClaimsLegacy
+	lc := newAccessClaims(&User{}, &Session{}, now)
+	if lc["user_id"] == nil || lc["expire"] == nil || lc["sub"] != nil {
+		t.Fatalf("[Claims] Bad legacy format %v\n", lc)
+	}
+}
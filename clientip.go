@@ -0,0 +1,114 @@
+// Client ip resolution for MarketX
+// Behind load balancers r.RemoteAddr is the address of the last proxy. The
+// client address is taken from the Forwarded, X-Forwarded-For or X-Real-IP
+// headers, walking the forwarded hops from the right and only believing
+// hops added by a trusted proxy.
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxyNets, _ = parseCidrs(trustedProxies)
+
+// parseCidrs parses CIDRs, a single ip is taken as a network of its own
+func parseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("%v is not an ip or CIDR", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip,
+				Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not an ip or CIDR", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedProxy checks whether ip belongs to a trusted proxy
+func trustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostIp parses an ip with an optional port, brackets and quotes as
+// found in RemoteAddr and forwarding headers, nil if invalid
+func parseHostIp(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// forwardedHops returns the client addresses recorded by proxies, nearest
+// client first, preferring the standard Forwarded header
+func forwardedHops(r *http.Request) []string {
+	var hops []string
+	if fs := r.Header["Forwarded"]; len(fs) > 0 {
+		for _, e := range strings.Split(strings.Join(fs, ","), ",") {
+			for _, pair := range strings.Split(e, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, kv[1])
+				}
+			}
+		}
+		return hops
+	}
+	if xs := r.Header["X-Forwarded-For"]; len(xs) > 0 {
+		return strings.Split(strings.Join(xs, ","), ",")
+	}
+	if x := r.Header.Get("X-Real-IP"); x != "" {
+		return []string{x}
+	}
+	return nil
+}
+
+// resolveClientIp returns the client address of r: the rightmost forwarded
+// hop not added by a trusted proxy, or the connection address when it does
+// not come from a trusted proxy
+func resolveClientIp(r *http.Request) string {
+	ip := parseHostIp(r.RemoteAddr)
+	if ip == nil {
+		return ""
+	}
+	hops := forwardedHops(r)
+	for i := len(hops) - 1; i >= 0 && trustedProxy(ip); i-- {
+		hop := parseHostIp(hops[i])
+		if hop == nil {
+			// Obfuscated or garbled, the last proxy is all we know
+			break
+		}
+		ip = hop
+	}
+	return ip.String()
+}
+
+// getIp returns the resolved client ip address of a request
+func getIp(r *http.Request) string {
+	return getRequestContext(r).ip
+}
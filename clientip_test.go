@@ -0,0 +1,46 @@
+// Testing for client ip resolution
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIp(t *testing.T) {
+	defer func(nets []*net.IPNet) { trustedProxyNets = nets }(trustedProxyNets)
+	var err error
+	trustedProxyNets, err = parseCidrs([]string{"10.0.0.0/8", "fd00::1"})
+	if err != nil || len(trustedProxyNets) != 2 {
+		t.Fatalf("[ClientIp] parseCidrs failed: %v\n", err)
+	}
+	if _, err := parseCidrs([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("[ClientIp] parseCidrs accepts bad CIDR\n")
+	}
+
+	for _, c := range []struct {
+		remote, header, value, expected string
+	}{
+		// Untrusted peers cannot spoof their address
+		{"1.2.3.4:5", "X-Forwarded-For", "9.9.9.9", "1.2.3.4"},
+		{"10.0.0.1:5", "", "", "10.0.0.1"},
+		{"10.0.0.1:5", "X-Forwarded-For", "9.9.9.9, 1.2.3.4, 10.0.0.2",
+			"1.2.3.4"},
+		{"10.0.0.1:5", "X-Real-IP", "1.2.3.4", "1.2.3.4"},
+		{"[fd00::1]:5", "Forwarded",
+			`for=9.9.9.9, for="[2001:db8::1]:4711";proto=https`,
+			"2001:db8::1"},
+		{"10.0.0.1:5", "Forwarded", "for=_hidden, for=10.0.0.3",
+			"10.0.0.3"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		if ip := resolveClientIp(r); ip != c.expected {
+			t.Fatalf("[ClientIp] %v %v: %v resolved to %v, expected %v\n",
+				c.remote, c.header, c.value, ip, c.expected)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Command line interface for MarketX server
+// Every subcommand shares config validation, logging and the database
+// connection, and maps its result onto the process exit code.
+package main
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Process exit codes
+const (
+	ExitOk = iota
+	ExitFailure
+	ExitUsage
+)
+
+// command is a server subcommand
+type command struct {
+	args     string
+	help     string
+	database bool
+	run      func(args []string) error
+}
+
+// usageError is returned by commands called with bad arguments
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+var commands = map[string]*command{
+	"serve": {"", "run the web server (default)", true, runServe},
+	"migrate": {"status|up|down [N]|to VERSION",
+		"show or change the database schema version", true,
+		func(args []string) error {
+			return runMigrate(os.Stdout, dbConn, args)
+		}},
+	"import": {"[-dir DIR] [-dry-run]",
+		"import or refresh company data from csv files", true, runImport},
+	"create-admin": {"-email EMAIL [-first-name NAME] [-last-name NAME] " +
+		"[-role ROLES] [-promote]", "create an admin user, password read from stdin",
+		true, runCreateAdmin},
+	"reset-password": {"-email EMAIL",
+		"set a user password, read from stdin", true, runResetPassword},
+	"phone-report": {"[-preview]",
+		"list phone numbers the E.164 migration could not keep, or would " +
+			"not with -preview", true, runPhoneReport},
+	"rotate-keys": {"",
+		"re-encrypt stored data with MX_NEW_AES_TEXT_KEY and " +
+			"MX_NEW_AES_FILE_KEY", true, runRotateKeys},
+}
+
+// printUsage writes the command line help
+func printUsage() {
+	w := os.Stderr
+	fmt.Fprintf(w, "Usage: %v [flags] [command] [args]\n\nCommands:\n",
+		os.Args[0])
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(w, "  %v\n    \t%v\n",
+			strings.TrimSpace(n+" "+commands[n].args), commands[n].help)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand sets up the shared state, runs a command and returns the
+// exit code for it
+func runCommand(args []string) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		log.Println("Unknown command:", name)
+		printUsage()
+		return ExitUsage
+	}
+
+	// Report every configuration problem at once before doing anything
+	problems := checkConfig()
+	if *printConfigFlag {
+		printConfig(os.Stdout)
+	}
+	for _, p := range problems {
+		log.Println("Configuration error:", p)
+	}
+	if len(problems) > 0 {
+		log.Println("Invalid configuration, exiting")
+		return ExitFailure
+	}
+	if *printConfigFlag {
+		return ExitOk
+	}
+
+	closeLogs, err := setupLogs()
+	if err != nil {
+		log.Println("Error setting up logs:", err)
+		return ExitFailure
+	}
+	defer closeLogs()
+
+	if cmd.database {
+		if err := openDatabase(); err != nil {
+			log.Println("Error opening database connection:", err)
+			return ExitFailure
+		}
+		defer dbConn.Close()
+	}
+
+	err = cmd.run(args)
+	if _, ok := err.(usageError); ok {
+		log.Printf("Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Usage: %v %v %v\n", os.Args[0], name,
+			cmd.args)
+		return ExitUsage
+	}
+	if err != nil {
+		log.Printf("Error running %v: %v\n", name, err)
+		return ExitFailure
+	}
+	return ExitOk
+}
+
+// parseCommandFlags parses the flags of a command, flag errors are
+// usage errors
+func parseCommandFlags(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if fs.NArg() > 0 {
+		return usageError("unexpected argument " + fs.Arg(0))
+	}
+	return nil
+}
+
+// readPassword reads a password from the first line of in and converts it
+// to the form clients submit: the hex SHA-512 digest of the password
+// A value that is already a digest is kept as is.
+func readPassword(in io.Reader) (string, error) {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	p := strings.TrimRight(line, "\r\n")
+	if p == "" {
+		return "", errors.New("Empty password")
+	}
+	if uint64(len(p)) == PasswordMinMax {
+		return p, nil
+	}
+	return fmt.Sprintf("%x", sha512.Sum512([]byte(p))), nil
+}
+
+// hashPassword reads a password from stdin and returns its bcrypt hash
+func hashPassword() (string, error) {
+	if fi, err := os.Stdin.Stat(); err == nil &&
+		fi.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	password, err := readPassword(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password),
+		bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(passwordHash), nil
+}
+
+// runImport is the import command
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dir := fs.String("dir", dataDir, "directory of the csv files")
+	dryRun := fs.Bool("dry-run", false,
+		"validate and report without saving anything")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if err := checkSchema(dbConn); err != nil {
+		return err
+	}
+	dbLog.Info("importing table data", LogFields{"dir": *dir,
+		"dry_run": *dryRun})
+	return importCsvData(dbConn, *dir, *dryRun, os.Stdout)
+}
+
+// runCreateAdmin is the create-admin command
+func runCreateAdmin(args []string) error {
+	fs := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	email := fs.String("email", "", "email to sign in with")
+	firstName := fs.String("first-name", "", "first name")
+	lastName := fs.String("last-name", "", "last name")
+	promote := fs.Bool("promote", false,
+		"promote the user if it already exists, keeping its password")
+	role := fs.String("role", RoleSuperAdmin, "comma separated admin roles")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if *email == "" {
+		return usageError("missing -email")
+	}
+	roles, ok := parseRoles(*role)
+	if !ok || len(roles) == 0 {
+		return usageError("invalid -role")
+	}
+	if err := checkSchema(dbConn); err != nil {
+		return err
+	}
+
+	e := strings.ToLower(*email)
+	var u User
+	if !dbConn.First(&u, "email = ?", e).RecordNotFound() {
+		if !*promote {
+			return fmt.Errorf("User %v already exists, use -promote", e)
+		}
+		if err := setUserRoles(u.ID, roles, 0); err != nil {
+			return err
+		}
+		fmt.Printf("Promoted user %v (%v) to admin %v\n", u.ID, e, roles)
+		return nil
+	}
+
+	passwordHash, err := hashPassword()
+	if err != nil {
+		return err
+	}
+	u = User{
+		FirstName:    *firstName,
+		LastName:     *lastName,
+		FullName:     NameConventions[CitizenTypeCitizen](*firstName, *lastName),
+		Email:        e,
+		PasswordHash: passwordHash,
+		UserState:    UserStateConfirmed,
+		UserLevel:    UserLevelAdmin,
+		Country:      "US"}
+	if err := dbConn.Create(&u).Error; err != nil {
+		return err
+	}
+	if err := setUserRoles(u.ID, roles, 0); err != nil {
+		return err
+	}
+	fmt.Printf("Created admin user %v (%v) %v\n", u.ID, e, roles)
+	return nil
+}
+
+// runResetPassword is the reset-password command
+func runResetPassword(args []string) error {
+	fs := flag.NewFlagSet("reset-password", flag.ContinueOnError)
+	email := fs.String("email", "", "email of the user")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if *email == "" {
+		return usageError("missing -email")
+	}
+	if err := checkSchema(dbConn); err != nil {
+		return err
+	}
+
+	var u User
+	if dbConn.First(&u, "email = ?", strings.ToLower(*email)).RecordNotFound() {
+		return fmt.Errorf("User %v not found", *email)
+	}
+	passwordHash, err := hashPassword()
+	if err != nil {
+		return err
+	}
+	// Outstanding reset links and sessions must not work after this
+	if err := dbConn.Model(&u).Updates(map[string]interface{}{
+		"password_hash":  passwordHash,
+		"password_token": ""}).Error; err != nil {
+		return err
+	}
+	if err := revokeUserSessions(u.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Password reset for user %v (%v)\n", u.ID, u.Email)
+	return nil
+}
@@ -0,0 +1,24 @@
+// Testing for command line helpers
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadPassword(t *testing.T) {
+	p, err := readPassword(strings.NewReader("secret\nignored\n"))
+	if err != nil {
+		t.Fatalf("[Command] readPassword failed: %v\n", err)
+	}
+	if uint64(len(p)) != PasswordMinMax || !strings.HasPrefix(p, "bd2b1aaf") {
+		t.Fatalf("[Command] readPassword does not digest: %v\n", p)
+	}
+	d, err := readPassword(strings.NewReader(p))
+	if err != nil || d != p {
+		t.Fatalf("[Command] readPassword changes a digest: %v %v\n", d, err)
+	}
+	if _, err := readPassword(strings.NewReader("\n")); err == nil {
+		t.Fatal("[Command] readPassword accepts an empty password\n")
+	}
+}
@@ -1,36 +1,247 @@
 // Config file for running MarketX server
-// Reads in secret variables from the running environment.
-// In the future it should read and parse default values with their
-// respective types.
+// Values are layered: the running environment overrides the config file
+// (a flat TOML file, see marketx.example.toml), which overrides the
+// typed defaults declared here.
+// Missing or malformed values never panic at init, instead they are
+// collected and reported all at once when the server starts.
 package main
 
 import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// getString is a string environment variable parsing and
-// default-setting function
-func getString(name string, def interface{}) string {
-	val := os.Getenv(name)
-	// Make sure certain values have must sets
-	if val == "" && def == nil {
-		panic(name)
+const (
+	configFileDefault = "marketx.toml"
+	configSecretMask  = "********"
+)
+
+// configEntry is the resolved state of one configuration value
+type configEntry struct {
+	name   string
+	kind   string
+	value  string
+	source string
+	secret bool
+}
+
+var (
+	configEntries  = map[string]*configEntry{}
+	configProblems []string
+)
+
+// Config file values, loaded before any configuration is read
+var configFilePath, configFileValues = loadConfigFile()
+
+// configProblem records a configuration problem for the startup report
+func configProblem(format string, a ...interface{}) {
+	configProblems = append(configProblems, fmt.Sprintf(format, a...))
+}
+
+// configFileArg finds the config file path from --config on the command
+// line, MX_CONFIG_FILE or the default file name, and whether it was
+// explicitly given
+func configFileArg() (string, bool) {
+	args := os.Args[1:]
+	for i, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		a = strings.TrimLeft(a, "-")
+		if strings.HasPrefix(a, "config=") {
+			return a[len("config="):], true
+		}
+		if a == "config" && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	if p := os.Getenv("MX_CONFIG_FILE"); p != "" {
+		return p, true
+	}
+	return configFileDefault, false
+}
+
+// loadConfigFile reads the config file if available, an explicitly given
+// file that cannot be read is reported as a problem
+func loadConfigFile() (string, map[string]string) {
+	p, explicit := configFileArg()
+	f, err := os.Open(p)
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			configProblem("config file %v cannot be read: %v", p, err)
+		}
+		return "", map[string]string{}
+	}
+	defer f.Close()
+
+	vals, errs := parseConfig(f)
+	for _, e := range errs {
+		configProblem("config file %v: %v", p, e)
+	}
+	return p, vals
+}
+
+// parseConfig parses the flat TOML subset used by MarketX config files:
+// top-level "KEY = value" pairs with strings, integers, booleans and
+// arrays of strings; arrays are joined with "," like env variables
+func parseConfig(r io.Reader) (map[string]string, []string) {
+	vals := map[string]string{}
+	var errs []string
+	s := bufio.NewScanner(r)
+	for ln := 1; s.Scan(); ln++ {
+		line := strings.TrimSpace(stripConfigComment(s.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			errs = append(errs, fmt.Sprintf("line %v: tables are not "+
+				"supported", ln))
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			errs = append(errs, fmt.Sprintf("line %v: expected KEY = value",
+				ln))
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		val, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %v: %v: %v", ln, key, err))
+			continue
+		}
+		if _, found := vals[key]; found {
+			errs = append(errs, fmt.Sprintf("line %v: %v is defined twice",
+				ln, key))
+			continue
+		}
+		vals[key] = val
+	}
+	if err := s.Err(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	return vals, errs
+}
+
+// stripConfigComment removes a trailing # comment outside of strings
+func stripConfigComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValue converts a TOML value into its env variable form
+func parseConfigValue(v string) (string, error) {
+	switch {
+	case v == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return v[1 : len(v)-1], nil
+	case strings.HasPrefix(v, "["):
+		if !strings.HasSuffix(v, "]") {
+			return "", fmt.Errorf("unterminated array")
+		}
+		var items []string
+		for _, item := range strings.Split(v[1:len(v)-1], ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			s, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case v == "true" || v == "false":
+		return v, nil
+	}
+	if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid value %v", v)
 	}
+	return v, nil
+}
+
+// lookupConfig resolves a value from the environment or the config file
+func lookupConfig(name, kind string, secret bool) (string, *configEntry) {
+	e := &configEntry{name: name, kind: kind, secret: secret}
+	configEntries[name] = e
+	if val := os.Getenv(name); val != "" {
+		e.value, e.source = val, "env"
+	} else if val := configFileValues[name]; val != "" {
+		e.value, e.source = val, "file"
+	}
+	return e.value, e
+}
 
+// getConfigString is the common string lookup with required checking
+func getConfigString(name string, def interface{}, secret bool) string {
+	val, e := lookupConfig(name, "string", secret)
 	if val != "" {
 		return val
 	}
-	return def.(string)
+	// Make sure certain values have must sets
+	if def == nil {
+		configProblem("%v is required but missing", name)
+		e.source = "missing"
+		return ""
+	}
+	e.value, e.source = def.(string), "default"
+	return e.value
+}
+
+// getString is a string environment variable parsing and
+// default-setting function, nil defaults are required values
+func getString(name string, def interface{}) string {
+	return getConfigString(name, def, false)
+}
+
+// getSecret is the getString version for credentials, which are masked
+// when the configuration is printed
+func getSecret(name string, def interface{}) string {
+	return getConfigString(name, def, true)
 }
 
 // getBool is a bool environment variable parsing and
 // default-setting function
 func getBool(name string, def bool) bool {
-	val := os.Getenv(name)
+	val, e := lookupConfig(name, "bool", false)
+	if val == "" {
+		e.value, e.source = strconv.FormatBool(def), "default"
+		return def
+	}
 	ret, err := strconv.ParseBool(val)
 	if err != nil {
+		configProblem("%v is not a valid bool: %v", name, val)
 		return def
 	}
 	return ret
@@ -39,9 +250,30 @@ func getBool(name string, def bool) bool {
 // getInt is an int environment variable parsing and
 // default-setting function
 func getInt(name string, def int64) int64 {
-	val := os.Getenv(name)
+	val, e := lookupConfig(name, "int", false)
+	if val == "" {
+		e.value, e.source = strconv.FormatInt(def, 10), "default"
+		return def
+	}
 	ret, err := strconv.ParseInt(val, 10, 64)
 	if err != nil {
+		configProblem("%v is not a valid int: %v", name, val)
+		return def
+	}
+	return ret
+}
+
+// getDuration is a duration (e.g. "30s") environment variable parsing and
+// default-setting function
+func getDuration(name string, def time.Duration) time.Duration {
+	val, e := lookupConfig(name, "duration", false)
+	if val == "" {
+		e.value, e.source = def.String(), "default"
+		return def
+	}
+	ret, err := time.ParseDuration(val)
+	if err != nil || ret < 0 {
+		configProblem("%v is not a valid duration: %v", name, val)
 		return def
 	}
 	return ret
@@ -50,8 +282,9 @@ func getInt(name string, def int64) int64 {
 // getStringArray is a string array (separated by ",") environment variable
 // parsing and default-setting function
 func getStringArray(name string, def []string) []string {
-	val := os.Getenv(name)
+	val, e := lookupConfig(name, "strings", false)
 	if val == "" {
+		e.value, e.source = strings.Join(def, ","), "default"
 		return def
 	}
 
@@ -59,18 +292,180 @@ func getStringArray(name string, def []string) []string {
 	return strings.Split(val, ",")
 }
 
-// Debugging configurations
-var (
-	dropTables = getBool("MX_DEBUG_DROP_TABLES", false)
-	importData = getBool("MX_DEBUG_IMPORT_DATA", false)
-)
+// getSecretArray is the getStringArray version for credentials
+func getSecretArray(name string, def []string) []string {
+	ret := getStringArray(name, def)
+	configEntries[name].secret = true
+	return ret
+}
+
+// decodeHexKey decodes a hex-encoded key of one of the lengths
+func decodeHexKey(name, key string, lengths ...int) ([]byte, error) {
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("%v is not valid hex", name)
+	}
+	for _, l := range lengths {
+		if len(b) == l {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%v decodes to %v bytes, expected one of %v",
+		name, len(b), lengths)
+}
+
+// checkHexKey makes sure a hex-encoded key decodes to one of the lengths
+func checkHexKey(name, key string, lengths ...int) {
+	if key == "" {
+		// Already reported as missing
+		return
+	}
+	if _, err := decodeHexKey(name, key, lengths...); err != nil {
+		configProblem("%v", err)
+	}
+}
+
+// checkConfig runs the cross-value validations and returns every problem
+// found while loading the configuration
+func checkConfig() []string {
+	checkHexKey("MX_JWT_SECRET_KEY", jwtSecretKey, 32, 64)
+	if jwtSecretKey == "" && jwtKeyringFile == "" {
+		configProblem("MX_JWT_SECRET_KEY or MX_JWT_KEYRING_FILE is required")
+	}
+	if jwtClaimsFormat != JwtClaimsStandard &&
+		jwtClaimsFormat != JwtClaimsLegacy {
+		configProblem("MX_JWT_CLAIMS_FORMAT must be standard or legacy: %v",
+			jwtClaimsFormat)
+	}
+	if _, err := parseJwtTime(jwtLegacyClaimsUntil); err != nil {
+		configProblem("MX_JWT_LEGACY_CLAIMS_UNTIL is not an RFC 3339 time: %v",
+			jwtLegacyClaimsUntil)
+	}
+	checkHexKey("MX_AES_TEXT_KEY", aesTextKey, 16, 24, 32)
+	checkHexKey("MX_AES_FILE_KEY", aesFileKey, 16, 24, 32)
+	if _, err := parseCidrs(trustedProxies); err != nil {
+		configProblem("MX_TRUSTED_PROXIES is invalid: %v", err)
+	}
+	if rateLimitStore != RateStoreMemory &&
+		rateLimitStore != RateStoreDatabase {
+		configProblem("MX_RATE_LIMIT_STORE must be memory or database: %v",
+			rateLimitStore)
+	}
+	if accessTokenDuration <= 0 {
+		configProblem("MX_ACCESS_TOKEN_DURATION must be positive: %v",
+			accessTokenDuration)
+	} else if refreshTokenDuration < accessTokenDuration {
+		configProblem("MX_REFRESH_TOKEN_DURATION must not be shorter than "+
+			"MX_ACCESS_TOKEN_DURATION: %v", refreshTokenDuration)
+	}
+	if wechatAppId != "" && wechatAppSecret == "" {
+		configProblem("MX_WECHAT_APP_SECRET is required with MX_WECHAT_APP_ID")
+	}
+	switch smsProvider {
+	case SmsProviderAlidayu:
+		if aliDayuAppKey == "" || aliDayuAppSecret == "" {
+			configProblem("ALI_DAYU_APP_KEY and ALI_DAYU_APP_SECRET are " +
+				"required with the alidayu SMS provider")
+		}
+	case SmsProviderHttp:
+		if smsHttpUrl == "" {
+			configProblem("MX_SMS_HTTP_URL is required with the http SMS " +
+				"provider")
+		}
+		if _, err := newHttpSMSSender(smsHttpUrl, smsHttpToken,
+			smsHttpContentType, smsHttpBody); err != nil {
+			configProblem("MX_SMS_HTTP_BODY is invalid: %v", err)
+		}
+	case SmsProviderLog, SmsProviderFile:
+	default:
+		configProblem("MX_SMS_PROVIDER must be alidayu, http, log or file: %v",
+			smsProvider)
+	}
+	if verifyCodeTtl < time.Minute {
+		configProblem("MX_VERIFY_CODE_TTL must be at least a minute: %v",
+			verifyCodeTtl)
+	}
+	if verifyCodeMaxAttempts < 1 {
+		configProblem("MX_VERIFY_CODE_MAX_ATTEMPTS must be positive: %v",
+			verifyCodeMaxAttempts)
+	}
+	if verifyCodeResend < 0 || verifyCodeResend >= verifyCodeTtl {
+		configProblem("MX_VERIFY_CODE_RESEND must be between zero and "+
+			"MX_VERIFY_CODE_TTL: %v", verifyCodeResend)
+	}
+	if verifyCodeLength < 4 || verifyCodeLength > 10 {
+		configProblem("MX_VERIFY_CODE_LENGTH must be between 4 and 10: %v",
+			verifyCodeLength)
+	}
+	if _, ok := PhoneRegions[phoneDefaultRegion]; !ok {
+		configProblem("MX_PHONE_DEFAULT_REGION must be CN, HK, TW or US: %v",
+			phoneDefaultRegion)
+	}
+	for _, m := range loginMethodsDefault {
+		if m != "none" && !loginMethodKnown(m) {
+			configProblem("MX_LOGIN_METHODS must list sms, email_link or "+
+				"none: %v", m)
+		}
+	}
+	if apiKeyRotateGrace < 0 {
+		configProblem("MX_API_KEY_ROTATE_GRACE must not be negative: %v",
+			apiKeyRotateGrace)
+	}
+	if _, err := time.Parse(time.RFC3339, wechatTokensUntil); err != nil &&
+		wechatTokensUntil != "" {
+		configProblem("MX_WECHAT_TOKENS_UNTIL is not an RFC 3339 time: %v",
+			wechatTokensUntil)
+	}
+	if _, ok := LogLevels[logLevel]; !ok {
+		configProblem("MX_LOG_LEVEL must be debug, info, warn or error: %v",
+			logLevel)
+	}
+	if logFormat != LogFormatJson && logFormat != LogFormatConsole {
+		configProblem("MX_LOG_FORMAT must be json or console: %v", logFormat)
+	}
+	return configProblems
+}
+
+// printConfig writes the resolved configuration as a config file with
+// every secret masked and the source of each value noted
+func printConfig(w io.Writer) {
+	names := make([]string, 0, len(configEntries))
+	for n := range configEntries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if configFilePath != "" {
+		fmt.Fprintf(w, "# Config file: %v\n", configFilePath)
+	}
+	for _, n := range names {
+		e := configEntries[n]
+		val := e.value
+		if e.secret && val != "" {
+			val = configSecretMask
+		}
+		switch {
+		case e.kind == "strings":
+			var items []string
+			if val != "" {
+				for _, s := range strings.Split(val, ",") {
+					items = append(items, strconv.Quote(s))
+				}
+			}
+			val = "[" + strings.Join(items, ", ") + "]"
+		case e.kind == "string" || e.kind == "duration" ||
+			val == configSecretMask:
+			val = strconv.Quote(val)
+		}
+		fmt.Fprintf(w, "%v = %v # %v\n", n, val, e.source)
+	}
+}
 
 // Server configurations
 var (
 	environment   = getString("MX_ENVIRONMENT", "development")
 	logFileName   = getString("MX_LOG_FILE_NAME", "marketx.log")
 	dbScheme      = getString("MX_DB_SCHEME", "postgres")
-	dbUrl         = getString("DATABASE_URL", nil)
+	dbUrl         = getSecret("DATABASE_URL", nil)
 	dbLogFileName = getString("MX_DB_LOG_FILE_NAME", "marketx_db.log")
 	serverProto   = getString("MX_SERVER_PROTO", "https://")
 	serverDomain  = getString("MX_SERVER_DOMAIN", "https://127.0.0.1")
@@ -80,27 +475,159 @@ var (
 	dataDir       = getString("MX_DATA_DIR", "data")
 )
 
+// Proxy configurations, forwarded client addresses are only believed when
+// the connection comes from one of these networks (CIDRs or single ips)
+var (
+	trustedProxies = getStringArray("MX_TRUSTED_PROXIES", nil)
+)
+
+// Logging configurations, console writes readable lines to stdout instead
+// of json to the log files
+var (
+	logLevel      = getString("MX_LOG_LEVEL", "info")
+	logFormat     = getString("MX_LOG_FORMAT", LogFormatJson)
+	logMaxSize    = getInt("MX_LOG_MAX_SIZE", 100)
+	logMaxAge     = getDuration("MX_LOG_MAX_AGE", 24*time.Hour)
+	logMaxBackups = getInt("MX_LOG_MAX_BACKUPS", 14)
+)
+
+// Server timeouts
+var (
+	serverReadHeaderTimeout = getDuration("MX_SERVER_READ_HEADER_TIMEOUT",
+		10*time.Second)
+	serverReadTimeout     = getDuration("MX_SERVER_READ_TIMEOUT", time.Minute)
+	serverWriteTimeout    = getDuration("MX_SERVER_WRITE_TIMEOUT", 2*time.Minute)
+	serverIdleTimeout     = getDuration("MX_SERVER_IDLE_TIMEOUT", 2*time.Minute)
+	serverShutdownTimeout = getDuration("MX_SERVER_SHUTDOWN_TIMEOUT",
+		time.Minute)
+)
+
+// Rate limit configurations, the database store shares counters between
+// server instances
+var (
+	rateLimitEnabled = getBool("MX_RATE_LIMIT_ENABLED", true)
+	rateLimitStore   = getString("MX_RATE_LIMIT_STORE", RateStoreMemory)
+)
+
+// Login protection configurations, accounts are locked for loginLockout
+// after loginMaxFailures wrong passwords in a row
+var (
+	loginMaxFailures     = getInt("MX_LOGIN_MAX_FAILURES", 5)
+	loginLockout         = getDuration("MX_LOGIN_LOCKOUT", 15*time.Minute)
+	loginNotifyNewSignIn = getBool("MX_LOGIN_NOTIFY_NEW_SIGN_IN", true)
+)
+
+// Session configurations, access jwts are renewed with a refresh token that
+// is good for refreshTokenDuration since it was issued
+var (
+	accessTokenDuration = getDuration("MX_ACCESS_TOKEN_DURATION",
+		15*time.Minute)
+	refreshTokenDuration = getDuration("MX_REFRESH_TOKEN_DURATION",
+		30*24*time.Hour)
+)
+
+// Two-factor configurations, admins must enable two-factor authentication
+// and sign in with a code to use the admin routes when required
+var (
+	twoFactorRequireAdmin = getBool("MX_TWO_FACTOR_REQUIRE_ADMIN", true)
+	twoFactorIssuer       = getString("MX_TWO_FACTOR_ISSUER", "MarketX")
+)
+
+// Api key configurations, a rotated key keeps working for the grace period
+// MX_WECHAT_TOKENS is deprecated, its tokens are only accepted as wechat
+// keys until MX_WECHAT_TOKENS_UNTIL, never when it is unset
+var (
+	apiKeyRotateGrace = getDuration("MX_API_KEY_ROTATE_GRACE", 24*time.Hour)
+	wechatTokens      = getSecretArray("MX_WECHAT_TOKENS", []string{})
+	wechatTokensUntil = getString("MX_WECHAT_TOKENS_UNTIL", "")
+)
+
+// WeChat OAuth configurations, WeChat login is off without an app id
+var (
+	wechatAppId     = getString("MX_WECHAT_APP_ID", "")
+	wechatAppSecret = getSecret("MX_WECHAT_APP_SECRET", "")
+	wechatOAuthUrl  = getString("MX_WECHAT_OAUTH_URL",
+		"https://api.weixin.qq.com")
+)
+
+// SMS configurations, messages go through MX_SMS_PROVIDER: alidayu, http,
+// or log and file for development
+var (
+	smsProvider           = getString("MX_SMS_PROVIDER", SmsProviderAlidayu)
+	aliDayuAppKey         = getString("ALI_DAYU_APP_KEY", "")
+	aliDayuAppSecret      = getSecret("ALI_DAYU_APP_SECRET", "")
+	aliDayuSignName       = getString("ALI_DAYU_SIGN_NAME", "源投金融")
+	aliDayuVerifyTemplate = getString("ALI_DAYU_VERIFY_TEMPLATE",
+		"SMS_26070193")
+	smsHttpUrl         = getString("MX_SMS_HTTP_URL", "")
+	smsHttpToken       = getSecret("MX_SMS_HTTP_TOKEN", "")
+	smsHttpContentType = getString("MX_SMS_HTTP_CONTENT_TYPE",
+		"application/json")
+	smsHttpBody = getString("MX_SMS_HTTP_BODY",
+		`{"to": {{json .To}}, "text": {{json .Text}}}`)
+	smsFile = getString("MX_SMS_FILE", "sms.log")
+)
+
+// Verification code configurations, a code expires after the ttl or the
+// given number of wrong attempts, and another can only be sent to the same
+// phone number after the resend delay
+var (
+	verifyCodeTtl         = getDuration("MX_VERIFY_CODE_TTL", 15*time.Minute)
+	verifyCodeMaxAttempts = getInt("MX_VERIFY_CODE_MAX_ATTEMPTS", 5)
+	verifyCodeResend      = getDuration("MX_VERIFY_CODE_RESEND", time.Minute)
+	verifyCodeLength      = getInt("MX_VERIFY_CODE_LENGTH", 6)
+)
+
+// Passwordless login configurations, the methods on for the role types no
+// admin has set them for, "none" turns them all off
+var (
+	loginMethodsDefault = getStringArray("MX_LOGIN_METHODS", LoginMethods)
+)
+
+// Phone number configurations, numbers without a country code are read in
+// the default region when the request language has none
+var (
+	phoneDefaultRegion = getString("MX_PHONE_DEFAULT_REGION", "CN")
+)
+
+// Health check and metrics configurations
+var (
+	readyCheckTimeout   = getDuration("MX_READY_CHECK_TIMEOUT", 2*time.Second)
+	readyExternalChecks = getBool("MX_READY_EXTERNAL_CHECKS", false)
+	metricsToken        = getSecret("MX_METRICS_TOKEN", "")
+)
+
 // Authentication configurations
 var (
-	jwtSecretKey         = getString("MX_JWT_SECRET_KEY", nil)
-	aesTextKey           = getString("MX_AES_TEXT_KEY", nil)
-	aesFileKey           = getString("MX_AES_FILE_KEY", nil)
+	jwtSecretKey         = getSecret("MX_JWT_SECRET_KEY", "")
+	jwtKeyringFile       = getString("MX_JWT_KEYRING_FILE", "")
+	jwtClaimsFormat      = getString("MX_JWT_CLAIMS_FORMAT", JwtClaimsStandard)
+	jwtIssuer            = getString("MX_JWT_ISSUER", serverDomain)
+	jwtAudience          = getString("MX_JWT_AUDIENCE", "marketx")
+	jwtLegacyClaimsUntil = getString("MX_JWT_LEGACY_CLAIMS_UNTIL", "")
+	aesTextKey           = getSecret("MX_AES_TEXT_KEY", nil)
+	aesFileKey           = getSecret("MX_AES_FILE_KEY", nil)
 	compSecretPrefix     = getString("MX_COMPANY_SECRET_PREFIX", "xtekram")
 	supportEmailHostname = getString("MX_SUPPORT_EMAIL_HOSTNAME",
 		"smtp.gmail.com")
 	supportEmailPort     = getInt("MX_SUPPORT_EMAIL_PORT", 587)
 	supportEmail         = getString("MX_SUPPORT_EMAIL", nil)
 	supportEmailUsername = getString("MX_SUPPORT_EMAIL_USERNAME", nil)
-	supportEmailPassword = getString("MX_SUPPORT_EMAIL_PASSWORD", nil)
+	supportEmailPassword = getSecret("MX_SUPPORT_EMAIL_PASSWORD", nil)
 	transactUrl          = getString("MX_TRANSACT_URL", nil)
-	transactId           = getString("MX_TRANSACT_ID", nil)
-	transactKey          = getString("MX_TRANSACT_KEY", nil)
+	transactId           = getSecret("MX_TRANSACT_ID", nil)
+	transactKey          = getSecret("MX_TRANSACT_KEY", nil)
 	docusignUrl          = getString("MX_DOCUSIGN_URL",
 		"https://demo.docusign.net/restapi/v2")
-	docusignUsername             = getString("MX_DOCUSIGN_USERNAME", nil)
-	docusignPassword             = getString("MX_DOCUSIGN_PASSWORD", nil)
-	docusignAccountId            = getString("MX_DOCUSIGN_ACCOUNT_ID", nil)
-	docusignIntegratorKey        = getString("MX_DOCUSIGN_INTEGRATOR_KEY", nil)
+	docusignUsername      = getString("MX_DOCUSIGN_USERNAME", nil)
+	docusignPassword      = getSecret("MX_DOCUSIGN_PASSWORD", nil)
+	docusignAccountId     = getString("MX_DOCUSIGN_ACCOUNT_ID", nil)
+	docusignIntegratorKey = getSecret("MX_DOCUSIGN_INTEGRATOR_KEY", nil)
+	useSsl                = getBool("MX_USE_SSL", false)
+)
+
+// DocuSign template configurations
+var (
 	docusignSellEngagementLetter = getString(
 		"MX_DOCUSIGN_SELL_ENGAGEMENT_LETTER",
 		"d59cb209-3602-4d77-ab60-e15a1a2af4e8")
@@ -119,8 +646,4 @@ var (
 	docusignBuyDeSubscriptionAgreement = getString(
 		"MX_DOCUSIGN_BUY_DE_SUBSCRIPTION_AGREEMENT",
 		"5d19273a-5495-4ddf-b942-2dfccc568730")
-	wechatTokens     = getStringArray("MX_WECHAT_TOKENS", []string{})
-	aliDayuAppKey    = getString("ALI_DAYU_APP_KEY", "23532365")
-	aliDayuAppSecret = getString("ALI_DAYU_APP_SECRET", "c9883ac3d0cfbec594e995827ffbedc3")
-	useSsl           = getBool("MX_USE_SSL", false)
 )
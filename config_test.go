@@ -0,0 +1,68 @@
+// Testing for configuration file parsing
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	vals, errs := parseConfig(strings.NewReader(`
+# Comment line
+MX_ENVIRONMENT = "production" # trailing comment
+MX_SERVER_DOMAIN = 'https://themarketx.com'
+PORT = 8443
+MX_USE_SSL = true
+MX_WECHAT_TOKENS = ["a#b", "c"]
+MX_SUPPORT_EMAIL = "support@themarketx.com"
+`))
+	if len(errs) != 0 {
+		t.Fatalf("[Config] parseConfig fails on good file: %v\n", errs)
+	}
+	expected := map[string]string{
+		"MX_ENVIRONMENT":   "production",
+		"MX_SERVER_DOMAIN": "https://themarketx.com",
+		"PORT":             "8443",
+		"MX_USE_SSL":       "true",
+		"MX_WECHAT_TOKENS": "a#b,c",
+		"MX_SUPPORT_EMAIL": "support@themarketx.com",
+	}
+	for k, v := range expected {
+		if vals[k] != v {
+			t.Fatalf("[Config] parseConfig reads %v as %v instead of %v\n",
+				k, vals[k], v)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	_, errs := parseConfig(strings.NewReader(`
+[server]
+PORT = eighty
+MX_ENVIRONMENT = "production
+MX_DATA_DIR
+MX_CLIENT_DIR = "a"
+MX_CLIENT_DIR = "b"
+`))
+	// All problems must be reported at once
+	if len(errs) != 5 {
+		t.Fatalf("[Config] parseConfig reports %v errors instead of 5: %v\n",
+			len(errs), errs)
+	}
+}
+
+func TestCheckHexKey(t *testing.T) {
+	configProblems = nil
+	checkHexKey("KEY", strings.Repeat("11", 32), 32)
+	if len(configProblems) != 0 {
+		t.Fatalf("[Config] checkHexKey fails on good key: %v\n",
+			configProblems)
+	}
+	checkHexKey("KEY", "zz", 32)
+	checkHexKey("KEY", "1111", 32)
+	if len(configProblems) != 2 {
+		t.Fatalf("[Config] checkHexKey does not fail on bad keys: %v\n",
+			configProblems)
+	}
+	configProblems = nil
+}
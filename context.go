@@ -0,0 +1,133 @@
+// Request context for MarketX api calls
+// logProtect attaches a typed context to every api request carrying its
+// request id, negotiated locale, client ip and, once authenticated, the
+// user. Handlers read it from r.Context() and still work when called
+// without logProtect, e.g. in tests.
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	RequestIdHeader = "X-Request-ID"
+	requestIdMax    = 128
+	defaultLang     = "en-US"
+)
+
+// requestContextKey is the r.Context() key of the request context
+type requestContextKey struct{}
+
+// requestContext is the per-request state of an api call
+type requestContext struct {
+	id    string
+	lang  string
+	ip    string
+	start time.Time
+	user  *User
+
+	// Session of the access token, 0 for tokens from before sessions, and
+	// whether its login was verified with a second factor
+	session   uint
+	twoFactor bool
+
+	// Permissions of the roles of an admin
+	perms map[Permission]bool
+
+	// Api key of a machine integration call
+	apiKey *ApiKey
+
+	// Set by formatReturnJson for the request log and metrics
+	returned  bool
+	errorCode ErrorCode
+	response  string
+}
+
+// newRequestContext creates the context of r, keeping a valid request id
+// sent by an upstream proxy
+func newRequestContext(r *http.Request) *requestContext {
+	id := r.Header.Get(RequestIdHeader)
+	if !validRequestId(id) {
+		id = newRequestId()
+	}
+	return &requestContext{id: id, lang: negotiateLang(r),
+		ip: resolveClientIp(r), start: time.Now()}
+}
+
+// withRequestContext returns r carrying rc
+func withRequestContext(r *http.Request, rc *requestContext) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey{},
+		rc))
+}
+
+// getRequestContext returns the context of r, or a fresh one if r did not
+// go through logProtect
+func getRequestContext(r *http.Request) *requestContext {
+	if rc, ok := r.Context().Value(requestContextKey{}).(*requestContext); ok {
+		return rc
+	}
+	return newRequestContext(r)
+}
+
+// requestLang returns the negotiated locale of r
+func requestLang(r *http.Request) string {
+	return getRequestContext(r).lang
+}
+
+// requestId returns the request id of r
+func requestId(r *http.Request) string {
+	return getRequestContext(r).id
+}
+
+// newRequestId generates a random request id
+func newRequestId() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestId makes sure a forwarded request id is safe to log and echo
+func validRequestId(id string) bool {
+	if id == "" || len(id) > requestIdMax {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiateLang picks a supported locale from the Language header or,
+// failing that, Accept-Language, defaulting to English
+func negotiateLang(r *http.Request) string {
+	if l := r.Header.Get("Language"); ErrorCodes[l] != nil {
+		return l
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		for l := range ErrorCodes {
+			if strings.EqualFold(tag, l) {
+				return l
+			}
+		}
+		// Fall back to the language without region, e.g. zh-TW -> zh-CN
+		base := strings.SplitN(tag, "-", 2)[0]
+		for l := range ErrorCodes {
+			if strings.EqualFold(base, strings.SplitN(l, "-", 2)[0]) {
+				return l
+			}
+		}
+	}
+	return defaultLang
+}
@@ -0,0 +1,63 @@
+// Testing for the api request context
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestNegotiateLang(t *testing.T) {
+	for _, c := range []struct{ language, accept, expected string }{
+		{"", "", "en-US"},
+		{"zh-CN", "", "zh-CN"},
+		{"fr-FR", "", "en-US"},
+		{"", "fr-FR, zh-TW;q=0.8, en;q=0.5", "zh-CN"},
+		{"", "en-GB", "en-US"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Language", c.language)
+		r.Header.Set("Accept-Language", c.accept)
+		if l := negotiateLang(r); l != c.expected {
+			t.Fatalf("[Context] %v/%v negotiated %v, expected %v\n",
+				c.language, c.accept, l, c.expected)
+		}
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	var seen string
+	h := logProtect(func(w http.ResponseWriter, r *http.Request,
+		ps httprouter.Params) {
+		seen = requestId(r)
+	})
+	defer func(l *Logger) { serverLog = l }(serverLog)
+	serverLog = newLogger(ioutil.Discard, LogLevelError, false)
+
+	// Forwarded ids are kept and echoed
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(RequestIdHeader, "abc-123")
+	w := httptest.NewRecorder()
+	h(w, r, nil)
+	if seen != "abc-123" || w.Header().Get(RequestIdHeader) != "abc-123" {
+		t.Fatalf("[Context] Forwarded id not kept: %v\n", seen)
+	}
+
+	// Unsafe ids are replaced
+	r.Header.Set(RequestIdHeader, "abc\n123")
+	w = httptest.NewRecorder()
+	h(w, r, nil)
+	if seen == "abc\n123" || len(seen) != 32 ||
+		w.Header().Get(RequestIdHeader) != seen {
+		t.Fatalf("[Context] Unsafe id not replaced: %q\n", seen)
+	}
+
+	// Handlers also work without logProtect
+	r = httptest.NewRequest("GET", "/", nil)
+	if requestLang(r) != "en-US" || requestId(r) == "" {
+		t.Fatal("[Context] No default context without logProtect\n")
+	}
+}
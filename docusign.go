@@ -27,6 +27,7 @@ type Docusign struct {
 	accountId     string
 	integratorKey string
 	quiet         bool
+	requestId     string
 }
 
 var (
@@ -53,32 +54,41 @@ var (
 	docusignReturnUrl   = serverDomain + "/u/#/pages/sign/"
 )
 
-// log checks to see if we should log to server or just stdout
-// for testing purposes
-func (d *Docusign) log(format string, a ...interface{}) {
-	fmt.Printf(format, a...)
-	if d.quiet {
-		return
-	}
-	if serverLog != nil {
-		serverLog.Printf(format, a...)
-	} else {
-		fmt.Printf(format, a...)
-	}
+// logger returns the logger of an api call, which discards everything
+// when quiet for testing purposes
+func (d *Docusign) logger(reqId int64) *Logger {
+	return outboundLogger(d.quiet, "docusign", reqId, d.requestId)
 }
 
-// request takes a call and params to construct a call to DocuSign API
-// and parses response and returns response body for parsing
+// forRequest returns a copy of the client forwarding the request id of r
+// to DocuSign
+func (d *Docusign) forRequest(r *http.Request) *Docusign {
+	n := *d
+	n.requestId = requestId(r)
+	return &n
+}
+
+// request wraps doRequest with latency and outcome metrics
 func (d *Docusign) request(method, call string,
 	params map[string]interface{}, raw bool) (map[string]interface{}, error) {
-	fmt.Printf("on docusign requested")
+	start := time.Now()
+	data, err := d.doRequest(method, call, params, raw)
+	observeOutbound("docusign", call, start, err)
+	return data, err
+}
+
+// doRequest takes a call and params to construct a call to DocuSign API
+// and parses response and returns response body for parsing
+func (d *Docusign) doRequest(method, call string,
+	params map[string]interface{}, raw bool) (map[string]interface{}, error) {
 	reqId := rand.Int63()
+	reqLog := d.logger(reqId)
 	// Encode POST and GET differently
 	var args string
 	if method == "POST" {
 		jp, err := json.Marshal(params)
 		if err != nil {
-			d.log("[MXDSAPI] (%v) REQ: %v\n", reqId, err)
+			reqLog.Error("request error", LogFields{"error": err})
 			return nil, DocusignErrorParams
 		}
 		args = string(jp)
@@ -94,16 +104,21 @@ func (d *Docusign) request(method, call string,
 		args = form.Encode()
 	}
 	url := d.url + "/accounts/" + d.accountId + "/" + call
-	// Log before any error will happen
-	d.log("[MXDSAPI] (%v) %v: %v?%v\n", reqId, method, url, args)
+	// Log before any error will happen, without recipient details
+	reqLog.Info("request", LogFields{"method": method, "url": url,
+		"params": redactJson(params, docusignRedact)})
 	req, err := http.NewRequest(method, url, strings.NewReader(args))
 	if err != nil {
-		d.log("[MXDSAPI] (%v) REQ: %v\n", reqId, err)
+		reqLog.Error("request error", LogFields{"error": err})
 		return nil, DocusignErrorRequest
 	}
 	// Always use json format as required
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
+	// Let the request be traced across services
+	if d.requestId != "" {
+		req.Header.Set(RequestIdHeader, d.requestId)
+	}
 	// Set authentication
 	req.Header.Set("X-DocuSign-Authentication",
 		"<DocuSignCredentials><Username>"+d.username+
@@ -115,7 +130,7 @@ func (d *Docusign) request(method, call string,
 	client := &http.Client{Timeout: time.Duration(docusignTimeout)}
 	resp, err := client.Do(req)
 	if err != nil {
-		d.log("[MXDSAPI] (%v) NET: %v\n", reqId, err)
+		reqLog.Warn("network error", LogFields{"error": err})
 		return nil, DocusignErrorNetwork
 	}
 	// Caller must close
@@ -123,18 +138,18 @@ func (d *Docusign) request(method, call string,
 
 	// Ignore error while parsing, read as many
 	b, _ := ioutil.ReadAll(resp.Body)
-	body := string(b)
 
 	// If http response error, we should not parse the data structure at all
 	if (method == "POST" && resp.StatusCode != http.StatusCreated) ||
 		(method != "POST" && resp.StatusCode != http.StatusOK) {
-		d.log("[MXDSAPI] (%v) API(%v): %v\n", reqId, resp.StatusCode, body)
+		reqLog.Warn("api error", LogFields{"status": resp.StatusCode,
+			"response": redactBody(b, docusignRedact)})
 		return nil, DocusignErrorAPI
 	}
 
 	// Return bytes if reading binary
 	if raw {
-		d.log("[MXDSAPI] (%v) DONE: <binary>\n", reqId)
+		reqLog.Info("response", LogFields{"response": "<binary>"})
 		return map[string]interface{}{"raw": b}, nil
 	}
 
@@ -142,11 +157,13 @@ func (d *Docusign) request(method, call string,
 	var data map[string]interface{}
 	err = json.Unmarshal(b, &data)
 	if err != nil {
-		d.log("[MXDSAPI] (%v) RES: %v\n", reqId, body)
+		reqLog.Warn("invalid response",
+			LogFields{"response": redactBody(b, docusignRedact)})
 		return nil, DocusignErrorResponse
 	}
 
-	d.log("[MXDSAPI] (%v) DONE: %v\n", reqId, data)
+	reqLog.Info("response",
+		LogFields{"response": redactJson(data, docusignRedact)})
 	return data, nil
 }
 
@@ -12,8 +12,9 @@ import (
 func testDocusign(t *testing.T, template string,
 	args map[string]interface{}, dur time.Duration, pdf string) {
 	// Setup api
-	mxds := Docusign{docusignUrl, docusignUsername, docusignPassword,
-		docusignAccountId, docusignIntegratorKey, false}
+	mxds := Docusign{url: docusignUrl, username: docusignUsername,
+		password: docusignPassword, accountId: docusignAccountId,
+		integratorKey: docusignIntegratorKey}
 
 	cuid := "12345"
 	email := "zhaiyifan56@gmail.com"
@@ -0,0 +1,235 @@
+// Health checks for MarketX
+// /healthz only tells that the process is up, /readyz checks the
+// dependencies the server needs to handle requests and is what load
+// balancers should route on. Each check runs with a timeout, results are
+// reused for readyCacheTtl, and only callers with the metrics token see
+// the errors and durations of the json breakdown.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	HealthStatusOk   = "ok"
+	HealthStatusFail = "fail"
+	readyCacheTtl    = 5 * time.Second
+)
+
+// healthCheck is a named dependency check, failing optional checks are
+// reported but do not make the server unready
+type healthCheck struct {
+	name     string
+	optional bool
+	check    func(ctx context.Context) error
+}
+
+// healthResult is the json breakdown of a single check
+type healthResult struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Optional   bool   `json:"optional,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+}
+
+// readyCache keeps the last /readyz results so anonymous callers cannot
+// make every request run the checks
+var readyCache struct {
+	lock    sync.Mutex
+	at      time.Time
+	ok      bool
+	results map[string]healthResult
+}
+
+// readyChecks returns the checks run by /readyz
+func readyChecks() []healthCheck {
+	checks := []healthCheck{
+		{"database", false, checkDatabase},
+		{"data_dir", false, checkDataDir},
+		{"aes_keys", false, checkAesKeys},
+	}
+	if readyExternalChecks {
+		checks = append(checks,
+			healthCheck{"transact", true, checkHttpReachable(transactUrl)},
+			healthCheck{"docusign", true, checkHttpReachable(docusignUrl)},
+			healthCheck{"smtp", true, checkTcpReachable(fmt.Sprintf("%v:%v",
+				supportEmailHostname, supportEmailPort))})
+	}
+	return checks
+}
+
+// checkDatabase pings the database connection
+func checkDatabase(ctx context.Context) error {
+	if dbConn == nil {
+		return fmt.Errorf("not connected")
+	}
+	return dbConn.DB().PingContext(ctx)
+}
+
+// checkDataDir makes sure uploads can be written to the data directory
+func checkDataDir(ctx context.Context) error {
+	f, err := ioutil.TempFile(dataDir, ".readyz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkAesKeys makes sure the encryption keys decode to valid lengths
+func checkAesKeys(ctx context.Context) error {
+	if _, err := decodeHexKey("MX_AES_TEXT_KEY", aesTextKey,
+		16, 24, 32); err != nil {
+		return err
+	}
+	_, err := decodeHexKey("MX_AES_FILE_KEY", aesFileKey, 16, 24, 32)
+	return err
+}
+
+// checkHttpReachable creates a check that any http response comes back
+// from url, error statuses included
+func checkHttpReachable(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest("HEAD", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+}
+
+// checkTcpReachable creates a check that addr accepts tcp connections
+func checkTcpReachable(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// runHealthChecks runs all checks concurrently, each bounded by timeout,
+// and returns whether every required check passed
+func runHealthChecks(checks []healthCheck,
+	timeout time.Duration) (bool, map[string]healthResult) {
+	var (
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		ok      = true
+		results = map[string]healthResult{}
+	)
+	for _, hc := range checks {
+		wg.Add(1)
+		go func(hc healthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			// Checks not honoring the context still time out
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() {
+				done <- hc.check(ctx)
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = fmt.Errorf("timed out after %v", timeout)
+			}
+
+			hr := healthResult{Status: HealthStatusOk, Optional: hc.optional,
+				DurationMs: int64(time.Since(start) / time.Millisecond)}
+			if err != nil {
+				hr.Status = HealthStatusFail
+				hr.Error = err.Error()
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			results[hc.name] = hr
+			if err != nil && !hc.optional {
+				ok = false
+			}
+		}(hc)
+	}
+	wg.Wait()
+	return ok, results
+}
+
+// writeHealth writes a health json response
+func writeHealth(w http.ResponseWriter, ok bool, ret map[string]interface{}) {
+	ret["status"] = HealthStatusOk
+	code := http.StatusOK
+	if !ok {
+		ret["status"] = HealthStatusFail
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ret)
+}
+
+// healthzHandler reports that the process is up
+func healthzHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	writeHealth(w, true, map[string]interface{}{})
+}
+
+// cachedReadyChecks returns the ready check results of the last
+// readyCacheTtl, running the checks again once they are older
+func cachedReadyChecks(now time.Time) (bool, map[string]healthResult) {
+	readyCache.lock.Lock()
+	defer readyCache.lock.Unlock()
+	if readyCache.results != nil && now.Sub(readyCache.at) < readyCacheTtl {
+		return readyCache.ok, readyCache.results
+	}
+	ok, results := runHealthChecks(readyChecks(), readyCheckTimeout)
+	if !ok {
+		serverLog.Warn("not ready", LogFields{"checks": results})
+	}
+	readyCache.at, readyCache.ok, readyCache.results = now, ok, results
+	return ok, results
+}
+
+// publicHealthResults strips the errors and durations of results, which
+// can tell hosts and credentials
+func publicHealthResults(
+	results map[string]healthResult) map[string]healthResult {
+	ret := map[string]healthResult{}
+	for name, hr := range results {
+		ret[name] = healthResult{Status: hr.Status, Optional: hr.Optional}
+	}
+	return ret
+}
+
+// readyzHandler reports whether the server can handle requests
+func readyzHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	ok, results := cachedReadyChecks(time.Now())
+	if !metricsTokenValid(r) {
+		results = publicHealthResults(results)
+	}
+	writeHealth(w, ok, map[string]interface{}{"checks": results})
+}
@@ -0,0 +1,75 @@
+// Testing for health checks
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	pass := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("down") }
+	hang := func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}
+
+	ok, results := runHealthChecks([]healthCheck{{"a", false, pass},
+		{"b", true, fail}}, 100*time.Millisecond)
+	if !ok || results["a"].Status != HealthStatusOk ||
+		results["b"].Status != HealthStatusFail ||
+		results["b"].Error != "down" {
+		t.Fatalf("[Health] Optional failure makes unready: %v\n", results)
+	}
+
+	start := time.Now()
+	ok, results = runHealthChecks([]healthCheck{{"a", false, pass},
+		{"c", false, hang}}, 100*time.Millisecond)
+	if ok || results["c"].Status != HealthStatusFail {
+		t.Fatalf("[Health] Hanging check does not fail: %v\n", results)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("[Health] Hanging check is not timed out\n")
+	}
+}
+
+func TestReadyzDetails(t *testing.T) {
+	defer func(token string) { metricsToken = token }(metricsToken)
+	metricsToken = "secret"
+	readyCache.lock.Lock()
+	readyCache.at, readyCache.ok = time.Now(), false
+	readyCache.results = map[string]healthResult{"database": {
+		Status: HealthStatusFail, Error: "dial tcp db.internal:5432",
+		DurationMs: 3}}
+	readyCache.lock.Unlock()
+	defer func() {
+		readyCache.lock.Lock()
+		readyCache.results = nil
+		readyCache.lock.Unlock()
+	}()
+
+	get := func(auth string) string {
+		r := httptest.NewRequest("GET", "/readyz", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		readyzHandler(w, r, nil)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("[Health] Unready server gives %v\n", w.Code)
+		}
+		return w.Body.String()
+	}
+	if b := get(""); strings.Contains(b, "db.internal") ||
+		strings.Contains(b, "duration_ms") || !strings.Contains(b, `"fail"`) {
+		t.Fatalf("[Health] Anonymous readyz shows details: %v\n", b)
+	}
+	if b := get("Bearer secret"); !strings.Contains(b, "db.internal") {
+		t.Fatalf("[Health] Token readyz hides details: %v\n", b)
+	}
+}
@@ -44,22 +44,24 @@ var (
 	hellosignTimeout = 30 * time.Second
 )
 
-// log checks to see if we should log to server or just stdout
-// for testing purposes
-func (h *Hellosign) log(format string, a ...interface{}) {
-	if h.quiet {
-		return
-	}
-	if serverLog != nil {
-		serverLog.Printf(format, a...)
-	} else {
-		fmt.Printf(format, a...)
-	}
+// logger returns the logger of an api call, which discards everything
+// when quiet for testing purposes
+func (h *Hellosign) logger(reqId int64) *Logger {
+	return outboundLogger(h.quiet, "hellosign", reqId, "")
 }
 
-// request takes a call and params to construct a call to HelloSign API
-// and parses response and returns response body for parsing
+// request wraps doRequest with latency and outcome metrics
 func (h *Hellosign) request(call string,
+	params map[string]string) (map[string]interface{}, error) {
+	start := time.Now()
+	data, err := h.doRequest(call, params)
+	observeOutbound("hellosign", call, start, err)
+	return data, err
+}
+
+// doRequest takes a call and params to construct a call to HelloSign API
+// and parses response and returns response body for parsing
+func (h *Hellosign) doRequest(call string,
 	params map[string]string) (map[string]interface{}, error) {
 	form := url.Values{}
 	// Create form with all params
@@ -68,12 +70,14 @@ func (h *Hellosign) request(call string,
 	}
 	args := form.Encode()
 	reqId := rand.Int63()
+	reqLog := h.logger(reqId)
 	url := h.url + "/" + call
-	// Log before any error will happen
-	h.log("[MXHSAPI] (%v) %v: %v?%v\n", reqId, "POST", url, args)
+	// Log before any error will happen, without signer details
+	reqLog.Info("request", LogFields{"method": "POST", "url": url,
+		"params": redactValues(form, hellosignRedact)})
 	req, err := http.NewRequest("POST", url, strings.NewReader(args))
 	if err != nil {
-		h.log("[MXHSAPI] (%v) REQ: %v\n", reqId, err)
+		reqLog.Error("request error", LogFields{"error": err})
 		return nil, HellosignErrorRequest
 	}
 	// Always use url-encoded here
@@ -85,7 +89,7 @@ func (h *Hellosign) request(call string,
 	client := &http.Client{Timeout: time.Duration(hellosignTimeout)}
 	resp, err := client.Do(req)
 	if err != nil {
-		h.log("[MXHSAPI] (%v) NET: %v\n", reqId, err)
+		reqLog.Warn("network error", LogFields{"error": err})
 		return nil, HellosignErrorNetwork
 	}
 	// Caller must close
@@ -93,11 +97,11 @@ func (h *Hellosign) request(call string,
 
 	// Ignore error while parsing, read as many
 	b, _ := ioutil.ReadAll(resp.Body)
-	body := string(b)
 
 	// If http response error, we should not parse the data structure at all
 	if resp.StatusCode != http.StatusOK {
-		h.log("[MXHSAPI] (%v) API(%v): %v\n", reqId, resp.StatusCode, body)
+		reqLog.Warn("api error", LogFields{"status": resp.StatusCode,
+			"response": redactBody(b, hellosignRedact)})
 		return nil, HellosignErrorAPI
 	}
 
@@ -105,11 +109,13 @@ func (h *Hellosign) request(call string,
 	var data map[string]interface{}
 	err = json.Unmarshal(b, &data)
 	if err != nil {
-		h.log("[MXHSAPI] (%v) RES: %v\n", reqId, body)
+		reqLog.Warn("invalid response",
+			LogFields{"response": redactBody(b, hellosignRedact)})
 		return nil, HellosignErrorResponse
 	}
 
-	h.log("[MXHSAPI] (%v) DONE: %v\n", reqId, data)
+	reqLog.Info("response",
+		LogFields{"response": redactJson(data, hellosignRedact)})
 	return data, nil
 }
 
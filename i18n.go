@@ -85,6 +85,32 @@ const (
 	ErrorCodeAdminCompanyUpdatesError
 	ErrorCodeKeywordError
 	ErrorCodeIdError
+	ErrorFmtCodeTooManyRequests
+	ErrorFmtCodeAccountLocked
+	ErrorCodeUnlockTokenInvalid
+	ErrorCodeRefreshTokenInvalid
+	ErrorCodeSessionRevoked
+	ErrorCodeSessionUnknown
+	ErrorCodeTwoFactorRequired
+	ErrorCodeTwoFactorInvalid
+	ErrorCodeTwoFactorSetupRequired
+	ErrorCodeTwoFactorEnabled
+	ErrorCodeTwoFactorNotEnabled
+	ErrorCodeTwoFactorMandatory
+	ErrorCodeRoleUnknown
+	ErrorCodeRoleLastSuperAdmin
+	ErrorCodeApiKeyUnknown
+	ErrorCodeApiKeyScopeError
+	ErrorCodeWechatUnbound
+	ErrorCodeWechatCodeError
+	ErrorCodeWechatUnavailable
+	ErrorCodeSmsError
+	ErrorCodeVerifyCodeExpired
+	ErrorCodeVerifyCodeLocked
+	ErrorFmtCodeVerifyCodeWait
+	ErrorCodeLoginMethodDisabled
+	ErrorCodeLoginLinkInvalid
+	ErrorCodeLoginLinkError
 	ErrorCodeUnknown
 	ErrorCodeNone = 99999
 )
@@ -171,6 +197,32 @@ var ErrorCodes = map[string][]string{
 		"Company updates are invalid",
 		"Keyword is invalid",
 		"ID is invalid",
+		"Too many requests, please try again in %v seconds",
+		"Account is locked after too many failed logins, please try again in %v minutes or use the unlock link sent to your email",
+		"Unlock link is invalid or has expired",
+		"Refresh token is invalid or has expired, please log in again",
+		"Login session has been signed out, please log in again",
+		"Session does not exist",
+		"Two-factor code is required, please enter the code from your authenticator app",
+		"Two-factor code is invalid",
+		"Two-factor authentication must be enabled for this account",
+		"Two-factor authentication is already enabled",
+		"Two-factor authentication is not set up",
+		"Two-factor authentication cannot be disabled for this account",
+		"Role is invalid",
+		"At least one super admin must remain",
+		"API key does not exist or is no longer active",
+		"API key scopes are invalid",
+		"Wechat account is not bound to any user",
+		"Wechat authorization code is invalid or has expired",
+		"Wechat login is not available",
+		"Text message could not be sent, please try again later",
+		"Verification code has expired, please request a new one",
+		"Too many wrong verification codes, please request a new one",
+		"Please wait %v seconds before requesting another verification code",
+		"This login method is not available for your account",
+		"Login link is invalid or has expired",
+		"Login link could not be sent, please try again later",
 		"Unknown error",
 	},
 	"zh-CN": []string{
@@ -254,6 +306,32 @@ var ErrorCodes = map[string][]string{
 		"公司新闻不合法",
 		"关键词不合法",
 		"ID 不合法",
+		"请求过于频繁，请在 %v 秒后重试",
+		"登录失败次数过多，帐号已被锁定，请在 %v 分钟后重试或使用发送到您邮箱的解锁链接",
+		"解锁链接不合法或已过期",
+		"刷新令牌不合法或已过期，请重新登录",
+		"登录会话已退出，请重新登录",
+		"会话不存在",
+		"需要两步验证码，请输入身份验证器应用中的验证码",
+		"两步验证码不正确",
+		"此帐号必须开启两步验证",
+		"两步验证已开启",
+		"两步验证尚未设置",
+		"此帐号不能关闭两步验证",
+		"角色不合法",
+		"至少需要保留一位超级管理员",
+		"API 密钥不存在或已失效",
+		"API 密钥权限范围不合法",
+		"微信帐号未绑定任何用户",
+		"微信授权码不合法或已过期",
+		"微信登录暂不可用",
+		"短信发送失败，请稍后重试",
+		"验证码已过期，请重新获取",
+		"验证码错误次数过多，请重新获取",
+		"请等待%v秒后再获取验证码",
+		"您的帐号不支持此登录方式",
+		"登录链接不合法或已过期",
+		"登录链接发送失败，请稍后重试",
 		"未知错误",
 	},
 }
@@ -284,6 +362,12 @@ const (
 	EmailTextBodyInvestorApproved
 	EmailTextSubjectShareholderApproved
 	EmailTextBodyShareholderApproved
+	EmailTextSubjectAccountLocked
+	EmailTextBodyAccountLocked
+	EmailTextSubjectNewSignIn
+	EmailTextBodyNewSignIn
+	EmailTextSubjectLoginLink
+	EmailTextBodyLoginLink
 )
 
 var EmailTexts = map[string][]string{
@@ -354,6 +438,50 @@ International SWIFT BIC: WFBIUS6S</p>
 
 <p>Best regards,</p>
 
+<p>Team MarketX</p>
+`,
+		"Your MarketX account has been locked",
+		`<p>Hello %v,</p>
+
+<p>Your account has been locked for %v minutes after %v failed login attempts in a row.</p>
+
+<p>If it was you, you can unlock your account right away through the link below. If it wasn't, we recommend that you change your password once you are signed in again.</p>
+
+<p><a href="%v">Unlock Your Account</a></p>
+
+<p>Best regards,</p>
+
+<p>Team MarketX</p>
+`,
+		"New sign-in to your MarketX account",
+		`<p>Hello %v,</p>
+
+<p>Your account was just signed in to from a new location or device:</p>
+
+<p>Time: %v<br>
+IP address: %v<br>
+Device: %v</p>
+
+<p>If this was you, you can ignore this email. If not, please reset your password right away.</p>
+
+<p>Best regards,</p>
+
+<p>Team MarketX</p>
+`,
+		"Sign in to MarketX",
+		`<p>Hello %v,</p>
+
+<p>Click the link below to sign in to your MarketX account. The link works once and expires in %v minutes.</p>
+
+<p><a href="%v">Sign In</a></p>
+
+<p>If the link doesn't work, you could also use this link to sign in:<br>
+%v</p>
+
+<p>If you didn't request this, please ignore this email.</p>
+
+<p>Best regards,</p>
+
 <p>Team MarketX</p>
 `,
 	},
@@ -427,6 +555,50 @@ International SWIFT BIC: WFBIUS6S</p>
 
 <p>致礼！</p>
 
+<p>源投金融团队</p>
+		`,
+		"您的源投金融帐号已被锁定",
+		`<p>%v您好！</p>
+
+<p>由于连续登录失败，您的帐号已被锁定 %v 分钟（失败次数：%v）。</p>
+
+<p>如果是您本人操作，您可以通过下方链接立即解锁帐号。如果不是，建议您在登录后尽快修改密码。</p>
+
+<p><a href="%v">解锁帐号</a></p>
+
+<p>致礼！</p>
+
+<p>源投金融团队</p>
+		`,
+		"您的源投金融帐号有新的登录",
+		`<p>%v您好！</p>
+
+<p>您的帐号刚刚在新的地点或设备上登录：</p>
+
+<p>时间：%v<br>
+IP 地址：%v<br>
+设备：%v</p>
+
+<p>如果是您本人操作，请忽略此邮件。如果不是，请立即重置您的密码。</p>
+
+<p>致礼！</p>
+
+<p>源投金融团队</p>
+		`,
+		"登录源投金融",
+		`<p>%v您好！</p>
+
+<p>请点击以下链接登录您的源投金融帐号。此链接仅可使用一次，%v分钟后失效。</p>
+
+<p><a href="%v">登录</a></p>
+
+<p>如果以上链接失效，您也可以使用以下链接登录：<br>
+%v</p>
+
+<p>如果您并没有做此申请，请您忽略这条邮件。</p>
+
+<p>致礼！</p>
+
 <p>源投金融团队</p>
 		`,
 	},
@@ -460,6 +632,19 @@ var SignTexts = map[string][]string{
 	},
 }
 
+const (
+	SmsTextVerifyCode = iota
+)
+
+var SmsTexts = map[string][]string{
+	"en-US": []string{
+		"[MarketX] Your verification code is %v, valid for %v minutes.",
+	},
+	"zh-CN": []string{
+		"【MarketX】您的验证码为%v，%v分钟内有效。",
+	},
+}
+
 var SharesTypeTexts = map[string][]string{
 	"en-US": []string{
 		"Preferred Shares",
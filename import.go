@@ -0,0 +1,665 @@
+// CSV data import for MarketX
+// Loads tags, companies, fundings, executives and updates from the csv files
+// in a data directory. Rows are matched to existing records by a natural key
+// and updated in place, so the same files can be imported again to refresh
+// company data. Every row is validated and nothing is saved unless the
+// whole import is clean.
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// importFile describes a csv file, columns are listed in the order of the
+// legacy positional layout
+// Files with a header naming all of them may reorder columns and also give
+// the optional companies.csv columns state_founded, video_url and live_deal.
+type importFile struct {
+	name    string
+	columns []string
+}
+
+var (
+	importTags = importFile{"tags.csv",
+		[]string{"name", "name_cn"}}
+	importCompanies = importFile{"companies.csv",
+		[]string{"name", "description", "description_cn", "year_founded",
+			"hq", "home_page", "key_person", "num_employees",
+			"total_valuation", "total_funding", "growth_rate_percent",
+			"size_multiple", "tags", "investors", "investor_logo_pics",
+			"num_slides"}}
+	importFundings = importFile{"fundings.csv",
+		[]string{"company", "type", "date", "amount", "raised_to_date",
+			"pre_valuation", "post_valuation", "status", "stage",
+			"num_shares", "par_value", "dividend_rate",
+			"original_issue_price", "liquidation",
+			"liquidation_pref_multiple", "conversion_price",
+			"percent_owned"}}
+	importExecutives = importFile{"company_executives.csv",
+		[]string{"company", "name", "role", "office"}}
+	importUpdates = importFile{"company_updates.csv",
+		[]string{"company", "title", "url", "date", "language"}}
+)
+
+// importReport collects the per-row errors and outcome of an import
+type importReport struct {
+	files     []string
+	errors    []string
+	created   map[string]int
+	updated   map[string]int
+	unchanged map[string]int
+	skipped   map[string]bool
+}
+
+func newImportReport() *importReport {
+	return &importReport{created: map[string]int{}, updated: map[string]int{},
+		unchanged: map[string]int{}, skipped: map[string]bool{}}
+}
+
+// write prints a summary line per file followed by every row error
+func (rp *importReport) write(w io.Writer) {
+	for _, f := range rp.files {
+		if rp.skipped[f] {
+			fmt.Fprintf(w, "%v: skipped, file not found\n", f)
+			continue
+		}
+		fmt.Fprintf(w, "%v: %v created, %v updated, %v unchanged\n", f,
+			rp.created[f], rp.updated[f], rp.unchanged[f])
+	}
+	for _, e := range rp.errors {
+		fmt.Fprintln(w, e)
+	}
+}
+
+// csvTable is a csv file with its columns resolved by header name
+type csvTable struct {
+	file string
+	cols map[string]int
+	rows []*csvRow
+}
+
+// csvRow is one data row of a csvTable and the validation errors found
+type csvRow struct {
+	table *csvTable
+	line  int
+	rec   []string
+	errs  []string
+}
+
+// importColumn normalizes a header name, e.g. "Name CN" -> name_cn
+func importColumn(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.Replace(s, " ", "_", -1)
+	return strings.Replace(s, "-", "_", -1)
+}
+
+// parseCsvTable reads a csv file, with the first row being either header
+// names or, for files in the legacy layout, ignored column titles
+func parseCsvTable(in io.Reader, f importFile) (*csvTable, error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", f.name, err)
+	}
+
+	t := &csvTable{file: f.name, cols: map[string]int{}}
+	for i, h := range header {
+		t.cols[importColumn(h)] = i
+	}
+	named := true
+	for _, c := range f.columns {
+		if _, ok := t.cols[c]; !ok {
+			named = false
+		}
+	}
+	if !named {
+		if len(header) < len(f.columns) {
+			return nil, fmt.Errorf("%v: header needs the columns %v", f.name,
+				strings.Join(f.columns, ","))
+		}
+		t.cols = map[string]int{}
+		for i, c := range f.columns {
+			t.cols[c] = i
+		}
+	}
+
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", f.name, err)
+		}
+		line, _ := r.FieldPos(0)
+		if strings.TrimSpace(strings.Join(rec, "")) == "" {
+			continue
+		}
+		t.rows = append(t.rows, &csvRow{table: t, line: line, rec: rec})
+	}
+	return t, nil
+}
+
+// readCsvTable opens and parses a csv file in dir, nil if it does not exist
+func readCsvTable(dir string, f importFile) (*csvTable, error) {
+	in, err := os.Open(path.Join(dir, f.name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return parseCsvTable(in, f)
+}
+
+// has checks whether the file gives a column
+func (t *csvTable) has(col string) bool {
+	_, ok := t.cols[col]
+	return ok
+}
+
+// fail records a validation error of a column
+func (r *csvRow) fail(col, format string, a ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf("%v:%v: %v: %v", r.table.file,
+		r.line, col, fmt.Sprintf(format, a...)))
+}
+
+// get returns the trimmed value of a column, empty if not given
+func (r *csvRow) get(col string) string {
+	i, ok := r.table.cols[col]
+	if !ok || i >= len(r.rec) {
+		return ""
+	}
+	return strings.TrimSpace(r.rec[i])
+}
+
+// field returns a required non-empty string column
+func (r *csvRow) field(col string) string {
+	s, ok := CheckField(true, r.get(col))
+	if !ok {
+		r.fail(col, "required, up to %v characters", StringMax)
+	}
+	return s
+}
+
+// text returns an optional string column of at most max characters
+func (r *csvRow) text(col string, max uint64) string {
+	s, ok := CheckLength(true, r.get(col), 0, max)
+	if !ok {
+		r.fail(col, "up to %v characters", max)
+	}
+	return s
+}
+
+// number returns an unsigned integer column, empty being 0
+func (r *csvRow) number(col string, max uint64) uint64 {
+	s := r.get(col)
+	if s == "" {
+		return 0
+	}
+	n, ok := CheckRange(true, s, max)
+	if !ok {
+		r.fail(col, "%q is not a number up to %v", s, max)
+	}
+	return n
+}
+
+// float returns a decimal column, empty being 0
+func (r *csvRow) float(col string, pos bool) float64 {
+	s := r.get(col)
+	if s == "" {
+		return 0.0
+	}
+	f, ok := CheckFloat(true, s, pos)
+	if !ok {
+		r.fail(col, "%q is not a valid number", s)
+	}
+	return f
+}
+
+// money returns an amount like $1.5B or $300M in billions, empty or 0
+// being 0
+func (r *csvRow) money(col string) float64 {
+	s := r.get(col)
+	if s == "" || s == "0" {
+		return 0.0
+	}
+	unit := s[len(s)-1]
+	f, ok := CheckFloat(len(s) > 2 && s[0] == '$', s[1:len(s)-1], true)
+	if !ok || (unit != 'B' && unit != 'M') {
+		r.fail(col, "%q is not an amount like $1.5B or $300M", s)
+		return 0.0
+	}
+	if unit == 'M' {
+		f /= 1000.0
+	}
+	return f
+}
+
+// multiple returns a whole multiple column like 1x
+func (r *csvRow) multiple(col string) uint64 {
+	s := strings.TrimRight(r.get(col), "xX")
+	if s == "" {
+		return 0
+	}
+	f, ok := CheckFloat(true, s, true)
+	if !ok {
+		r.fail(col, "%q is not a multiple like 1x", r.get(col))
+	}
+	return uint64(f)
+}
+
+// flag returns a yes/no column, empty being no
+func (r *csvRow) flag(col string) bool {
+	switch strings.ToLower(r.get(col)) {
+	case "", "0", "n", "no", "false":
+		return false
+	case "1", "y", "yes", "true":
+		return true
+	}
+	r.fail(col, "%q is not yes or no", r.get(col))
+	return false
+}
+
+// list returns a column of values separated by sep
+func (r *csvRow) list(col, sep string) []string {
+	var ls []string
+	for _, s := range strings.Split(r.get(col), sep) {
+		if s = strings.TrimSpace(s); s != "" {
+			ls = append(ls, s)
+		}
+	}
+	return ls
+}
+
+// importUpsert finds the record matching the natural key in where, lets set
+// fill it in and creates or saves it, counting the outcome
+func importUpsert(tx *gorm.DB, rp *importReport, file string,
+	out interface{}, set func(), where string, args ...interface{}) error {
+	q := tx.Where(where, args...).First(out)
+	found := q.Error == nil
+	if q.Error != nil && !q.RecordNotFound() {
+		return q.Error
+	}
+	before := reflect.ValueOf(out).Elem().Interface()
+	set()
+	if !found {
+		rp.created[file]++
+		return tx.Create(out).Error
+	}
+	if reflect.DeepEqual(before, reflect.ValueOf(out).Elem().Interface()) {
+		rp.unchanged[file]++
+		return nil
+	}
+	rp.updated[file]++
+	return tx.Save(out).Error
+}
+
+// importCsvData imports all csv files under dir, writing the report to w
+// Nothing is saved if any row is invalid or when running dry.
+func importCsvData(db *gorm.DB, dir string, dryRun bool, w io.Writer) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	rp := newImportReport()
+	err := importCsvTables(tx, dir, rp)
+	rp.write(w)
+	if err == nil && len(rp.errors) > 0 {
+		err = fmt.Errorf("%v invalid rows, nothing imported", len(rp.errors))
+	}
+	if err != nil || dryRun {
+		tx.Rollback()
+		if err == nil {
+			fmt.Fprintln(w, "Dry run, nothing imported")
+		}
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// importCsvTables reads and saves the csv files in dependency order
+func importCsvTables(tx *gorm.DB, dir string, rp *importReport) error {
+	tables := map[string]*csvTable{}
+	for _, f := range []importFile{importTags, importCompanies,
+		importFundings, importExecutives, importUpdates} {
+		t, err := readCsvTable(dir, f)
+		if err != nil {
+			return err
+		}
+		rp.files = append(rp.files, f.name)
+		rp.skipped[f.name] = t == nil
+		tables[f.name] = t
+	}
+
+	tags, err := importTagRows(tx, rp, tables[importTags.name])
+	if err != nil {
+		return err
+	}
+	companies, err := importCompanyRows(tx, rp, tables[importCompanies.name],
+		tags)
+	if err != nil {
+		return err
+	}
+	if err := importFundingRows(tx, rp, tables[importFundings.name],
+		companies); err != nil {
+		return err
+	}
+	if err := importExecutiveRows(tx, rp, tables[importExecutives.name],
+		companies); err != nil {
+		return err
+	}
+	return importUpdateRows(tx, rp, tables[importUpdates.name], companies)
+}
+
+// importRefs resolves references to rows of an earlier file by natural key
+// or, for files in the legacy layout, by 1-based row number
+type importRefs struct {
+	tx    *gorm.DB
+	ids   map[string]uint
+	table string
+	key   string
+}
+
+// add registers a saved row under its key and row number
+func (refs *importRefs) add(key string, num int, id uint) {
+	refs.ids[key] = id
+	refs.ids[strconv.Itoa(num)] = id
+}
+
+// find returns the id of a reference, looking up the database for rows
+// not part of this import
+func (refs *importRefs) find(ref string) (uint, bool, error) {
+	if id, ok := refs.ids[ref]; ok {
+		return id, true, nil
+	}
+	var ids []uint
+	err := refs.tx.Table(refs.table).Where(refs.key+" = ? AND "+
+		"deleted_at IS NULL", ref).Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, false, err
+	}
+	return ids[0], true, nil
+}
+
+// duplicates tracks natural keys seen in a file to reject repeated rows
+type duplicates map[string]int
+
+func (d duplicates) check(r *csvRow, col string, key ...interface{}) {
+	k := fmt.Sprint(key...)
+	if l, ok := d[k]; ok {
+		r.fail(col, "duplicate of line %v", l)
+		return
+	}
+	d[k] = r.line
+}
+
+// importTagRows upserts tags by name
+func importTagRows(tx *gorm.DB, rp *importReport,
+	t *csvTable) (*importRefs, error) {
+	refs := &importRefs{tx, map[string]uint{}, "tags", "name"}
+	if t == nil {
+		return refs, nil
+	}
+	seen := duplicates{}
+	for i, r := range t.rows {
+		name := r.field("name")
+		nameCn := r.field("name_cn")
+		seen.check(r, "name", name)
+		if len(r.errs) > 0 {
+			rp.errors = append(rp.errors, r.errs...)
+			continue
+		}
+		var tag Tag
+		if err := importUpsert(tx, rp, t.file, &tag, func() {
+			tag.Name = name
+			tag.NameCn = nameCn
+		}, "name = ?", name); err != nil {
+			return nil, err
+		}
+		refs.add(name, i+1, tag.ID)
+	}
+	return refs, nil
+}
+
+// importCompanyRows upserts companies by name along with their tags and
+// their live deal
+func importCompanyRows(tx *gorm.DB, rp *importReport, t *csvTable,
+	tags *importRefs) (*importRefs, error) {
+	refs := &importRefs{tx, map[string]uint{}, "companies", "name"}
+	if t == nil {
+		return refs, nil
+	}
+	seen := duplicates{}
+	for i, r := range t.rows {
+		name := r.field("name")
+		seen.check(r, "name", name)
+		var ct []Tag
+		for _, ref := range r.list("tags", ",") {
+			id, ok, err := tags.find(ref)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				r.fail("tags", "unknown tag %q", ref)
+				continue
+			}
+			var tag Tag
+			tag.ID = id
+			ct = append(ct, tag)
+		}
+		c := Company{
+			Name:              name,
+			Description:       r.text("description", StringBlockMax),
+			DescriptionCn:     r.text("description_cn", StringBlockMax),
+			YearFounded:       r.number("year_founded", YearMax),
+			StateFounded:      r.text("state_founded", StringMax),
+			Hq:                r.text("hq", StringMax),
+			HomePage:          r.text("home_page", StringMax),
+			KeyPerson:         r.text("key_person", StringMax),
+			NumEmployees:      r.number("num_employees", NumberMax),
+			TotalValuation:    r.float("total_valuation", true),
+			TotalFunding:      r.float("total_funding", true),
+			GrowthRatePercent: r.float("growth_rate_percent", false),
+			SizeMultiple:      r.float("size_multiple", true),
+			Investors:         strings.Join(r.list("investors", "\n"), ","),
+			InvestorLogoPics: strings.Join(r.list("investor_logo_pics", "\n"),
+				","),
+			NumSlides: r.number("num_slides", NumberMax),
+			VideoUrl:  r.text("video_url", StringMax)}
+		liveDeal := r.flag("live_deal")
+		if len(r.errs) > 0 {
+			rp.errors = append(rp.errors, r.errs...)
+			continue
+		}
+
+		var saved Company
+		if err := importUpsert(tx, rp, t.file, &saved, func() {
+			c.Model = saved.Model
+			// Optional columns the file does not give are left as they
+			// are, and so are not compared either
+			if !t.has("state_founded") {
+				c.StateFounded = saved.StateFounded
+			}
+			if !t.has("video_url") {
+				c.VideoUrl = saved.VideoUrl
+			}
+			saved = c
+		}, "name = ?", name); err != nil {
+			return nil, err
+		}
+		if err := tx.Model(&saved).Association("Tags").
+			Replace(ct).Error; err != nil {
+			return nil, err
+		}
+		if liveDeal {
+			var open int
+			if err := tx.Model(&Deal{}).Where("company_id = ? AND "+
+				"deal_state = ?", saved.ID, DealStateOpen).
+				Count(&open).Error; err != nil {
+				return nil, err
+			}
+			if open == 0 {
+				if err := tx.Create(&Deal{CompanyID: uint64(saved.ID),
+					DealState:   DealStateOpen,
+					DealSpecial: DealSpecialTwentyPercentOff}).Error; err != nil {
+					return nil, err
+				}
+			}
+		}
+		refs.add(name, i+1, saved.ID)
+	}
+	return refs, nil
+}
+
+// importCompany resolves the company column of a row
+func importCompany(r *csvRow, companies *importRefs) (uint64, error) {
+	ref := r.field("company")
+	if ref == "" {
+		return 0, nil
+	}
+	id, ok, err := companies.find(ref)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		r.fail("company", "unknown company %q", ref)
+	}
+	return uint64(id), nil
+}
+
+// importFundingRows upserts fundings by company, type and date
+func importFundingRows(tx *gorm.DB, rp *importReport, t *csvTable,
+	companies *importRefs) error {
+	if t == nil {
+		return nil
+	}
+	seen := duplicates{}
+	for _, r := range t.rows {
+		cid, err := importCompany(r, companies)
+		if err != nil {
+			return err
+		}
+		f := Funding{
+			CompanyID:               cid,
+			Type:                    r.field("type"),
+			Date:                    r.field("date"),
+			Amount:                  r.money("amount"),
+			RaisedToDate:            r.money("raised_to_date"),
+			PreValuation:            r.money("pre_valuation"),
+			PostValuation:           r.money("post_valuation"),
+			Status:                  r.text("status", StringMax),
+			Stage:                   r.text("stage", StringMax),
+			NumShares:               r.number("num_shares", NumberMax),
+			ParValue:                r.float("par_value", true),
+			DividendRatePercent:     r.float("dividend_rate", true) * 100,
+			OriginalIssuePrice:      r.float("original_issue_price", true),
+			Liquidation:             r.float("liquidation", true),
+			LiquidationPrefMultiple: r.multiple("liquidation_pref_multiple"),
+			ConversionPrice:         r.float("conversion_price", true),
+			PercentOwned:            r.float("percent_owned", true) * 100}
+		seen.check(r, "date", cid, "/", f.Type, "/", f.Date)
+		if len(r.errs) > 0 {
+			rp.errors = append(rp.errors, r.errs...)
+			continue
+		}
+		var saved Funding
+		if err := importUpsert(tx, rp, t.file, &saved, func() {
+			f.Model = saved.Model
+			saved = f
+		}, "company_id = ? AND type = ? AND date = ?", cid, f.Type,
+			f.Date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importExecutiveRows upserts company executives by company and name
+func importExecutiveRows(tx *gorm.DB, rp *importReport, t *csvTable,
+	companies *importRefs) error {
+	if t == nil {
+		return nil
+	}
+	seen := duplicates{}
+	for _, r := range t.rows {
+		cid, err := importCompany(r, companies)
+		if err != nil {
+			return err
+		}
+		ce := CompanyExecutive{
+			CompanyID: cid,
+			Name:      r.field("name"),
+			Role:      r.text("role", StringMax),
+			Office:    r.text("office", StringMax)}
+		seen.check(r, "name", cid, "/", ce.Name)
+		if len(r.errs) > 0 {
+			rp.errors = append(rp.errors, r.errs...)
+			continue
+		}
+		var saved CompanyExecutive
+		if err := importUpsert(tx, rp, t.file, &saved, func() {
+			ce.Model = saved.Model
+			saved = ce
+		}, "company_id = ? AND name = ?", cid, ce.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importUpdateRows upserts company updates by company, title and language
+func importUpdateRows(tx *gorm.DB, rp *importReport, t *csvTable,
+	companies *importRefs) error {
+	if t == nil {
+		return nil
+	}
+	// Updates are listed newest first but shown in id order, so they are
+	// saved from the bottom up once all rows are validated
+	var cus []CompanyUpdate
+	seen := duplicates{}
+	for _, r := range t.rows {
+		cid, err := importCompany(r, companies)
+		if err != nil {
+			return err
+		}
+		cu := CompanyUpdate{
+			CompanyID: cid,
+			Title:     r.field("title"),
+			Url:       r.text("url", StringMax),
+			Date:      r.text("date", StringMax),
+			Language:  r.field("language")}
+		if _, ok := ErrorCodes[cu.Language]; cu.Language != "" && !ok {
+			r.fail("language", "unknown language %q", cu.Language)
+		}
+		seen.check(r, "title", cid, "/", cu.Title, "/", cu.Language)
+		if len(r.errs) > 0 {
+			rp.errors = append(rp.errors, r.errs...)
+			continue
+		}
+		cus = append(cus, cu)
+	}
+	for i := len(cus) - 1; i >= 0; i-- {
+		cu := cus[i]
+		var saved CompanyUpdate
+		if err := importUpsert(tx, rp, t.file, &saved, func() {
+			cu.Model = saved.Model
+			saved = cu
+		}, "company_id = ? AND title = ? AND language = ?", cu.CompanyID,
+			cu.Title, cu.Language); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Testing for csv data import parsing and validation
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCsvTable(t *testing.T) {
+	// Header-named columns in any order
+	tb, err := parseCsvTable(strings.NewReader(
+		"Name CN,name,extra\n标签,Tag,x\n\n,Other,y\n"), importTags)
+	if err != nil {
+		t.Fatalf("[Import] parseCsvTable failed on named header: %v\n", err)
+	}
+	if len(tb.rows) != 2 || tb.rows[0].get("name") != "Tag" ||
+		tb.rows[0].get("name_cn") != "标签" || tb.rows[1].line != 4 {
+		t.Fatalf("[Import] parseCsvTable misreads named columns: %+v\n",
+			tb.rows[0])
+	}
+	if !tb.has("name_cn") || tb.has("video_url") {
+		t.Fatal("[Import] Named header columns are misreported\n")
+	}
+	// Legacy positional columns
+	tb, err = parseCsvTable(strings.NewReader(
+		"Tag Name,Chinese,Extra\nTag,标签,x\n"), importTags)
+	if err != nil || tb.rows[0].get("name_cn") != "标签" {
+		t.Fatalf("[Import] parseCsvTable misreads legacy columns: %v\n", err)
+	}
+	if tb.has("extra") {
+		t.Fatal("[Import] Legacy columns are misreported\n")
+	}
+	// Too few columns to be either
+	if _, err = parseCsvTable(strings.NewReader("name\nTag\n"),
+		importTags); err == nil {
+		t.Fatal("[Import] parseCsvTable accepts missing columns\n")
+	}
+}
+
+func TestCsvRowValidation(t *testing.T) {
+	tb, err := parseCsvTable(strings.NewReader(
+		"company,type,date,amount,raised_to_date,pre_valuation,"+
+			"post_valuation,status,stage,num_shares,par_value,"+
+			"dividend_rate,original_issue_price,liquidation,"+
+			"liquidation_pref_multiple,conversion_price,percent_owned\n"+
+			"Acme,Series A,2016,$300M,$1.5B,0,,,,1000,0.01,0.08,1,1,1x,1,0.1\n"+
+			",,,300M,$xB,,,,,-1,abc,,,,2y,,\n"), importFundings)
+	if err != nil {
+		t.Fatalf("[Import] parseCsvTable failed: %v\n", err)
+	}
+
+	good := tb.rows[0]
+	if good.money("amount") != 0.3 || good.money("raised_to_date") != 1.5 ||
+		good.money("pre_valuation") != 0 || good.number("num_shares",
+		NumberMax) != 1000 || good.multiple("liquidation_pref_multiple") != 1 {
+		t.Fatal("[Import] Good row values are misread\n")
+	}
+	if len(good.errs) != 0 {
+		t.Fatalf("[Import] Good row has errors: %v\n", good.errs)
+	}
+
+	bad := tb.rows[1]
+	bad.field("company")
+	bad.field("type")
+	bad.money("amount")
+	bad.money("raised_to_date")
+	bad.number("num_shares", NumberMax)
+	bad.float("par_value", true)
+	bad.multiple("liquidation_pref_multiple")
+	if len(bad.errs) != 7 {
+		t.Fatalf("[Import] Bad row has %v errors: %v\n", len(bad.errs),
+			bad.errs)
+	}
+	if !strings.HasPrefix(bad.errs[0], "fundings.csv:3: company: ") {
+		t.Fatalf("[Import] Bad row error is misformatted: %v\n", bad.errs[0])
+	}
+
+	seen := duplicates{}
+	seen.check(good, "date", 1, "/", "Series A")
+	seen.check(good, "date", 1, "/", "Series A")
+	if len(good.errs) != 1 {
+		t.Fatal("[Import] Duplicate keys are not reported\n")
+	}
+}
@@ -0,0 +1,340 @@
+// JWT signing keys for MarketX
+// Tokens are signed with the primary key of a keyring and carry its id in
+// the kid header, so keys can be rotated without logging anyone out: a new
+// key is added with an active_from time, becomes primary once that passes,
+// and the old one keeps verifying until its retire_at. RS256 and EdDSA
+// public keys are published on /.well-known/jwks.json for other services.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	JwtAlgEdDSA      = "EdDSA"
+	jwtSecretMin     = 32
+	jwksCacheSeconds = 300
+)
+
+var (
+	JwtErrorKeyUnknown = errors.New("Unknown or retired signing key")
+	JwtErrorNoPrimary  = errors.New("No active signing key")
+	JwtErrorKeyPem     = errors.New("Key file is not a PEM private key")
+)
+
+var (
+	// jwtKeys is replaced by the configured keyring when serving
+	jwtKeys            = newJwtKeyring(jwtSigningSecret)
+	signingMethodEdDSA = &signingMethodEd25519{}
+)
+
+func init() {
+	jwt.RegisterSigningMethod(JwtAlgEdDSA, func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+// signingMethodEd25519 signs tokens with Ed25519 keys, which the vendored
+// jwt library does not know
+type signingMethodEd25519 struct{}
+
+func (m *signingMethodEd25519) Alg() string {
+	return JwtAlgEdDSA
+}
+
+func (m *signingMethodEd25519) Sign(signingString string,
+	key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+func (m *signingMethodEd25519) Verify(signingString, signature string,
+	key interface{}) error {
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(k, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// jwtKey is a signing key of the keyring
+type jwtKey struct {
+	kid        string
+	method     jwt.SigningMethod
+	signKey    interface{}
+	verifyKey  interface{}
+	activeFrom time.Time
+	retireAt   time.Time
+}
+
+// active checks whether k signs tokens at now
+func (k *jwtKey) active(now time.Time) bool {
+	return !now.Before(k.activeFrom) && !k.retired(now)
+}
+
+// retired checks whether k stopped verifying tokens at now
+func (k *jwtKey) retired(now time.Time) bool {
+	return !k.retireAt.IsZero() && !now.Before(k.retireAt)
+}
+
+// jwtKeyring holds every signing key, legacy verifies tokens without kid
+type jwtKeyring struct {
+	keys   []*jwtKey
+	legacy *jwtKey
+}
+
+// legacyJwtKey is the MX_JWT_SECRET_KEY HS512 key, its kid is derived from
+// the secret so every instance agrees on it
+func legacyJwtKey(secret []byte) *jwtKey {
+	return &jwtKey{kid: fmt.Sprintf("%x", sha256.Sum256(secret))[:16],
+		method: jwt.SigningMethodHS512, signKey: secret, verifyKey: secret}
+}
+
+// newJwtKeyring creates a keyring of the legacy secret alone
+func newJwtKeyring(secret []byte) *jwtKeyring {
+	kr := &jwtKeyring{}
+	if len(secret) > 0 {
+		kr.legacy = legacyJwtKey(secret)
+		kr.keys = append(kr.keys, kr.legacy)
+	}
+	return kr
+}
+
+// primary returns the key new tokens are signed with, the active key that
+// became active last
+func (kr *jwtKeyring) primary(now time.Time) *jwtKey {
+	var p *jwtKey
+	for _, k := range kr.keys {
+		if k.signKey != nil && k.active(now) &&
+			(p == nil || k.activeFrom.After(p.activeFrom)) {
+			p = k
+		}
+	}
+	return p
+}
+
+// lookup returns the unretired key of a kid, tokens without kid come from
+// before the keyring and use the legacy key
+func (kr *jwtKeyring) lookup(kid string, now time.Time) *jwtKey {
+	if kid == "" {
+		return kr.legacy
+	}
+	for _, k := range kr.keys {
+		if k.kid == kid && !k.retired(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// sign signs claims with the primary key
+func (kr *jwtKeyring) sign(claims jwt.MapClaims) (string, error) {
+	k := kr.primary(time.Now())
+	if k == nil {
+		return "", JwtErrorNoPrimary
+	}
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.signKey)
+}
+
+// verifyKey is the jwt.Keyfunc finding the key a token was signed with
+func (kr *jwtKeyring) verifyKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k := kr.lookup(kid, time.Now())
+	if k == nil {
+		return nil, JwtErrorKeyUnknown
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method: %v",
+			token.Header["alg"])
+	}
+	return k.verifyKey, nil
+}
+
+// jwks returns the public keys of the keyring as a json web key set,
+// including keys not active yet so verifiers can fetch them ahead
+func (kr *jwtKeyring) jwks(now time.Time) map[string]interface{} {
+	keys := []map[string]interface{}{}
+	for _, k := range kr.keys {
+		if k.retired(now) {
+			continue
+		}
+		jwk := map[string]interface{}{"kid": k.kid, "alg": k.method.Alg(),
+			"use": "sig"}
+		switch pub := k.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(
+				big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			// Shared secrets stay secret
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// jwtKeyFile is a key entry of the keyring file
+type jwtKeyFile struct {
+	Kid            string `json:"kid"`
+	Alg            string `json:"alg"`
+	Secret         string `json:"secret"`
+	PrivateKeyFile string `json:"private_key_file"`
+	ActiveFrom     string `json:"active_from"`
+	RetireAt       string `json:"retire_at"`
+}
+
+// parseJwtTime parses an optional RFC 3339 keyring time
+func parseJwtTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseJwtPrivateKey reads a PEM private key for alg
+func parseJwtPrivateKey(alg string, b []byte) (interface{}, interface{},
+	error) {
+	if alg == jwt.SigningMethodRS256.Alg() {
+		k, err := jwt.ParseRSAPrivateKeyFromPEM(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		return k, &k.PublicKey, nil
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, nil, JwtErrorKeyPem
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	k, ok := pk.(ed25519.PrivateKey)
+	if !ok {
+		return nil, nil, JwtErrorKeyPem
+	}
+	return k, k.Public(), nil
+}
+
+// loadJwtKeyring reads the keyring file, key files are relative to it
+// The legacy secret, if any, keeps verifying tokens without kid.
+func loadJwtKeyring(file string, secret []byte) (*jwtKeyring, error) {
+	if file == "" {
+		kr := newJwtKeyring(secret)
+		if kr.primary(time.Now()) == nil {
+			return nil, JwtErrorNoPrimary
+		}
+		return kr, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var kf struct {
+		Keys []jwtKeyFile `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &kf); err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+
+	kr := &jwtKeyring{}
+	kids := map[string]bool{}
+	if len(secret) > 0 {
+		// Only verifies the tokens signed before the keyring
+		kr.legacy = legacyJwtKey(secret)
+		kr.legacy.signKey = nil
+		kr.keys = append(kr.keys, kr.legacy)
+		kids[kr.legacy.kid] = true
+	}
+	for _, e := range kf.Keys {
+		if e.Kid == "" || kids[e.Kid] {
+			return nil, fmt.Errorf("%v: missing or duplicate kid %q", file,
+				e.Kid)
+		}
+		kids[e.Kid] = true
+		k := &jwtKey{kid: e.Kid}
+		if k.activeFrom, err = parseJwtTime(e.ActiveFrom); err != nil {
+			return nil, fmt.Errorf("%v: key %v active_from: %v", file, e.Kid,
+				err)
+		}
+		if k.retireAt, err = parseJwtTime(e.RetireAt); err != nil {
+			return nil, fmt.Errorf("%v: key %v retire_at: %v", file, e.Kid,
+				err)
+		}
+		switch e.Alg {
+		case "HS256", "HS384", "HS512":
+			key, err := decodeHexKey("secret", e.Secret, jwtSecretMin, 48,
+				64)
+			if err != nil {
+				return nil, fmt.Errorf("%v: key %v: %v", file, e.Kid, err)
+			}
+			k.method = jwt.GetSigningMethod(e.Alg)
+			k.signKey, k.verifyKey = key, key
+		case jwt.SigningMethodRS256.Alg(), JwtAlgEdDSA:
+			p := e.PrivateKeyFile
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(filepath.Dir(file), p)
+			}
+			pb, err := ioutil.ReadFile(p)
+			if err != nil {
+				return nil, fmt.Errorf("%v: key %v: %v", file, e.Kid, err)
+			}
+			k.method = jwt.GetSigningMethod(e.Alg)
+			k.signKey, k.verifyKey, err = parseJwtPrivateKey(e.Alg, pb)
+			if err != nil {
+				return nil, fmt.Errorf("%v: key %v: %v", file, e.Kid, err)
+			}
+		default:
+			return nil, fmt.Errorf("%v: key %v has unsupported alg %q", file,
+				e.Kid, e.Alg)
+		}
+		kr.keys = append(kr.keys, k)
+	}
+	if kr.primary(time.Now()) == nil {
+		return nil, JwtErrorNoPrimary
+	}
+	return kr, nil
+}
+
+// jwksHandler publishes the public signing keys
+func jwksHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v",
+		jwksCacheSeconds))
+	json.NewEncoder(w).Encode(jwtKeys.jwks(time.Now()))
+}
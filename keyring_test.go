@@ -0,0 +1,156 @@
+// Testing for jwt signing keys
+package main
+
+import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// writeTestKeyring writes an RS256 key retired in an hour, an EdDSA key
+// active since a minute ago and an HS512 key active in an hour
+func writeTestKeyring(t *testing.T, dir string) string {
+	rk, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(rk)})
+	_, ek, _ := ed25519.GenerateKey(crand.Reader)
+	eb, _ := x509.MarshalPKCS8PrivateKey(ek)
+	eb = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: eb})
+	ioutil.WriteFile(filepath.Join(dir, "rs.pem"), rb, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "ed.pem"), eb, 0600)
+
+	now := time.Now().UTC()
+	kf := filepath.Join(dir, "keyring.json")
+	ioutil.WriteFile(kf, []byte(fmt.Sprintf(`{"keys": [
+		{"kid": "rs", "alg": "RS256", "private_key_file": "rs.pem",
+			"retire_at": %q},
+		{"kid": "ed", "alg": "EdDSA", "private_key_file": "ed.pem",
+			"active_from": %q},
+		{"kid": "hs", "alg": "HS512", "secret": %q,
+			"active_from": %q}]}`,
+		now.Add(time.Hour).Format(time.RFC3339),
+		now.Add(-time.Minute).Format(time.RFC3339), strings.Repeat("ab", 64),
+		now.Add(time.Hour).Format(time.RFC3339))), 0600)
+	return kf
+}
+
+// useTestKeyring signs with a random secret until the returned restore is
+// called, so tokens do not depend on MX_JWT_SECRET_KEY being set
+func useTestKeyring(t *testing.T) func() {
+	secret := make([]byte, 64)
+	crand.Read(secret)
+	kr, err := loadJwtKeyring("", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := jwtKeys
+	jwtKeys = kr
+	return func() { jwtKeys = old }
+}
+
+func TestJwtKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	legacy := []byte(strings.Repeat("k", 64))
+	kr, err := loadJwtKeyring(writeTestKeyring(t, dir), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The latest active key signs
+	now := time.Now()
+	if p := kr.primary(now); p == nil || p.kid != "ed" {
+		t.Fatalf("[Keyring] Bad primary key %v\n", p)
+	}
+	if p := kr.primary(now.Add(2 * time.Hour)); p == nil || p.kid != "hs" {
+		t.Fatalf("[Keyring] Scheduled key did not become primary %v\n", p)
+	}
+	if kr.lookup("rs", now.Add(2*time.Hour)) != nil {
+		t.Fatal("[Keyring] Retired key still verifies\n")
+	}
+
+	s, err := kr.sign(jwt.MapClaims{"user_id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Parse(s, kr.verifyKey)
+	if err != nil || !token.Valid || token.Header["kid"] != "ed" ||
+		token.Header["alg"] != JwtAlgEdDSA {
+		t.Fatalf("[Keyring] EdDSA token does not verify: %v\n", err)
+	}
+
+	// Older keys keep verifying
+	rt := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{})
+	rt.Header["kid"] = "rs"
+	rs, _ := rt.SignedString(kr.lookup("rs", now).signKey)
+	if _, err := jwt.Parse(rs, kr.verifyKey); err != nil {
+		t.Fatalf("[Keyring] RS256 token does not verify: %v\n", err)
+	}
+
+	// Tokens from before the keyring have no kid
+	lt, _ := jwt.NewWithClaims(jwt.SigningMethodHS512,
+		jwt.MapClaims{}).SignedString(legacy)
+	if _, err := jwt.Parse(lt, kr.verifyKey); err != nil {
+		t.Fatalf("[Keyring] Legacy token does not verify: %v\n", err)
+	}
+
+	// A kid cannot be used with another algorithm
+	ht := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{})
+	ht.Header["kid"] = "ed"
+	hs, _ := ht.SignedString([]byte("secret"))
+	if _, err := jwt.Parse(hs, kr.verifyKey); err == nil {
+		t.Fatal("[Keyring] Token with the wrong algorithm verifies\n")
+	}
+
+	// Only public keys are published
+	keys := kr.jwks(now)["keys"].([]map[string]interface{})
+	if len(keys) != 2 || keys[0]["kty"] != "RSA" || keys[1]["kty"] != "OKP" {
+		t.Fatalf("[Keyring] Bad jwks %v\n", keys)
+	}
+	for _, k := range keys {
+		if k["d"] != nil || k["k"] != nil {
+			t.Fatalf("[Keyring] Private key in jwks %v\n", k)
+		}
+	}
+}
+
+func TestJwtKeyringErrors(t *testing.T) {
+	if _, err := loadJwtKeyring("", nil); err != JwtErrorNoPrimary {
+		t.Fatalf("[Keyring] Empty keyring loads: %v\n", err)
+	}
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kf := filepath.Join(dir, "keyring.json")
+	for _, bad := range []string{
+		`{"keys": [{"kid": "a", "alg": "HS512", "secret": "ab"}]}`,
+		`{"keys": [{"kid": "a", "alg": "none"}]}`,
+		`{"keys": [{"alg": "HS512", "secret": "` +
+			strings.Repeat("ab", 64) + `"}]}`,
+		`{"keys": [{"kid": "a", "alg": "EdDSA", "private_key_file": "x"}]}`,
+	} {
+		ioutil.WriteFile(kf, []byte(bad), 0600)
+		if _, err := loadJwtKeyring(kf, nil); err == nil {
+			t.Fatalf("[Keyring] Bad keyring loads: %v\n", bad)
+		}
+	}
+}
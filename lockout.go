@@ -0,0 +1,114 @@
+// Login lockout and sign-in notifications for MarketX
+// Wrong passwords are counted on the user; once over the limit the account
+// is locked for a while and an unlock link is emailed. Successful logins
+// from a new ip or device are reported to the user by email.
+package main
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+const userAgentMax = 512
+
+// userLang returns the language to email a user in
+func userLang(u *User) string {
+	if EmailTexts[u.LastLanguage] == nil {
+		return defaultLang
+	}
+	return u.LastLanguage
+}
+
+// userAgent returns the (bounded) device description of a request
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > userAgentMax {
+		ua = ua[:userAgentMax]
+	}
+	return ua
+}
+
+// loginLocked checks whether u is locked out and for how many more minutes
+func loginLocked(u *User) (bool, int64) {
+	left := u.LockedUntil.Sub(time.Now())
+	if left <= 0 {
+		return false, 0
+	}
+	return true, int64(math.Ceil(left.Minutes()))
+}
+
+// loginFailed records a wrong password for u and locks the account with
+// an unlock email once it reaches the limit
+func loginFailed(r *http.Request, u *User) {
+	// Count in the database so concurrent attempts are not lost
+	if err := dbConn.Raw(`UPDATE "users" SET "failed_login_count" = `+
+		`"failed_login_count" + 1 WHERE "id" = ? `+
+		`RETURNING "failed_login_count"`, u.ID).Row().
+		Scan(&u.FailedLoginCount); err != nil {
+		serverLog.Error("cannot count failed login", LogFields{
+			"request_id": requestId(r), "user_id": u.ID, "error": err})
+		return
+	}
+	if loginMaxFailures <= 0 || u.FailedLoginCount < uint64(loginMaxFailures) {
+		return
+	}
+
+	b := make([]byte, TokenMinMax/2)
+	crand.Read(b)
+	failures := u.FailedLoginCount
+	u.UnlockToken = fmt.Sprintf("%x", b)
+	u.LockedUntil = time.Now().Add(loginLockout)
+	u.FailedLoginCount = 0
+	if err := dbConn.Model(u).Updates(map[string]interface{}{
+		"unlock_token":       u.UnlockToken,
+		"locked_until":       u.LockedUntil,
+		"failed_login_count": 0}).Error; err != nil {
+		serverLog.Error("cannot lock account", LogFields{
+			"request_id": requestId(r), "user_id": u.ID, "error": err})
+		return
+	}
+	serverLog.Warn("account locked", LogFields{"request_id": requestId(r),
+		"user_id": u.ID, "ip": getIp(r), "failures": failures})
+
+	lang := userLang(u)
+	link := fmt.Sprintf(emailUnlockLink, serverDomain, u.UnlockToken)
+	body := fmt.Sprintf(EmailTexts[lang][EmailTextBodyAccountLocked],
+		u.FullName, int64(math.Ceil(loginLockout.Minutes())), failures, link)
+	sendMailBackground(EmailTexts[lang][EmailTextName], u.Email, u.FullName,
+		EmailTexts[lang][EmailTextSubjectAccountLocked], body)
+}
+
+// loginSucceeded clears the failures of u and notifies the user of a
+// sign-in from a new ip or device, it is saved by saveLogin
+func loginSucceeded(r *http.Request, u *User) {
+	u.FailedLoginCount = 0
+	u.UnlockToken = ""
+	u.LockedUntil = time.Time{}
+
+	// Nothing to compare with on the first login
+	ip, ua := getIp(r), userAgent(r)
+	if !loginNotifyNewSignIn || u.LastIpAddress == "" ||
+		(ip == u.LastIpAddress && (u.LastUserAgent == "" ||
+			ua == u.LastUserAgent)) {
+		return
+	}
+	lang := userLang(u)
+	body := fmt.Sprintf(EmailTexts[lang][EmailTextBodyNewSignIn],
+		u.FullName, time.Now().UTC().Format(time.RFC1123), ip, ua)
+	sendMailBackground(EmailTexts[lang][EmailTextName], u.Email, u.FullName,
+		EmailTexts[lang][EmailTextSubjectNewSignIn], body)
+}
+
+// unlockUser clears the lockout of u
+func unlockUser(u *User) error {
+	u.FailedLoginCount = 0
+	u.UnlockToken = ""
+	u.LockedUntil = time.Time{}
+	return dbConn.Model(u).Updates(map[string]interface{}{
+		"failed_login_count": 0,
+		"unlock_token":       "",
+		"locked_until":       time.Time{}}).Error
+}
@@ -0,0 +1,35 @@
+// Testing for login lockout
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLocked(t *testing.T) {
+	u := &User{}
+	if locked, _ := loginLocked(u); locked {
+		t.Fatal("[Lockout] New user is locked\n")
+	}
+	u.LockedUntil = time.Now().Add(90 * time.Second)
+	if locked, minutes := loginLocked(u); !locked || minutes != 2 {
+		t.Fatalf("[Lockout] Expected 2 minutes left, got %v %v\n", locked,
+			minutes)
+	}
+	u.LockedUntil = time.Now().Add(-time.Second)
+	if locked, _ := loginLocked(u); locked {
+		t.Fatal("[Lockout] Expired lock still applies\n")
+	}
+}
+
+func TestLockoutTexts(t *testing.T) {
+	for lang, texts := range EmailTexts {
+		if len(texts) != EmailTextBodyLoginLink+1 {
+			t.Fatalf("[Lockout] %v has %v email texts\n", lang, len(texts))
+		}
+	}
+	if userLang(&User{LastLanguage: "zh-CN"}) != "zh-CN" ||
+		userLang(&User{LastLanguage: "fr"}) != defaultLang {
+		t.Fatal("[Lockout] userLang does not fall back to default\n")
+	}
+}
@@ -0,0 +1,314 @@
+// Structured logging for MarketX
+// Log lines are written as json objects (or readable text in console mode)
+// with a time, level, message and fields such as request_id and route. Log
+// files are rotated by size and age without an external rotator.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log line
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var LogLevels = map[string]LogLevel{
+	"debug": LogLevelDebug,
+	"info":  LogLevelInfo,
+	"warn":  LogLevelWarn,
+	"error": LogLevelError,
+}
+
+func (l LogLevel) String() string {
+	for n, v := range LogLevels {
+		if v == l {
+			return n
+		}
+	}
+	return "unknown"
+}
+
+const (
+	LogFormatJson    = "json"
+	LogFormatConsole = "console"
+	logTimeFormat    = "2006-01-02T15:04:05.000Z07:00"
+	logBackupFormat  = "20060102-150405"
+)
+
+// LogFields are the structured fields of a log line
+type LogFields map[string]interface{}
+
+// Logger writes leveled, structured log lines
+type Logger struct {
+	out     io.Writer
+	lock    *sync.Mutex
+	level   LogLevel
+	console bool
+	fields  LogFields
+}
+
+// newLogger creates a logger writing lines of level and above to out
+func newLogger(out io.Writer, level LogLevel, console bool) *Logger {
+	return &Logger{out: out, lock: &sync.Mutex{}, level: level,
+		console: console}
+}
+
+// With returns a logger adding fields to every line
+func (l *Logger) With(f LogFields) *Logger {
+	nl := *l
+	nl.fields = LogFields{}
+	for k, v := range l.fields {
+		nl.fields[k] = v
+	}
+	for k, v := range f {
+		nl.fields[k] = v
+	}
+	return &nl
+}
+
+// Log writes a line with msg and fields at level
+func (l *Logger) Log(level LogLevel, msg string, f LogFields) {
+	if level < l.level {
+		return
+	}
+	all := LogFields{}
+	for k, v := range l.fields {
+		all[k] = v
+	}
+	for k, v := range f {
+		// Errors do not marshal into json
+		if err, ok := v.(error); ok && err != nil {
+			v = err.Error()
+		}
+		all[k] = v
+	}
+	now := time.Now().UTC().Format(logTimeFormat)
+
+	var buf bytes.Buffer
+	if l.console {
+		fmt.Fprintf(&buf, "%v %-5v %v", now,
+			strings.ToUpper(level.String()), msg)
+		keys := make([]string, 0, len(all))
+		for k := range all {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %v=%v", k, all[k])
+		}
+		buf.WriteByte('\n')
+	} else {
+		all["time"] = now
+		all["level"] = level.String()
+		all["msg"] = msg
+		b, err := json.Marshal(all)
+		if err != nil {
+			// Should not happen but keep the message
+			b, _ = json.Marshal(LogFields{"time": now,
+				"level": level.String(), "msg": msg,
+				"log_error": err.Error()})
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// Debug writes a debug line
+func (l *Logger) Debug(msg string, f LogFields) {
+	l.Log(LogLevelDebug, msg, f)
+}
+
+// Info writes an info line
+func (l *Logger) Info(msg string, f LogFields) {
+	l.Log(LogLevelInfo, msg, f)
+}
+
+// Warn writes a warn line
+func (l *Logger) Warn(msg string, f LogFields) {
+	l.Log(LogLevelWarn, msg, f)
+}
+
+// Error writes an error line
+func (l *Logger) Error(msg string, f LogFields) {
+	l.Log(LogLevelError, msg, f)
+}
+
+// logMillis formats a duration as the milliseconds logged in latency fields
+func logMillis(d time.Duration) float64 {
+	return float64(d.Nanoseconds()/1e3) / 1e3
+}
+
+// outboundLogger returns the logger of an integration api call, which
+// discards everything when quiet, with the api request id if any
+func outboundLogger(quiet bool, service string, callId int64,
+	requestId string) *Logger {
+	if quiet {
+		return newLogger(ioutil.Discard, LogLevelError+1, false)
+	}
+	f := LogFields{"service": service, "call_id": callId}
+	if requestId != "" {
+		f["request_id"] = requestId
+	}
+	return serverLog.With(f)
+}
+
+// logWriter turns each write into a log line, for libraries that take a
+// log.Logger such as http.Server
+type logWriter struct {
+	l     *Logger
+	level LogLevel
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.l.Log(w.level, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// gormLogger adapts a Logger to the gorm logger interface
+type gormLogger struct {
+	l *Logger
+}
+
+// Print logs a gorm sql or message line, the sql is logged with its
+// placeholders so no values (hashes, encrypted fields) end up in the log
+func (g gormLogger) Print(v ...interface{}) {
+	if len(v) < 2 {
+		return
+	}
+	f := LogFields{"source": v[1]}
+	if v[0] == "sql" && len(v) >= 4 {
+		if d, ok := v[2].(time.Duration); ok {
+			f["latency_ms"] = logMillis(d)
+		}
+		f["sql"] = v[3]
+		g.l.Info("sql", f)
+		return
+	}
+	g.l.Error(strings.TrimSpace(fmt.Sprintln(v[2:]...)), f)
+}
+
+// rotatingFile is a log file that rotates itself once it grows past
+// maxSize bytes or gets older than maxAge, keeping maxBackups old files
+// Zero values disable the respective limit.
+type rotatingFile struct {
+	name       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	lock       sync.Mutex
+	f          *os.File
+	size       int64
+	opened     time.Time
+}
+
+var LogErrorClosed = errors.New("Log file is closed")
+
+// openRotatingFile opens (appending to) a rotating log file
+func openRotatingFile(name string, maxSize int64, maxAge time.Duration,
+	maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{name: name, maxSize: maxSize, maxAge: maxAge,
+		maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open opens the current file, caller holds the lock
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+// rotate moves the current file to a timestamped backup, opens a new one
+// and removes backups over the limit, caller holds the lock
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+	backup := fmt.Sprintf("%v.%v", rf.name,
+		time.Now().UTC().Format(logBackupFormat))
+	if _, err := os.Stat(backup); err == nil {
+		backup = fmt.Sprintf("%v.%v", backup, time.Now().UnixNano())
+	}
+	if err := os.Rename(rf.name, backup); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if rf.maxBackups > 0 {
+		backups, _ := filepath.Glob(rf.name + ".*")
+		sort.Strings(backups)
+		for len(backups) > rf.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// Write appends p to the file, rotating it first when over a limit
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.f == nil {
+		return 0, LogErrorClosed
+	}
+	full := rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize
+	old := rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+	if rf.size > 0 && (full || old) {
+		if err := rf.rotate(); err != nil {
+			// Keep logging into whatever file we can
+			if rf.f == nil && rf.open() != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (rf *rotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,101 @@
+// Testing for structured logging
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := newLogger(&b, LogLevelInfo, false).With(LogFields{"a": 1})
+	l.Debug("hidden", nil)
+	l.Warn("shown", LogFields{"b": "x", "error": os.ErrNotExist})
+	var line map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatalf("[Logger] Not a single json line: %v\n", b.String())
+	}
+	if line["level"] != "warn" || line["msg"] != "shown" ||
+		line["a"] != 1.0 || line["b"] != "x" ||
+		line["error"] != os.ErrNotExist.Error() || line["time"] == nil {
+		t.Fatalf("[Logger] Wrong fields: %v\n", line)
+	}
+
+	b.Reset()
+	newLogger(&b, LogLevelDebug, true).Info("hi", LogFields{"b": 2, "a": 1})
+	if !strings.HasSuffix(b.String(), " INFO  hi a=1 b=2\n") {
+		t.Fatalf("[Logger] Wrong console line: %v\n", b.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mxlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.log")
+	rf, err := openRotatingFile(name, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n",
+		"dddddddd\n"} {
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+	backups, _ := filepath.Glob(name + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("[Logger] Expected 2 backups, got %v\n", backups)
+	}
+	b, _ := ioutil.ReadFile(name)
+	if string(b) != "dddddddd\n" {
+		t.Fatalf("[Logger] Expected only the last write, got %q\n", b)
+	}
+}
+
+func TestLogProtect(t *testing.T) {
+	var b bytes.Buffer
+	defer func(l *Logger) { serverLog = l }(serverLog)
+	serverLog = newLogger(&b, LogLevelInfo, false)
+
+	h := logProtect(func(w http.ResponseWriter, r *http.Request,
+		ps httprouter.Params) {
+		getRequestContext(r).user = &User{ID: 7}
+		formatReturn(w, r, ps, ErrorCodeNoPermission, true, nil)
+	})
+	r := httptest.NewRequest("GET", "/deal/42/sell", nil)
+	h(httptest.NewRecorder(), r, httprouter.Params{{Key: "id", Value: "42"}})
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("[Logger] Expected request and response lines: %v\n", lines)
+	}
+	var req, resp map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &req)
+	json.Unmarshal([]byte(lines[1]), &resp)
+	if req["route"] != "/deal/:id/sell" || req["request_id"] == nil ||
+		resp["request_id"] != req["request_id"] || resp["user_id"] != 7.0 ||
+		resp["error_code"] != float64(ErrorCodeNoPermission) ||
+		resp["latency_ms"] == nil {
+		t.Fatalf("[Logger] Wrong request fields: %v\n", lines)
+	}
+
+	var mb bytes.Buffer
+	httpRequests.write(&mb)
+	if !strings.Contains(mb.String(), `mx_http_requests_total{method="GET",`+
+		`route="/deal/:id/sell",result="`) {
+		t.Fatalf("[Logger] Request not counted by route:\n%v\n", mb.String())
+	}
+}
@@ -4,12 +4,15 @@ package main
 import (
 	"fmt"
 	"net/smtp"
+	"strings"
 	"time"
 )
 
 const (
 	emailConfirmLink     = "%v/u/#/pages/info?token=%v"
 	emailForgetLink      = "%v/u/#/pages/recover?token=%v"
+	emailUnlockLink      = "%v/u/#/pages/unlock?token=%v"
+	emailLoginLink       = "%v/u/#/pages/login?link=%v"
 	emailInvestorLink    = "%v/u/#/investors/dashboard"
 	emailShareholderLink = "%v/u/#/shareholders/dashboard"
 	tokenExpiration      = 30 * time.Minute
@@ -36,7 +39,29 @@ func sendMail(author, recipient, name, subject, message string) bool {
 		subject, message)
 	err := smtp.SendMail(host, auth, supportEmail, []string{recipient},
 		[]byte(msg))
-	serverLog.Printf("[MXMAIL] Sent email to %v (%v): %v\n", recipient,
-		subject, err)
+	f := LogFields{"recipient": maskEmail(recipient), "subject": subject}
+	if err != nil {
+		f["error"] = err
+		serverLog.Error("email not sent", f)
+	} else {
+		serverLog.Info("email sent", f)
+	}
 	return err == nil
 }
+
+// sendMailBackground is the non-blocking version of sendMail, graceful
+// shutdown waits for it to finish
+func sendMailBackground(author, recipient, name, subject, message string) {
+	goBackground(func() {
+		sendMail(author, recipient, name, subject, message)
+	})
+}
+
+// maskEmail hides an address in logs but its first letter and domain
+func maskEmail(e string) string {
+	i := strings.LastIndex(e, "@")
+	if i < 1 {
+		return strings.Repeat("*", len(e))
+	}
+	return e[:1] + strings.Repeat("*", i-1) + e[i:]
+}
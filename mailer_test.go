@@ -0,0 +1,19 @@
+// Testing for the mailer
+package main
+
+import (
+	"testing"
+)
+
+func TestMaskEmail(t *testing.T) {
+	for e, want := range map[string]string{
+		"someone@example.com": "s******@example.com",
+		"a@b.com":             "a@b.com",
+		"@b.com":              "******",
+		"nobody":              "******",
+	} {
+		if m := maskEmail(e); m != want {
+			t.Fatalf("[Mailer] %q masked as %q\n", e, m)
+		}
+	}
+}
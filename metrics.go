@@ -0,0 +1,344 @@
+// Prometheus metrics for MarketX
+// A minimal collector for counters, histograms and gauges written in the
+// Prometheus text exposition format on /metrics. API routes are labelled by
+// their httprouter pattern and ErrorCode result, outbound integration calls
+// by service, call and outcome.
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	MetricResultSuccess = "success"
+	MetricResultNone    = "none"
+)
+
+// Default latency buckets in seconds
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+	2.5, 5, 10, 30}
+
+// metricSeries is the state of one label combination
+type metricSeries struct {
+	values []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// metricVec is a counter or histogram family with labels
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*metricSeries
+}
+
+// metricGauge is a gauge family computed when scraped
+type metricGauge struct {
+	name   string
+	help   string
+	labels []string
+	values func() map[string]float64
+}
+
+var (
+	metricVecs   []*metricVec
+	metricGauges []*metricGauge
+)
+
+// newCounterVec registers a counter family
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: "counter", labels: labels,
+		series: map[string]*metricSeries{}}
+	metricVecs = append(metricVecs, m)
+	return m
+}
+
+// newHistogramVec registers a histogram family
+func newHistogramVec(name, help string, buckets []float64,
+	labels ...string) *metricVec {
+	m := newCounterVec(name, help, labels...)
+	m.kind = "histogram"
+	m.buckets = buckets
+	return m
+}
+
+// newGauge registers a gauge family, values maps a single label value
+// (or "" without labels) to the current value
+func newGauge(name, help string, labels []string,
+	values func() map[string]float64) *metricGauge {
+	g := &metricGauge{name, help, labels, values}
+	metricGauges = append(metricGauges, g)
+	return g
+}
+
+// get returns the series of the label values, creating it if needed
+// Caller holds the lock.
+func (m *metricVec) get(values []string) *metricSeries {
+	k := strings.Join(values, "\xff")
+	s, ok := m.series[k]
+	if !ok {
+		s = &metricSeries{values: values,
+			counts: make([]uint64, len(m.buckets))}
+		m.series[k] = s
+	}
+	return s
+}
+
+// inc adds 1 to a counter
+func (m *metricVec) inc(values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(values).value++
+}
+
+// observe records a value into a histogram
+func (m *metricVec) observe(v float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.get(values)
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// metricLabels formats label names and values, with an optional extra pair
+func metricLabels(names, values []string, extra ...string) string {
+	var ls []string
+	for i, n := range names {
+		ls = append(ls, fmt.Sprintf("%v=%v", n, strconv.Quote(values[i])))
+	}
+	if len(extra) == 2 {
+		ls = append(ls, fmt.Sprintf("%v=%v", extra[0],
+			strconv.Quote(extra[1])))
+	}
+	if len(ls) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(ls, ",") + "}"
+}
+
+// metricFloat formats a sample value
+func metricFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write writes the family in text exposition format
+func (m *metricVec) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", m.name, m.help, m.name,
+		m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind == "counter" {
+			fmt.Fprintf(w, "%v%v %v\n", m.name,
+				metricLabels(m.labels, s.values), metricFloat(s.value))
+			continue
+		}
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", m.name,
+				metricLabels(m.labels, s.values, "le", metricFloat(b)),
+				s.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", m.name,
+			metricLabels(m.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", m.name,
+			metricLabels(m.labels, s.values), metricFloat(s.value))
+		fmt.Fprintf(w, "%v_count%v %v\n", m.name,
+			metricLabels(m.labels, s.values), s.count)
+	}
+}
+
+// write writes the gauge family in text exposition format
+func (g *metricGauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", g.name, g.help, g.name)
+	vals := g.values()
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var lvs []string
+		if len(g.labels) > 0 {
+			lvs = []string{k}
+		}
+		fmt.Fprintf(w, "%v%v %v\n", g.name, metricLabels(g.labels, lvs),
+			metricFloat(vals[k]))
+	}
+}
+
+// writeMetrics writes every registered family
+func writeMetrics(w io.Writer) {
+	for _, m := range metricVecs {
+		m.write(w)
+	}
+	for _, g := range metricGauges {
+		g.write(w)
+	}
+}
+
+// metricsHandler serves the metrics for scraping
+func metricsHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// metricsTokenValid checks whether r carries the configured bearer token
+func metricsTokenValid(r *http.Request) bool {
+	return metricsToken != "" && subtle.ConstantTimeCompare(
+		[]byte(r.Header.Get("Authorization")),
+		[]byte("Bearer "+metricsToken)) == 1
+}
+
+// metricsTokenProtect requires the configured bearer token, if any
+func metricsTokenProtect(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request,
+		ps httprouter.Params) {
+		if metricsToken != "" && !metricsTokenValid(r) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+/* HTTP metrics */
+
+var (
+	httpRequests = newCounterVec("mx_http_requests_total",
+		"API requests by route and ErrorCode result.",
+		"method", "route", "result")
+	httpDuration = newHistogramVec("mx_http_request_duration_seconds",
+		"API request latency by route and ErrorCode result.",
+		metricBuckets, "method", "route", "result")
+)
+
+// observeRequest records an API request that took d
+func observeRequest(method, route, result string, d time.Duration) {
+	httpRequests.inc(method, route, result)
+	httpDuration.observe(d.Seconds(), method, route, result)
+}
+
+/* Outbound metrics */
+
+var (
+	outboundRequests = newCounterVec("mx_outbound_requests_total",
+		"Integration API calls by service, call and outcome.",
+		"service", "call", "result")
+	outboundDuration = newHistogramVec("mx_outbound_request_duration_seconds",
+		"Integration API call latency by service, call and outcome.",
+		metricBuckets, "service", "call", "result")
+	outboundRetries = newCounterVec("mx_outbound_retries_total",
+		"Integration API calls retried after a network error.",
+		"service", "call")
+)
+
+// outboundResult maps integration errors onto a result label
+func outboundResult(err error) string {
+	switch err {
+	case nil:
+		return MetricResultSuccess
+	case TransactErrorNetwork, DocusignErrorNetwork, HellosignErrorNetwork,
+		WechatErrorNetwork, SmsErrorNetwork:
+		return "network"
+	case TransactErrorAPI, DocusignErrorAPI, HellosignErrorAPI,
+		WechatErrorAPI, WechatErrorCode, SmsErrorAPI:
+		return "api"
+	case TransactErrorResponse, DocusignErrorResponse, HellosignErrorResponse,
+		WechatErrorResponse:
+		return "response"
+	case TransactErrorFail:
+		return "fail"
+	}
+	return "request"
+}
+
+// outboundCall strips ids from a call path to keep label values bounded,
+// e.g. /envelopes/1a2b/recipients -> envelopes/:id/recipients
+func outboundCall(call string) string {
+	segs := strings.Split(strings.Trim(call, "/"), "/")
+	for i, s := range segs {
+		if strings.ContainsAny(s, "0123456789") {
+			segs[i] = ":id"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// observeOutbound records an integration call started at start
+func observeOutbound(service, call string, start time.Time, err error) {
+	call = outboundCall(call)
+	result := outboundResult(err)
+	outboundRequests.inc(service, call, result)
+	outboundDuration.observe(time.Since(start).Seconds(), service, call,
+		result)
+}
+
+/* State gauges */
+
+// countChecks counts the deals with a running docusign check
+func countChecks(lock *sync.Mutex, checks map[uint64]bool) (float64, float64) {
+	lock.Lock()
+	defer lock.Unlock()
+	running := 0.0
+	for _, c := range checks {
+		if c {
+			running++
+		}
+	}
+	return running, float64(len(checks))
+}
+
+var (
+	_ = newGauge("mx_deal_checks_running",
+		"Deals with a DocuSign check in progress.", []string{"side"},
+		func() map[string]float64 {
+			sell, _ := countChecks(sellLock, sellChecks)
+			buy, _ := countChecks(buyLock, buyChecks)
+			return map[string]float64{"sell": sell, "buy": buy}
+		})
+	_ = newGauge("mx_deal_checks_entries",
+		"Entries in the DocuSign check maps.", []string{"side"},
+		func() map[string]float64 {
+			_, sell := countChecks(sellLock, sellChecks)
+			_, buy := countChecks(buyLock, buyChecks)
+			return map[string]float64{"sell": sell, "buy": buy}
+		})
+	_ = newGauge("mx_verification_codes_outstanding",
+		"Unused verification codes that have not expired.",
+		[]string{"purpose"},
+		func() map[string]float64 {
+			return outstandingVerifyCodes(time.Now())
+		})
+)
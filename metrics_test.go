@@ -0,0 +1,81 @@
+// Testing for prometheus metrics
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	c := &metricVec{name: "c", help: "h", kind: "counter",
+		labels: []string{"a"}, series: map[string]*metricSeries{}}
+	c.inc(`x"y`)
+	c.inc(`x"y`)
+	h := &metricVec{name: "h", help: "h", kind: "histogram",
+		buckets: []float64{0.1, 1}, series: map[string]*metricSeries{}}
+	h.observe(0.5)
+	var b bytes.Buffer
+	c.write(&b)
+	h.write(&b)
+	expected := []string{
+		"# TYPE c counter",
+		`c{a="x\"y"} 2`,
+		`h_bucket{le="0.1"} 0`,
+		`h_bucket{le="1"} 1`,
+		`h_bucket{le="+Inf"} 1`,
+		"h_sum 0.5",
+		"h_count 1",
+	}
+	for _, e := range expected {
+		if !strings.Contains(b.String(), e+"\n") {
+			t.Fatalf("[Metrics] Missing %v in:\n%v\n", e, b.String())
+		}
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	defer func(l *Logger) { serverLog = l }(serverLog)
+	serverLog = newLogger(ioutil.Discard, LogLevelInfo, false)
+
+	h := logProtect(func(w http.ResponseWriter, r *http.Request,
+		ps httprouter.Params) {
+		formatReturn(w, r, ps, ErrorCodeNone, false, nil)
+	})
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/metrics_test/42", nil)
+		h(httptest.NewRecorder(), r,
+			httprouter.Params{{Key: "id", Value: "42"}})
+	}
+
+	var b bytes.Buffer
+	httpRequests.write(&b)
+	httpDuration.write(&b)
+	labels := `{method="GET",route="/metrics_test/:id",result="success"`
+	for _, e := range []string{
+		"mx_http_requests_total" + labels + "} 2",
+		"mx_http_request_duration_seconds_count" + labels + "} 2",
+		"mx_http_request_duration_seconds_bucket" + labels + `,le="+Inf"} 2`,
+	} {
+		if !strings.Contains(b.String(), e+"\n") {
+			t.Fatalf("[Metrics] Missing %v in:\n%v\n", e, b.String())
+		}
+	}
+}
+
+func TestOutboundLabels(t *testing.T) {
+	if c := outboundCall("/envelopes/1a2b/recipients"); c !=
+		"envelopes/:id/recipients" {
+		t.Fatalf("[Metrics] outboundCall keeps ids: %v\n", c)
+	}
+	if outboundResult(nil) != MetricResultSuccess ||
+		outboundResult(TransactErrorNetwork) != "network" ||
+		outboundResult(DocusignErrorAPI) != "api" {
+		t.Fatal("[Metrics] outboundResult maps errors wrongly\n")
+	}
+}
@@ -0,0 +1,288 @@
+// Versioned database migrations for MarketX
+// Migrations are numbered and applied in order, each in its own
+// transaction, and recorded in the schema_migrations table. The server
+// refuses to start when the database is behind the latest migration.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migration is a single reversible schema change
+type migration struct {
+	version uint64
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+var (
+	MigrateErrorUnknownVersion = errors.New("Unknown migration version")
+	MigrateErrorBehind         = errors.New("Database schema is behind")
+	MigrateErrorAhead          = errors.New("Database schema is ahead")
+	MigrateErrorIrreversible   = errors.New("Migration cannot be reverted")
+)
+
+const migrationTable = `CREATE TABLE IF NOT EXISTS "schema_migrations" (
+	"version" bigint,
+	"name" text,
+	"applied_at" timestamp with time zone,
+	PRIMARY KEY ("version"))`
+
+// migrateSql creates a migration step running sql statements in order
+func migrateSql(stmts ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, s := range stmts {
+			if err := tx.Exec(s).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// latestMigration returns the version the binary expects
+func latestMigration() uint64 {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// appliedMigrations returns the applied versions and their times
+func appliedMigrations(db *gorm.DB) (map[uint64]time.Time, error) {
+	if err := db.Exec(migrationTable).Error; err != nil {
+		return nil, err
+	}
+	rows, err := db.Raw(`SELECT "version", "applied_at" ` +
+		`FROM "schema_migrations"`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[uint64]time.Time{}
+	for rows.Next() {
+		var v uint64
+		var t time.Time
+		if err := rows.Scan(&v, &t); err != nil {
+			return nil, err
+		}
+		applied[v] = t
+	}
+	return applied, rows.Err()
+}
+
+// schemaVersion returns the highest applied migration version
+func schemaVersion(db *gorm.DB) (uint64, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	var cur uint64
+	for v := range applied {
+		if v > cur {
+			cur = v
+		}
+	}
+	return cur, nil
+}
+
+// applyMigration runs one migration step in a transaction and records it
+func applyMigration(db *gorm.DB, m migration, up bool) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	var err error
+	if up {
+		dbLog.Info("migrating up", LogFields{"version": m.version,
+			"name": m.name})
+		err = m.up(tx)
+		if err == nil {
+			err = tx.Exec(`INSERT INTO "schema_migrations" `+
+				`("version", "name", "applied_at") VALUES (?, ?, ?)`,
+				m.version, m.name, time.Now()).Error
+		}
+	} else {
+		dbLog.Info("migrating down", LogFields{"version": m.version,
+			"name": m.name})
+		err = m.down(tx)
+		if err == nil {
+			err = tx.Exec(`DELETE FROM "schema_migrations" `+
+				`WHERE "version" = ?`, m.version).Error
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %v (%v): %v", m.version, m.name, err)
+	}
+	return tx.Commit().Error
+}
+
+// migrateIrreversible is the down step of migrations that cannot be reverted
+func migrateIrreversible(tx *gorm.DB) error {
+	return MigrateErrorIrreversible
+}
+
+// migrateTo moves the schema up or down to the target version, never below
+// the baseline
+func migrateTo(db *gorm.DB, target uint64) error {
+	if target < 1 {
+		return MigrateErrorIrreversible
+	}
+	if !knownMigration(target) {
+		return MigrateErrorUnknownVersion
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	// Apply missing ones in order, including gaps below the target
+	for _, m := range migrations {
+		if m.version > target {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if err := applyMigration(db, m, true); err != nil {
+			return err
+		}
+	}
+	// Revert in reverse order
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= target {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if err := applyMigration(db, m, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDown reverts the last n applied migrations, stopping short of the
+// baseline
+func migrateDown(db *gorm.DB, n int) error {
+	cur, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	target := cur
+	for i := len(migrations) - 1; i >= 0 && n > 0; i-- {
+		if migrations[i].version > cur {
+			continue
+		}
+		n--
+		target = 0
+		if i > 0 {
+			target = migrations[i-1].version
+		}
+	}
+	if target < 1 {
+		return MigrateErrorIrreversible
+	}
+	return migrateTo(db, target)
+}
+
+// knownMigration checks if a version is defined by this binary
+func knownMigration(v uint64) bool {
+	for _, m := range migrations {
+		if m.version == v {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateStatus writes every migration and whether it has been applied
+func migrateStatus(w io.Writer, db *gorm.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if t, ok := applied[m.version]; ok {
+			state = "applied " + t.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%4v  %-40v %v\n", m.version, m.name, state)
+	}
+	for v := range applied {
+		if !knownMigration(v) {
+			fmt.Fprintf(w, "%4v  %-40v %v\n", v, "?", "unknown to binary")
+		}
+	}
+	return nil
+}
+
+// checkSchema makes sure the database matches the migrations of the binary
+func checkSchema(db *gorm.DB) error {
+	cur, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if cur < latestMigration() {
+		return fmt.Errorf("%v: at version %v, binary expects %v",
+			MigrateErrorBehind, cur, latestMigration())
+	}
+	if cur > latestMigration() {
+		return fmt.Errorf("%v: at version %v, binary expects %v",
+			MigrateErrorAhead, cur, latestMigration())
+	}
+	return nil
+}
+
+// runMigrate is the migrate command: status, up, down [n] or to <version>
+func runMigrate(w io.Writer, db *gorm.DB, args []string) error {
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+	var err error
+	switch args[0] {
+	case "status":
+		return migrateStatus(w, db)
+	case "up":
+		err = migrateTo(db, latestMigration())
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return usageError("invalid step count " + args[1])
+			}
+		}
+		err = migrateDown(db, n)
+	case "to":
+		if len(args) < 2 {
+			return usageError("missing target version")
+		}
+		v, perr := strconv.ParseUint(args[1], 10, 64)
+		if perr != nil {
+			return usageError("invalid version " + args[1])
+		}
+		err = migrateTo(db, v)
+	default:
+		return usageError("unknown migrate command " + args[0])
+	}
+	if err != nil {
+		return err
+	}
+	cur, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Schema at version %v (latest %v)\n", cur,
+		latestMigration())
+	return nil
+}
@@ -0,0 +1,33 @@
+// Testing for database migration definitions
+package main
+
+import (
+	"testing"
+)
+
+func TestMigrationList(t *testing.T) {
+	var last uint64
+	for _, m := range migrations {
+		if m.version <= last {
+			t.Fatalf("[Migrate] Version %v is not after %v\n", m.version, last)
+		}
+		if m.name == "" || m.up == nil || m.down == nil {
+			t.Fatalf("[Migrate] Version %v is incomplete\n", m.version)
+		}
+		last = m.version
+	}
+	if latestMigration() != last {
+		t.Fatalf("[Migrate] Latest migration is %v instead of %v\n",
+			latestMigration(), last)
+	}
+}
+
+func TestMigrationBaseline(t *testing.T) {
+	if migrations[0].version != 1 ||
+		migrations[0].down(nil) != MigrateErrorIrreversible {
+		t.Fatal("[Migrate] Baseline migration can be reverted\n")
+	}
+	if migrateTo(nil, 0) != MigrateErrorIrreversible {
+		t.Fatal("[Migrate] Migrating below the baseline accepted\n")
+	}
+}
@@ -0,0 +1,662 @@
+// Database migrations for MarketX
+// Append new migrations to the end of the list with the next version number,
+// never edit one that has been released.
+package main
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "baseline",
+		up: migrateSql(
+			`CREATE TABLE IF NOT EXISTS "user_companies" (
+				"user_id" integer,
+				"company_id" integer,
+				PRIMARY KEY ("user_id","company_id"))`,
+			`CREATE TABLE IF NOT EXISTS "users" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"wx_open_id" text,
+				"wx_union_id" text,
+				"wx_access_token" text,
+				"user_state" bigint,
+				"user_level" bigint,
+				"first_name" text,
+				"middle_initial" text,
+				"id_card_number" text,
+				"last_name" text,
+				"full_name" text,
+				"email" text,
+				"email_token" text,
+				"email_token_expire" timestamp with time zone,
+				"password_hash" text,
+				"password_token" text,
+				"password_token_expire" timestamp with time zone,
+				"role_type" bigint,
+				"creation_ip_address" text,
+				"last_ip_address" text,
+				"last_language" text,
+				"affiliation" text,
+				"investor_type" bigint,
+				"investor_situation" bigint,
+				"phone_number" text,
+				"photo_id_pic" text,
+				"photo_id_name" text,
+				"photo_id_type" text,
+				"photo_id_token" text,
+				"dob" text,
+				"address1" text,
+				"address2" text,
+				"city" text,
+				"state" text,
+				"zip" text,
+				"country" text,
+				"citizen_type" bigint,
+				"ssn_encrypted" text,
+				"employment_type" bigint,
+				"employer" text,
+				"occupation" text,
+				"public_company_policy_maker" bigint,
+				"employed_by_broker_dealer" bigint,
+				"risk_tolerance" bigint,
+				"marital_status" bigint,
+				"household_income" bigint,
+				"household_networth" bigint,
+				"invest_portfolio_total" bigint,
+				"invest_exp_total" bigint,
+				"invest_real_estate_portion" bigint,
+				"invest_convert_cash_ninety_days_portion" bigint,
+				"invest_alternative_portion" bigint,
+				"invest_private_company" bigint,
+				"invest_portfolio_horizon" bigint,
+				"education_level" bigint,
+				"invest_knowledge" bigint,
+				"work_with_financial_advisors" bigint,
+				"transact_api_investor_id" bigint,
+				"transact_api_issuer_id" bigint,
+				"transact_api_kyc_id" bigint,
+				"transact_api_kyc_expire" timestamp with time zone,
+				"transact_api_kyc_attempts" bigint,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_users_photo_id_token ON "users"(photo_id_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON "users"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_users_wx_open_id ON "users"(wx_open_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_users_wx_union_id ON "users"(wx_union_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_users_email ON "users"("email")`,
+			`CREATE INDEX IF NOT EXISTS idx_users_email_token ON "users"(email_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_users_password_token ON "users"(password_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_users_phone_number ON "users"(phone_number)`,
+			`CREATE TABLE IF NOT EXISTS "company_tags" (
+				"company_id" integer,
+				"tag_id" integer,
+				PRIMARY KEY ("company_id","tag_id"))`,
+			`CREATE TABLE IF NOT EXISTS "companies" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"name" text,
+				"description" varchar(10000),
+				"description_cn" varchar(10000),
+				"year_founded" bigint,
+				"state_founded" text,
+				"hq" text,
+				"home_page" text,
+				"key_person" text,
+				"num_employees" bigint,
+				"total_valuation" numeric,
+				"total_funding" numeric,
+				"growth_rate_percent" numeric,
+				"size_multiple" numeric,
+				"investors" varchar(10000),
+				"investor_logo_pics" varchar(1000),
+				"num_slides" bigint,
+				"video_url" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_companies_deleted_at ON "companies"(deleted_at)`,
+			`CREATE TABLE IF NOT EXISTS "company_executives" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"company_id" bigint,
+				"name" text,
+				"role" text,
+				"office" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_company_executives_deleted_at ON "company_executives"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_company_executives_company_id ON "company_executives"(company_id)`,
+			`CREATE TABLE IF NOT EXISTS "fundings" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"company_id" bigint,
+				"type" text,
+				"date" text,
+				"amount" numeric,
+				"raised_to_date" numeric,
+				"pre_valuation" numeric,
+				"post_valuation" numeric,
+				"status" text,
+				"stage" text,
+				"num_shares" bigint,
+				"par_value" numeric,
+				"dividend_rate_percent" numeric,
+				"original_issue_price" numeric,
+				"liquidation" numeric,
+				"liquidation_pref_multiple" bigint,
+				"conversion_price" numeric,
+				"percent_owned" numeric,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_fundings_deleted_at ON "fundings"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_fundings_company_id ON "fundings"(company_id)`,
+			`CREATE TABLE IF NOT EXISTS "company_updates" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"company_id" bigint,
+				"title" text,
+				"url" text,
+				"date" text,
+				"language" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_company_updates_deleted_at ON "company_updates"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_company_updates_company_id ON "company_updates"(company_id)`,
+			`CREATE TABLE IF NOT EXISTS "tags" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"name" text,
+				"name_cn" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_tags_deleted_at ON "tags"(deleted_at)`,
+			`CREATE TABLE IF NOT EXISTS "banks" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"user_id" bigint,
+				"full_name" text,
+				"nick_name" text,
+				"routing_number_encrypted" text,
+				"account_number_encrypted" text,
+				"account_type" bigint,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_banks_deleted_at ON "banks"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_banks_user_id ON "banks"(user_id)`,
+			`CREATE TABLE IF NOT EXISTS "offers" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"user_id" bigint,
+				"company_id" bigint,
+				"deal_id" bigint,
+				"own_type" bigint,
+				"vested" bigint,
+				"restrictions" bigint,
+				"shares_total_own" bigint,
+				"stock_type" bigint,
+				"exercise_date" text,
+				"exercise_price" numeric,
+				"shares_to_sell" bigint,
+				"desire_price" numeric,
+				"share_certificate_doc" text,
+				"share_certificate_name" text,
+				"share_certificate_type" text,
+				"share_certificate_token" text,
+				"company_by_laws_doc" text,
+				"company_by_laws_name" text,
+				"company_by_laws_type" text,
+				"company_by_laws_token" text,
+				"shareholder_agreement_doc" text,
+				"shareholder_agreement_name" text,
+				"shareholder_agreement_type" text,
+				"shareholder_agreement_token" text,
+				"stock_option_plan_doc" text,
+				"stock_option_plan_name" text,
+				"stock_option_plan_type" text,
+				"stock_option_plan_token" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_offers_deal_id ON "offers"(deal_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_offers_share_certificate_token ON "offers"(share_certificate_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_offers_company_by_laws_token ON "offers"(company_by_laws_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_offers_shareholder_agreement_token ON "offers"(shareholder_agreement_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_offers_stock_option_plan_token ON "offers"(stock_option_plan_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_offers_deleted_at ON "offers"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_offers_user_id ON "offers"(user_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_offers_company_id ON "offers"(company_id)`,
+			`CREATE TABLE IF NOT EXISTS "deals" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"company_id" bigint,
+				"name" text,
+				"deal_state" bigint,
+				"deal_special" bigint,
+				"fund_num" bigint,
+				"note" text,
+				"shares_amount" bigint,
+				"shares_left" bigint,
+				"shares_type" bigint,
+				"actual_price" numeric,
+				"actual_valuation" numeric,
+				"start_date" timestamp with time zone,
+				"end_date" timestamp with time zone,
+				"escrow_account" text,
+				"escrow_account_cn" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_deals_deleted_at ON "deals"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_deals_company_id ON "deals"(company_id)`,
+			`CREATE TABLE IF NOT EXISTS "deal_shareholders" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"bank_id" bigint,
+				"user_id" bigint,
+				"deal_id" bigint,
+				"deal_shareholder_state" bigint,
+				"engagement_letter_sign" text,
+				"engagement_letter_sign_id" text,
+				"engagement_letter_sign_url" text,
+				"engagement_letter_sign_expire" timestamp with time zone,
+				"engagement_letter_sign_check" timestamp with time zone,
+				"engagement_letter_token" text,
+				"shares_sell_amount" bigint,
+				"rofr_waiver_sign" text,
+				"rofr_waiver_sign_id" text,
+				"rofr_waiver_sign_url" text,
+				"rofr_waiver_sign_expire" timestamp with time zone,
+				"purchase_agreement_sign" text,
+				"purchase_agreement_sign_id" text,
+				"purchase_agreement_sign_url" text,
+				"purchase_agreement_sign_expire" timestamp with time zone,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_shareholders_deleted_at ON "deal_shareholders"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_shareholders_bank_id ON "deal_shareholders"(bank_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_shareholders_user_id ON "deal_shareholders"(user_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_shareholders_deal_id ON "deal_shareholders"(deal_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_shareholders_engagement_letter_token ON "deal_shareholders"(engagement_letter_token)`,
+			`CREATE TABLE IF NOT EXISTS "deal_investors" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"bank_id" bigint,
+				"user_id" bigint,
+				"deal_id" bigint,
+				"deal_investor_state" bigint,
+				"engagement_letter_sign" text,
+				"engagement_letter_sign_id" text,
+				"engagement_letter_sign_url" text,
+				"engagement_letter_sign_expire" timestamp with time zone,
+				"engagement_letter_sign_check" timestamp with time zone,
+				"engagement_letter_token" text,
+				"shares_buy_amount" bigint,
+				"summary_of_terms_sign" text,
+				"summary_of_terms_sign_id" text,
+				"summary_of_terms_sign_url" text,
+				"summary_of_terms_sign_expire" timestamp with time zone,
+				"summary_of_terms_sign_check" timestamp with time zone,
+				"summary_of_terms_token" text,
+				"indication_sign" text,
+				"indication_sign_id" text,
+				"indication_sign_url" text,
+				"indication_sign_expire" timestamp with time zone,
+				"rofr_waiver_sign" text,
+				"rofr_waiver_sign_id" text,
+				"rofr_waiver_sign_url" text,
+				"rofr_waiver_sign_expire" timestamp with time zone,
+				"lp_agreement_sign" text,
+				"lp_agreement_sign_id" text,
+				"lp_agreement_sign_url" text,
+				"lp_agreement_sign_expire" timestamp with time zone,
+				"gp_agreement_sign" text,
+				"gp_agreement_sign_id" text,
+				"gp_agreement_sign_url" text,
+				"gp_agreement_sign_expire" timestamp with time zone,
+				"spc_application_sign" text,
+				"spc_application_sign_id" text,
+				"spc_application_sign_url" text,
+				"spc_application_sign_expire" timestamp with time zone,
+				"spc_ppm_sign" text,
+				"spc_ppm_sign_id" text,
+				"spc_ppm_sign_url" text,
+				"spc_ppm_sign_expire" timestamp with time zone,
+				"spc_supplement_sign" text,
+				"spc_supplement_sign_id" text,
+				"spc_supplement_sign_url" text,
+				"spc_supplement_sign_expire" timestamp with time zone,
+				"de_ppm_sign" text,
+				"de_ppm_sign_id" text,
+				"de_ppm_sign_url" text,
+				"de_ppm_sign_expire" timestamp with time zone,
+				"de_ppm_sign_check" timestamp with time zone,
+				"de_ppm_token" text,
+				"de_operating_agreement_sign" text,
+				"de_operating_agreement_sign_id" text,
+				"de_operating_agreement_sign_url" text,
+				"de_operating_agreement_sign_expire" timestamp with time zone,
+				"de_operating_agreement_sign_check" timestamp with time zone,
+				"de_operating_agreement_token" text,
+				"de_subscription_agreement_sign" text,
+				"de_subscription_agreement_sign_id" text,
+				"de_subscription_agreement_sign_url" text,
+				"de_subscription_agreement_sign_expire" timestamp with time zone,
+				"de_subscription_agreement_sign_check" timestamp with time zone,
+				"de_subscription_agreement_token" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_user_id ON "deal_investors"(user_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_deal_id ON "deal_investors"(deal_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_summary_of_terms_token ON "deal_investors"(summary_of_terms_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_de_ppm_token ON "deal_investors"(de_ppm_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_de_operating_agreement_token ON "deal_investors"(de_operating_agreement_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_deleted_at ON "deal_investors"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_bank_id ON "deal_investors"(bank_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_engagement_letter_token ON "deal_investors"(engagement_letter_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_deal_investors_de_subscription_agreement_token ON "deal_investors"(de_subscription_agreement_token)`,
+			`CREATE TABLE IF NOT EXISTS "wechats" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"user_id" bigint,
+				"wechat_state" bigint,
+				"open_id" text,
+				"union_id" text,
+				"photo_id_pic" text,
+				"photo_id_name" text,
+				"photo_id_type" text,
+				"citizen_type" bigint,
+				"overseas_bank" bigint,
+				"investment_amount" bigint,
+				"nickname" text,
+				"sex" integer,
+				"city" text,
+				"country" text,
+				"province" text,
+				"language" text,
+				"head_img_url" text,
+				"subscribe_time" text,
+				"group_id" text,
+				"remark" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_wechats_deleted_at ON "wechats"(deleted_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_wechats_user_id ON "wechats"(user_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_wechats_open_id ON "wechats"(open_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_wechats_union_id ON "wechats"(union_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_wechats_group_id ON "wechats"(group_id)`,
+		),
+		// The baseline holds all the data, it is never reverted
+		down: migrateIrreversible,
+	},
+	{
+		version: 2,
+		name:    "rate_limits",
+		up: migrateSql(
+			`CREATE TABLE "rate_limits" (
+				"key" text,
+				"count" bigint NOT NULL,
+				"reset_at" timestamp with time zone NOT NULL,
+				PRIMARY KEY ("key"))`,
+			`CREATE INDEX idx_rate_limits_reset_at ON "rate_limits"(reset_at)`,
+		),
+		down: migrateSql(
+			`DROP TABLE IF EXISTS "rate_limits"`,
+		),
+	},
+	{
+		version: 3,
+		name:    "login_lockout",
+		up: migrateSql(
+			`ALTER TABLE "users"
+				ADD COLUMN "failed_login_count" bigint NOT NULL DEFAULT 0,
+				ADD COLUMN "locked_until" timestamp with time zone,
+				ADD COLUMN "unlock_token" text,
+				ADD COLUMN "last_user_agent" text`,
+			`CREATE INDEX idx_users_unlock_token ON "users"(unlock_token)`,
+		),
+		down: migrateSql(
+			`DROP INDEX IF EXISTS idx_users_unlock_token`,
+			`ALTER TABLE "users"
+				DROP COLUMN IF EXISTS "failed_login_count",
+				DROP COLUMN IF EXISTS "locked_until",
+				DROP COLUMN IF EXISTS "unlock_token",
+				DROP COLUMN IF EXISTS "last_user_agent"`,
+		),
+	},
+	{
+		version: 4,
+		name:    "sessions",
+		up: migrateSql(
+			`CREATE TABLE "sessions" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"user_id" integer NOT NULL,
+				"expires_at" timestamp with time zone NOT NULL,
+				"revoked_at" timestamp with time zone,
+				"last_used_at" timestamp with time zone,
+				"ip_address" text,
+				"user_agent" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_sessions_deleted_at ON "sessions"(deleted_at)`,
+			`CREATE INDEX idx_sessions_user_id ON "sessions"(user_id)`,
+			`CREATE INDEX idx_sessions_expires_at ON "sessions"(expires_at)`,
+			`CREATE TABLE "refresh_tokens" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"session_id" integer NOT NULL,
+				"token_hash" text NOT NULL,
+				"used_at" timestamp with time zone,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_refresh_tokens_deleted_at ON `+
+				`"refresh_tokens"(deleted_at)`,
+			`CREATE INDEX idx_refresh_tokens_session_id ON `+
+				`"refresh_tokens"(session_id)`,
+			`CREATE UNIQUE INDEX uix_refresh_tokens_token_hash ON `+
+				`"refresh_tokens"(token_hash)`,
+		),
+		down: migrateSql(
+			`DROP TABLE IF EXISTS "refresh_tokens"`,
+			`DROP TABLE IF EXISTS "sessions"`,
+		),
+	},
+	{
+		version: 5,
+		name:    "two_factor",
+		up: migrateSql(
+			`ALTER TABLE "users"
+				ADD COLUMN "totp_secret_encrypted" text,
+				ADD COLUMN "totp_enabled" boolean NOT NULL DEFAULT false,
+				ADD COLUMN "totp_last_step" bigint NOT NULL DEFAULT 0`,
+			`ALTER TABLE "sessions"
+				ADD COLUMN "two_factor" boolean NOT NULL DEFAULT false`,
+			`CREATE TABLE "recovery_codes" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"user_id" integer NOT NULL,
+				"code_hash" text NOT NULL,
+				"used_at" timestamp with time zone,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_recovery_codes_deleted_at ON `+
+				`"recovery_codes"(deleted_at)`,
+			`CREATE INDEX idx_recovery_codes_user_id ON `+
+				`"recovery_codes"(user_id)`,
+			`CREATE INDEX idx_recovery_codes_code_hash ON `+
+				`"recovery_codes"(code_hash)`,
+		),
+		down: migrateSql(
+			`DROP TABLE IF EXISTS "recovery_codes"`,
+			`ALTER TABLE "sessions" DROP COLUMN IF EXISTS "two_factor"`,
+			`ALTER TABLE "users"
+				DROP COLUMN IF EXISTS "totp_secret_encrypted",
+				DROP COLUMN IF EXISTS "totp_enabled",
+				DROP COLUMN IF EXISTS "totp_last_step"`,
+		),
+	},
+	{
+		version: 6,
+		name:    "user_roles",
+		up: migrateSql(
+			`CREATE TABLE "user_roles" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"user_id" integer NOT NULL,
+				"role" text NOT NULL,
+				"granted_by" integer NOT NULL DEFAULT 0,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_user_roles_deleted_at ON "user_roles"(deleted_at)`,
+			`CREATE UNIQUE INDEX uix_user_roles_user_id_role ON `+
+				`"user_roles"(user_id, role)`,
+			// Existing admins keep full access
+			`INSERT INTO "user_roles" (created_at, updated_at, user_id, role)
+				SELECT now(), now(), id, 'super_admin' FROM "users"
+				WHERE user_level = 1 AND deleted_at IS NULL`,
+		),
+		down: migrateSql(
+			`DROP TABLE IF EXISTS "user_roles"`,
+		),
+	},
+	{
+		version: 7,
+		name:    "api_keys",
+		up: migrateSql(
+			`CREATE TABLE "api_keys" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"name" text NOT NULL,
+				"prefix" text NOT NULL,
+				"key_hash" text NOT NULL,
+				"scopes" text NOT NULL,
+				"expires_at" timestamp with time zone,
+				"revoked_at" timestamp with time zone,
+				"last_used_at" timestamp with time zone,
+				"last_used_ip" text,
+				"created_by" integer NOT NULL DEFAULT 0,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_api_keys_deleted_at ON "api_keys"(deleted_at)`,
+			`CREATE UNIQUE INDEX uix_api_keys_key_hash ON "api_keys"(key_hash)`,
+		),
+		down: migrateSql(
+			`DROP TABLE IF EXISTS "api_keys"`,
+		),
+	},
+	{
+		version: 8,
+		name:    "wechat_profile",
+		up: migrateSql(
+			`ALTER TABLE "users"
+				ADD COLUMN "wx_nickname" text,
+				ADD COLUMN "wx_head_img_url" text`,
+		),
+		down: migrateSql(
+			`ALTER TABLE "users"
+				DROP COLUMN IF EXISTS "wx_nickname",
+				DROP COLUMN IF EXISTS "wx_head_img_url"`,
+		),
+	},
+	{
+		version: 9,
+		name:    "sms_deliveries",
+		up: migrateSql(
+			`CREATE TABLE "sms_deliveries" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"provider" text NOT NULL,
+				"phone_number" text NOT NULL,
+				"template" integer NOT NULL,
+				"lang" text,
+				"success" boolean NOT NULL DEFAULT false,
+				"response" text,
+				"request_id" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_sms_deliveries_deleted_at ON `+
+				`"sms_deliveries"(deleted_at)`,
+			`CREATE INDEX idx_sms_deliveries_phone_number ON `+
+				`"sms_deliveries"(phone_number)`,
+		),
+		down: migrateSql(
+			`DROP TABLE IF EXISTS "sms_deliveries"`,
+		),
+	},
+	{
+		version: 10,
+		name:    "verification_codes",
+		up: migrateSql(
+			`CREATE TABLE "verification_codes" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"purpose" text NOT NULL,
+				"target" text NOT NULL,
+				"code_hash" text NOT NULL,
+				"expires_at" timestamp with time zone NOT NULL,
+				"attempts" integer NOT NULL DEFAULT 0,
+				"used_at" timestamp with time zone,
+				"ip_address" text,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_verification_codes_deleted_at ON `+
+				`"verification_codes"(deleted_at)`,
+			`CREATE INDEX idx_verification_codes_purpose_target ON `+
+				`"verification_codes"(purpose, target, created_at)`,
+			`CREATE INDEX idx_verification_codes_expires_at ON `+
+				`"verification_codes"(expires_at)`,
+		),
+		down: migrateSql(
+			`DROP TABLE IF EXISTS "verification_codes"`,
+		),
+	},
+	{
+		version: 11,
+		name:    "login_methods",
+		up: migrateSql(
+			`CREATE TABLE "login_methods" (
+				"id" serial,
+				"created_at" timestamp with time zone,
+				"updated_at" timestamp with time zone,
+				"deleted_at" timestamp with time zone,
+				"role_type" bigint NOT NULL,
+				"method" text NOT NULL,
+				"enabled" boolean NOT NULL DEFAULT false,
+				"updated_by" integer NOT NULL DEFAULT 0,
+				PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_login_methods_deleted_at ON `+
+				`"login_methods"(deleted_at)`,
+			`CREATE UNIQUE INDEX uix_login_methods_role_type_method ON `+
+				`"login_methods"(role_type, method)`,
+		),
+		down: migrateSql(
+			`DROP TABLE IF EXISTS "login_methods"`,
+		),
+	},
+	{
+		version: 12,
+		name:    "phone_e164",
+		up:      migratePhoneNumbers,
+		down: migrateSql(
+			`DROP INDEX IF EXISTS uix_users_phone_number`,
+			`UPDATE "users" SET "phone_number" = c.original
+				FROM "phone_number_changes" c WHERE "users".id = c.user_id`,
+			`DROP TABLE IF EXISTS "phone_number_changes"`,
+		),
+	},
+}
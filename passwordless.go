@@ -0,0 +1,150 @@
+// Passwordless login for MarketX
+// Besides the password, users can sign in with a code texted to their phone
+// number or a link emailed to them. Links are tokens signed with the jwt
+// keyring for their own audience, carrying a verification code so each one
+// works once. Admins turn each method on or off per user role type.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	LoginMethodSms       = "sms"
+	LoginMethodEmailLink = "email_link"
+)
+
+// LoginMethods are the login methods admins can turn on or off
+var LoginMethods = []string{LoginMethodSms, LoginMethodEmailLink}
+
+// LoginRoleTypes are the role types login methods are set for
+var LoginRoleTypes = []uint64{RoleTypeShareholder, RoleTypeInvestor}
+
+// loginLinkAudience is the audience of login links, which keeps them from
+// being taken as access tokens
+func loginLinkAudience() string {
+	return jwtAudience + "/login_link"
+}
+
+// loginMethodKnown checks whether admins can set method
+func loginMethodKnown(method string) bool {
+	for _, m := range LoginMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// loginMethodDefault checks whether method is on for role types no admin
+// has set it for
+func loginMethodDefault(method string) bool {
+	for _, m := range loginMethodsDefault {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// loginMethodEnabled checks whether users of roleType can sign in with
+// method
+func loginMethodEnabled(roleType uint64, method string) bool {
+	var lm LoginMethod
+	if dbConn.First(&lm, "role_type = ? AND method = ?", roleType,
+		method).RecordNotFound() {
+		return loginMethodDefault(method)
+	}
+	return lm.Enabled
+}
+
+// loginMethodSettings returns whether every method is on for every role
+// type
+func loginMethodSettings() ([]map[string]interface{}, error) {
+	var lms []LoginMethod
+	if err := dbConn.Find(&lms).Error; err != nil {
+		return nil, err
+	}
+	set := map[string]*LoginMethod{}
+	for i := range lms {
+		set[fmt.Sprintf("%v|%v", lms[i].RoleType, lms[i].Method)] = &lms[i]
+	}
+
+	settings := []map[string]interface{}{}
+	for _, rt := range LoginRoleTypes {
+		for _, m := range LoginMethods {
+			s := map[string]interface{}{"role_type": rt, "method": m,
+				"enabled": loginMethodDefault(m), "default": true,
+				"updated_by": 0, "updated_at": 0}
+			if lm, ok := set[fmt.Sprintf("%v|%v", rt, m)]; ok {
+				s["enabled"], s["default"] = lm.Enabled, false
+				s["updated_by"] = lm.UpdatedBy
+				s["updated_at"] = unixTime(lm.UpdatedAt)
+			}
+			settings = append(settings, s)
+		}
+	}
+	return settings, nil
+}
+
+// setLoginMethod turns method on or off for users of roleType
+func setLoginMethod(roleType uint64, method string, enabled bool,
+	updatedBy uint) error {
+	var lm LoginMethod
+	if dbConn.First(&lm, "role_type = ? AND method = ?", roleType,
+		method).RecordNotFound() {
+		return dbConn.Create(&LoginMethod{RoleType: roleType, Method: method,
+			Enabled: enabled, UpdatedBy: updatedBy}).Error
+	}
+	return dbConn.Model(&lm).Updates(map[string]interface{}{
+		"enabled": enabled, "updated_by": updatedBy}).Error
+}
+
+// newLoginLinkToken signs a login link token of u around the verification
+// code of the link
+func newLoginLinkToken(u *User, code string, now time.Time) (string,
+	error) {
+	return jwtKeys.sign(jwt.MapClaims{
+		"iss":   jwtIssuer,
+		"aud":   loginLinkAudience(),
+		"sub":   strconv.FormatUint(uint64(u.ID), 10),
+		"email": u.Email,
+		"code":  code,
+		"iat":   now.Unix(),
+		"exp":   now.Add(verifyCodeTtl).Unix(),
+		"jti":   newRequestId(),
+	})
+}
+
+// parseLoginLinkToken verifies a login link token at now, returning the
+// user id, email and verification code it carries
+func parseLoginLinkToken(token string, now time.Time) (uint, string, string,
+	bool) {
+	t, err := jwtParser.Parse(token, jwtKeys.verifyKey)
+	if err != nil || !t.Valid {
+		return 0, "", "", false
+	}
+	c, ok := t.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, "", "", false
+	}
+	if iss, _ := c["iss"].(string); iss != jwtIssuer ||
+		!claimAudience(c, loginLinkAudience()) {
+		return 0, "", "", false
+	}
+	if exp, ok := claimTime(c, "exp"); !ok || now.After(exp) {
+		return 0, "", "", false
+	}
+	sub, _ := c["sub"].(string)
+	uid, err := strconv.ParseUint(sub, 10, 64)
+	email, _ := c["email"].(string)
+	code, _ := c["code"].(string)
+	if err != nil || email == "" || code == "" {
+		return 0, "", "", false
+	}
+	return uint(uid), email, code, true
+}
@@ -0,0 +1,70 @@
+// Testing for passwordless login
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestLoginLinkToken(t *testing.T) {
+	defer useTestKeyring(t)()
+	u := &User{Email: "someone@example.com"}
+	u.ID = 7
+	now := time.Now()
+	s, err := newLoginLinkToken(u, "123456", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid, email, code, ok := parseLoginLinkToken(s, now)
+	if !ok || uid != 7 || email != u.Email || code != "123456" {
+		t.Fatalf("[Passwordless] Bad link token %v %v %v %v\n", uid, email,
+			code, ok)
+	}
+	if _, _, _, ok := parseLoginLinkToken(s,
+		now.Add(verifyCodeTtl+time.Second)); ok {
+		t.Fatal("[Passwordless] Expired link token accepted\n")
+	}
+	if _, _, _, ok := parseLoginLinkToken(s[:len(s)-2]+"xx", now); ok {
+		t.Fatal("[Passwordless] Tampered link token accepted\n")
+	}
+
+	// Link tokens are no access tokens and access tokens no links
+	token, err := jwtParser.Parse(s, jwtKeys.verifyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ec := parseAuthClaims(token.Claims.(jwt.MapClaims),
+		now); ec == ErrorCodeNone {
+		t.Fatal("[Passwordless] Link token accepted as access token\n")
+	}
+	sess := &Session{}
+	sess.ID = 1
+	access, err := jwtKeys.sign(newAccessClaims(u, sess, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok := parseLoginLinkToken(access, now); ok {
+		t.Fatal("[Passwordless] Access token accepted as link token\n")
+	}
+}
+
+func TestLoginMethods(t *testing.T) {
+	for _, m := range LoginMethods {
+		if !loginMethodKnown(m) {
+			t.Fatalf("[Passwordless] %v is not known\n", m)
+		}
+	}
+	if loginMethodKnown("password") || loginMethodKnown("none") {
+		t.Fatal("[Passwordless] Unknown login method accepted\n")
+	}
+	old := loginMethodsDefault
+	defer func() { loginMethodsDefault = old }()
+	loginMethodsDefault = []string{LoginMethodSms}
+	if !loginMethodDefault(LoginMethodSms) ||
+		loginMethodDefault(LoginMethodEmailLink) {
+		t.Fatal("[Passwordless] Bad default login methods\n")
+	}
+}
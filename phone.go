@@ -0,0 +1,356 @@
+// Phone numbers for MarketX
+// Phone numbers are stored in E.164 form (+8613812345678) so the same
+// number always finds the same account however it was typed. Numbers
+// without a country code are read in the phone_region of the request, or
+// the region of the request language. The phone_e164 migration normalized
+// the numbers stored before, recording every change and collision in
+// phone_number_changes for the phone-report command.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// phoneRegion are the dialling rules of a region
+type phoneRegion struct {
+	code  string // country calling code
+	trunk string // national prefix, not part of the number
+	intl  string // prefix for dialling abroad
+	min   int    // lengths of the national number
+	max   int
+	lead  string // digits the national number can start with
+}
+
+// PhoneRegions are the regions numbers without a country code can be in
+var PhoneRegions = map[string]phoneRegion{
+	"CN": {code: "86", trunk: "0", intl: "00", min: 9, max: 11,
+		lead: "123456789"},
+	"HK": {code: "852", intl: "001", min: 8, max: 8, lead: "2345679"},
+	"TW": {code: "886", trunk: "0", intl: "002", min: 8, max: 9,
+		lead: "23456789"},
+	"US": {code: "1", trunk: "1", intl: "011", min: 10, max: 10,
+		lead: "23456789"},
+}
+
+// LangPhoneRegions are the default regions of the request languages
+var LangPhoneRegions = map[string]string{
+	"en-US": "US",
+	"zh-CN": "CN",
+}
+
+const (
+	// E.164 numbers have at most 15 digits
+	phoneE164Min = 7
+	phoneE164Max = 15
+)
+
+var PhoneErrorInvalid = errors.New("Invalid phone number")
+
+// national returns the national number of digits without its trunk prefix
+func (rg phoneRegion) national(digits string) (string, bool) {
+	if rg.trunk != "" && strings.HasPrefix(digits, rg.trunk) &&
+		!strings.Contains(rg.lead, rg.trunk) {
+		digits = digits[len(rg.trunk):]
+	}
+	if len(digits) < rg.min || len(digits) > rg.max ||
+		!strings.ContainsRune(rg.lead, rune(digits[0])) {
+		return "", false
+	}
+	return digits, true
+}
+
+// phoneDigits reads the digits of a typed number, which can start with a
+// + and use spaces, dashes, dots and parentheses
+func phoneDigits(number string) (string, bool, bool) {
+	number = strings.TrimSpace(number)
+	plus := strings.HasPrefix(number, "+")
+	if plus {
+		number = number[1:]
+	}
+	digits := make([]byte, 0, len(number))
+	for _, c := range number {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, byte(c))
+		case strings.ContainsRune(" -.()", c):
+		default:
+			return "", false, false
+		}
+	}
+	return string(digits), plus, len(digits) > 0
+}
+
+// internationalPhone checks the digits of a number after its +, applying
+// the rules of the regions known
+func internationalPhone(digits string) (string, bool) {
+	for _, rg := range PhoneRegions {
+		if !strings.HasPrefix(digits, rg.code) {
+			continue
+		}
+		// Calling codes are never the start of another, and the other
+		// NANP countries of +1 have the rules of the US
+		if n, ok := rg.national(digits[len(rg.code):]); ok {
+			return "+" + rg.code + n, true
+		}
+		return "", false
+	}
+	if len(digits) < phoneE164Min || len(digits) > phoneE164Max ||
+		digits[0] == '0' {
+		return "", false
+	}
+	return "+" + digits, true
+}
+
+// normalizePhone returns number in E.164 form, reading it in region if it
+// has no country code
+func normalizePhone(number, region string) (string, error) {
+	digits, plus, ok := phoneDigits(number)
+	if !ok {
+		return "", PhoneErrorInvalid
+	}
+	rg, known := PhoneRegions[region]
+	if !plus && known && strings.HasPrefix(digits, rg.intl) {
+		plus, digits = true, digits[len(rg.intl):]
+	}
+	if plus {
+		if e, ok := internationalPhone(digits); ok {
+			return e, nil
+		}
+		return "", PhoneErrorInvalid
+	}
+	if !known {
+		return "", PhoneErrorInvalid
+	}
+	if n, ok := rg.national(digits); ok {
+		return "+" + rg.code + n, nil
+	}
+	// The country code typed without the +
+	if strings.HasPrefix(digits, rg.code) {
+		if n, ok := rg.national(digits[len(rg.code):]); ok {
+			return "+" + rg.code + n, nil
+		}
+	}
+	return "", PhoneErrorInvalid
+}
+
+// requestPhoneRegion returns the region to read phone numbers of r in
+func requestPhoneRegion(r *http.Request) string {
+	region := strings.ToUpper(strings.TrimSpace(r.FormValue("phone_region")))
+	if _, ok := PhoneRegions[region]; ok {
+		return region
+	}
+	if region, ok := LangPhoneRegions[requestLang(r)]; ok {
+		return region
+	}
+	return phoneDefaultRegion
+}
+
+const (
+	PhoneChangeNormalized = "normalized"
+	PhoneChangeCollision  = "collision"
+	PhoneChangeInvalid    = "invalid"
+)
+
+// phoneRow is the stored phone number of a user
+type phoneRow struct {
+	userId  uint
+	number  string
+	country string
+}
+
+// phoneChange is what normalizing changes of a stored phone number, a
+// collision loses its number to the user keeping it
+type phoneChange struct {
+	userId     uint
+	original   string
+	normalized string
+	result     string
+	keptUserId uint
+}
+
+// loadPhoneRows returns the phone numbers of the users in id order
+func loadPhoneRows(db *gorm.DB) ([]phoneRow, error) {
+	rows, err := db.Raw(`SELECT "id", "phone_number", ` +
+		`COALESCE("country", '') FROM "users" WHERE "deleted_at" IS NULL ` +
+		`AND COALESCE("phone_number", '') <> '' ORDER BY "id"`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prs := []phoneRow{}
+	for rows.Next() {
+		var pr phoneRow
+		if err := rows.Scan(&pr.userId, &pr.number,
+			&pr.country); err != nil {
+			return nil, err
+		}
+		prs = append(prs, pr)
+	}
+	return prs, rows.Err()
+}
+
+// planPhoneNormalization returns the changes normalizing rows makes,
+// numbers are read in the region of the user country and the earliest
+// user keeps a number others also end up with
+func planPhoneNormalization(rows []phoneRow) []phoneChange {
+	owners := map[string]uint{}
+	changes := []phoneChange{}
+	for _, row := range rows {
+		region := row.country
+		if _, ok := PhoneRegions[region]; !ok {
+			region = phoneDefaultRegion
+		}
+		c := phoneChange{userId: row.userId, original: row.number,
+			result: PhoneChangeNormalized}
+		value, err := normalizePhone(row.number, region)
+		if err != nil {
+			// Numbers that cannot be read are kept as they are
+			value, c.result = row.number, PhoneChangeInvalid
+		} else {
+			c.normalized = value
+		}
+
+		if owner, ok := owners[value]; ok {
+			c.result, c.keptUserId = PhoneChangeCollision, owner
+			changes = append(changes, c)
+			continue
+		}
+		owners[value] = row.userId
+		if c.result == PhoneChangeInvalid || value != row.number {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// migratePhoneNumbers normalizes the stored phone numbers to E.164 and
+// makes them unique
+func migratePhoneNumbers(tx *gorm.DB) error {
+	if err := tx.Exec(`CREATE TABLE "phone_number_changes" (
+		"id" serial,
+		"created_at" timestamp with time zone,
+		"user_id" integer NOT NULL,
+		"original" text NOT NULL,
+		"normalized" text,
+		"result" text NOT NULL,
+		"kept_user_id" integer,
+		PRIMARY KEY ("id"))`).Error; err != nil {
+		return err
+	}
+	rows, err := loadPhoneRows(tx)
+	if err != nil {
+		return err
+	}
+
+	changes := planPhoneNormalization(rows)
+	counts := map[string]int{}
+	for _, c := range changes {
+		counts[c.result]++
+		switch c.result {
+		case PhoneChangeNormalized:
+			err = tx.Exec(`UPDATE "users" SET "phone_number" = ? `+
+				`WHERE "id" = ?`, c.normalized, c.userId).Error
+		case PhoneChangeCollision:
+			err = tx.Exec(`UPDATE "users" SET "phone_number" = '' `+
+				`WHERE "id" = ?`, c.userId).Error
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec(`INSERT INTO "phone_number_changes" `+
+			`("created_at", "user_id", "original", "normalized", "result", `+
+			`"kept_user_id") VALUES (now(), ?, ?, ?, ?, ?)`, c.userId,
+			c.original, c.normalized, c.result,
+			c.keptUserId).Error; err != nil {
+			return err
+		}
+	}
+	if counts[PhoneChangeCollision] > 0 || counts[PhoneChangeInvalid] > 0 {
+		serverLog.Warn("phone numbers need review, see phone-report",
+			LogFields{"collisions": counts[PhoneChangeCollision],
+				"invalid": counts[PhoneChangeInvalid]})
+	}
+	serverLog.Info("phone numbers normalized", LogFields{
+		"normalized": counts[PhoneChangeNormalized]})
+
+	return tx.Exec(`CREATE UNIQUE INDEX uix_users_phone_number ON ` +
+		`"users"(phone_number) WHERE deleted_at IS NULL AND ` +
+		`phone_number <> ''`).Error
+}
+
+// loadPhoneChanges returns the changes recorded by the phone_e164
+// migration
+func loadPhoneChanges(db *gorm.DB) ([]phoneChange, error) {
+	rows, err := db.Raw(`SELECT "user_id", "original", ` +
+		`COALESCE("normalized", ''), "result", COALESCE("kept_user_id", 0) ` +
+		`FROM "phone_number_changes" ORDER BY "id"`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []phoneChange{}
+	for rows.Next() {
+		var c phoneChange
+		if err := rows.Scan(&c.userId, &c.original, &c.normalized, &c.result,
+			&c.keptUserId); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// printPhoneChanges writes the collisions and invalid numbers of changes
+func printPhoneChanges(w io.Writer, changes []phoneChange) {
+	counts := map[string]int{}
+	for _, c := range changes {
+		counts[c.result]++
+		switch c.result {
+		case PhoneChangeCollision:
+			fmt.Fprintf(w, "collision\tuser %v\t%q\t%v is kept by user %v\n",
+				c.userId, c.original, c.normalized, c.keptUserId)
+		case PhoneChangeInvalid:
+			fmt.Fprintf(w, "invalid\tuser %v\t%q\n", c.userId, c.original)
+		}
+	}
+	fmt.Fprintf(w, "%v normalized, %v collisions, %v invalid\n",
+		counts[PhoneChangeNormalized], counts[PhoneChangeCollision],
+		counts[PhoneChangeInvalid])
+}
+
+// runPhoneReport is the phone-report command
+func runPhoneReport(args []string) error {
+	fs := flag.NewFlagSet("phone-report", flag.ContinueOnError)
+	preview := fs.Bool("preview", false,
+		"show what normalizing the current numbers would change")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+
+	var changes []phoneChange
+	if *preview {
+		rows, err := loadPhoneRows(dbConn)
+		if err != nil {
+			return err
+		}
+		changes = planPhoneNormalization(rows)
+	} else {
+		if err := checkSchema(dbConn); err != nil {
+			return err
+		}
+		var err error
+		if changes, err = loadPhoneChanges(dbConn); err != nil {
+			return err
+		}
+	}
+	printPhoneChanges(os.Stdout, changes)
+	return nil
+}
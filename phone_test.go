@@ -0,0 +1,92 @@
+// Testing for phone numbers
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	for _, c := range []struct {
+		number, region, e164 string
+	}{
+		{"13812345678", "CN", "+8613812345678"},
+		{"138 1234 5678", "CN", "+8613812345678"},
+		{"+86 138-1234-5678", "US", "+8613812345678"},
+		{"008613812345678", "CN", "+8613812345678"},
+		{"8613812345678", "CN", "+8613812345678"},
+		{"010 1234 5678", "CN", "+861012345678"},
+		{"(415) 555-2671", "US", "+14155552671"},
+		{"1 415 555 2671", "US", "+14155552671"},
+		{"011 86 13812345678", "US", "+8613812345678"},
+		{"+852 9123 4567", "CN", "+85291234567"},
+		{"+44 20 7946 0958", "CN", "+442079460958"},
+	} {
+		if e, err := normalizePhone(c.number, c.region); err != nil ||
+			e != c.e164 {
+			t.Fatalf("[Phone] %q in %v gives %q %v\n", c.number, c.region, e,
+				err)
+		}
+	}
+	for _, c := range [][]string{
+		{"", "CN"}, {"phone", "CN"}, {"138123", "CN"}, {"+86 123", "CN"},
+		{"415 555 2671 0", "US"}, {"+1 015 555 2671", "CN"},
+		{"13812345678", "FR"}, {"+0123456789", "CN"},
+		{"+1234567890123456", "CN"},
+	} {
+		if e, err := normalizePhone(c[0], c[1]); err == nil {
+			t.Fatalf("[Phone] Bad number %q in %v accepted as %q\n", c[0],
+				c[1], e)
+		}
+	}
+}
+
+func TestPhoneRegion(t *testing.T) {
+	r := httptest.NewRequest("POST", "/account/login?phone_region=us", nil)
+	if region := requestPhoneRegion(r); region != "US" {
+		t.Fatalf("[Phone] Bad region of phone_region %v\n", region)
+	}
+	r = httptest.NewRequest("POST", "/account/login?phone_region=xx", nil)
+	if region := requestPhoneRegion(r); region != LangPhoneRegions[defaultLang] {
+		t.Fatalf("[Phone] Bad default region %v\n", region)
+	}
+	for lang, region := range LangPhoneRegions {
+		if _, ok := PhoneRegions[region]; !ok {
+			t.Fatalf("[Phone] Region %v of %v is unknown\n", region, lang)
+		}
+	}
+}
+
+func TestPlanPhoneNormalization(t *testing.T) {
+	changes := planPhoneNormalization([]phoneRow{
+		{1, "13812345678", "CN"},
+		{2, "+8613812345678", "CN"},
+		{3, "+14155552671", "US"},
+		{4, "4155552671", "US"},
+		{5, "not a phone", ""},
+		{6, "(212) 555-0100", "US"},
+		{7, "13900000000", ""},
+	})
+	want := []phoneChange{
+		{1, "13812345678", "+8613812345678", PhoneChangeNormalized, 0},
+		{2, "+8613812345678", "+8613812345678", PhoneChangeCollision, 1},
+		{4, "4155552671", "+14155552671", PhoneChangeCollision, 3},
+		{5, "not a phone", "", PhoneChangeInvalid, 0},
+		{6, "(212) 555-0100", "+12125550100", PhoneChangeNormalized, 0},
+		{7, "13900000000", "+8613900000000", PhoneChangeNormalized, 0},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("[Phone] Bad changes %v\n", changes)
+	}
+
+	var b bytes.Buffer
+	printPhoneChanges(&b, changes)
+	out := b.String()
+	if !strings.Contains(out, "3 normalized, 2 collisions, 1 invalid") ||
+		!strings.Contains(out, "is kept by user 3") {
+		t.Fatalf("[Phone] Bad report %v\n", out)
+	}
+}
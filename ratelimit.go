@@ -0,0 +1,267 @@
+// Rate limiting for MarketX
+// Routes open to anonymous callers (login, sms codes, registration) are
+// limited per client ip and per account or phone number in fixed windows.
+// Counters live in memory, or in the database when several instances serve
+// the same users.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	RateStoreMemory   = "memory"
+	RateStoreDatabase = "database"
+	rateSweepEvery    = 1000
+)
+
+var RateErrorStore = errors.New("Unknown rate limit store")
+
+// RateStore counts hits of a key in fixed windows
+type RateStore interface {
+	// Hit records a hit of key and returns the hits in the current window
+	// including this one and when the window ends
+	Hit(key string, window time.Duration) (int64, time.Time, error)
+}
+
+// rateLimit allows limit hits per window in the bucket of a request, key
+// returns the bucket value of a request or "" to skip the limit
+type rateLimit struct {
+	bucket string
+	limit  int64
+	window time.Duration
+	key    func(r *http.Request) string
+}
+
+// rateByIp limits the requests of a client ip
+func rateByIp(limit int64, window time.Duration) rateLimit {
+	return rateLimit{"ip", limit, window, getIp}
+}
+
+// rateByForm limits the requests for a form field value, e.g. an email
+func rateByForm(field string, limit int64, window time.Duration) rateLimit {
+	return rateLimit{field, limit, window, func(r *http.Request) string {
+		return strings.ToLower(strings.TrimSpace(r.FormValue(field)))
+	}}
+}
+
+// rateByPhone limits the requests for a phone number however it is typed
+func rateByPhone(field string, limit int64, window time.Duration) rateLimit {
+	return rateLimit{field, limit, window, func(r *http.Request) string {
+		if e, err := normalizePhone(r.FormValue(field),
+			requestPhoneRegion(r)); err == nil {
+			return e
+		}
+		return strings.TrimSpace(r.FormValue(field))
+	}}
+}
+
+// rateByAccount limits the requests for a login name, which is an email or
+// a phone number however it is typed
+func rateByAccount(field string, limit int64, window time.Duration) rateLimit {
+	return rateLimit{field, limit, window, func(r *http.Request) string {
+		if e, err := normalizePhone(r.FormValue(field),
+			requestPhoneRegion(r)); err == nil {
+			return e
+		}
+		return strings.ToLower(strings.TrimSpace(r.FormValue(field)))
+	}}
+}
+
+// rateLimitRoutes are the limits of each route keyed by httprouter pattern
+var rateLimitRoutes = map[string][]rateLimit{
+	"/account/login": {
+		rateByIp(30, 10*time.Minute),
+		rateByAccount("email", 10, 10*time.Minute),
+		rateByPhone("phone_number", 10, 10*time.Minute)},
+	"/account/login_link": {
+		rateByIp(10, time.Hour),
+		rateByForm("email", 5, time.Hour)},
+	"/account/send_mobile_code": {
+		rateByIp(10, time.Hour),
+		rateByPhone("phone_number", 1, time.Minute),
+		rateByPhone("phone_number", 5, time.Hour)},
+	"/account/verify_mobile_code": {
+		rateByIp(30, 10*time.Minute),
+		rateByPhone("phone_number", 5, 15*time.Minute)},
+	"/user/phone/send_code": {
+		rateByIp(10, time.Hour),
+		rateByPhone("phone_number", 5, time.Hour)},
+	"/user/phone": {
+		rateByIp(30, 10*time.Minute)},
+	"/account/forget": {
+		rateByIp(10, time.Hour),
+		rateByForm("email", 3, time.Hour)},
+	"/account/unlock": {
+		rateByIp(10, time.Hour)},
+	"/account/register": {
+		rateByIp(10, time.Hour)},
+	"/account/refresh": {
+		rateByIp(60, 10*time.Minute)},
+	"/account/2fa/enable": {
+		rateByIp(10, 10*time.Minute)},
+	"/account/2fa/disable": {
+		rateByIp(10, 10*time.Minute)},
+	"/account/2fa/recovery_codes": {
+		rateByIp(10, 10*time.Minute)},
+	"/account/wxlogin": {
+		rateByIp(30, 10*time.Minute)},
+	"/account/wxbind": {
+		rateByIp(30, 10*time.Minute),
+		rateByAccount("email", 10, 10*time.Minute)},
+}
+
+var (
+	rateStore   RateStore = newMemoryRateStore()
+	rateLimited           = newCounterVec("mx_rate_limited_total",
+		"Requests refused by rate limits by route and bucket.",
+		"route", "bucket")
+)
+
+// newRateStore creates the configured rate limit store
+func newRateStore(kind string, db *gorm.DB) (RateStore, error) {
+	switch kind {
+	case RateStoreMemory:
+		return newMemoryRateStore(), nil
+	case RateStoreDatabase:
+		return &dbRateStore{db: db}, nil
+	}
+	return nil, RateErrorStore
+}
+
+// checkRateLimits records a hit in every bucket of limits and returns how
+// long to wait if any of them is over its limit
+func checkRateLimits(store RateStore, route string, limits []rateLimit,
+	r *http.Request) (time.Duration, string, error) {
+	var wait time.Duration
+	var bucket string
+	now := time.Now()
+	for _, rl := range limits {
+		k := rl.key(r)
+		if k == "" {
+			continue
+		}
+		n, reset, err := store.Hit(fmt.Sprintf("%v|%v|%v|%v", route,
+			rl.bucket, rl.window, k), rl.window)
+		if err != nil {
+			return 0, "", err
+		}
+		if n > rl.limit && reset.Sub(now) > wait {
+			wait, bucket = reset.Sub(now), rl.bucket
+		}
+	}
+	return wait, bucket, nil
+}
+
+// rateProtect refuses requests over the limits of their route with a
+// localized error and Retry-After
+func rateProtect(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request,
+		ps httprouter.Params) {
+		route := routePattern(r.URL.Path, ps)
+		limits := rateLimitRoutes[route]
+		if !rateLimitEnabled || len(limits) == 0 {
+			h(w, r, ps)
+			return
+		}
+		wait, bucket, err := checkRateLimits(rateStore, route, limits, r)
+		if err != nil {
+			// Do not lock everyone out when the store is down
+			serverLog.Error("rate limit store failed", LogFields{
+				"request_id": requestId(r), "route": route, "error": err})
+		}
+		if wait > 0 {
+			secs := int64(math.Ceil(wait.Seconds()))
+			rateLimited.inc(route, bucket)
+			w.Header().Set("Retry-After", fmt.Sprintf("%v", secs))
+			w.WriteHeader(http.StatusTooManyRequests)
+			formatReturnInfo(w, r, ps, ErrorFmtCodeTooManyRequests,
+				fmt.Sprintf("%v", secs), false, nil)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+/* Stores */
+
+// rateEntry is the window state of a key in memory
+type rateEntry struct {
+	count int64
+	reset time.Time
+}
+
+// memoryRateStore keeps counters in process memory
+type memoryRateStore struct {
+	lock    sync.Mutex
+	entries map[string]*rateEntry
+	hits    uint64
+}
+
+func newMemoryRateStore() *memoryRateStore {
+	return &memoryRateStore{entries: map[string]*rateEntry{}}
+}
+
+func (s *memoryRateStore) Hit(key string,
+	window time.Duration) (int64, time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+
+	// Drop expired windows from time to time to bound memory
+	s.hits++
+	if s.hits%rateSweepEvery == 0 {
+		for k, e := range s.entries {
+			if !e.reset.After(now) {
+				delete(s.entries, k)
+			}
+		}
+	}
+
+	e, ok := s.entries[key]
+	if !ok || !e.reset.After(now) {
+		e = &rateEntry{reset: now.Add(window)}
+		s.entries[key] = e
+	}
+	e.count++
+	return e.count, e.reset, nil
+}
+
+// dbRateStore keeps counters in the rate_limits table, shared by all
+// server instances
+type dbRateStore struct {
+	db   *gorm.DB
+	hits uint64
+}
+
+func (s *dbRateStore) Hit(key string,
+	window time.Duration) (int64, time.Time, error) {
+	now := time.Now()
+	if atomic.AddUint64(&s.hits, 1)%rateSweepEvery == 0 {
+		s.db.Exec(`DELETE FROM "rate_limits" WHERE "reset_at" <= ?`, now)
+	}
+
+	// Start a new window if the stored one has ended, atomically
+	var count int64
+	var reset time.Time
+	err := s.db.Raw(`INSERT INTO "rate_limits" ("key", "count", "reset_at")
+		VALUES (?, 1, ?)
+		ON CONFLICT ("key") DO UPDATE SET
+		"count" = CASE WHEN "rate_limits"."reset_at" <= ? THEN 1
+			ELSE "rate_limits"."count" + 1 END,
+		"reset_at" = CASE WHEN "rate_limits"."reset_at" <= ?
+			THEN EXCLUDED."reset_at" ELSE "rate_limits"."reset_at" END
+		RETURNING "count", "reset_at"`, key, now.Add(window), now,
+		now).Row().Scan(&count, &reset)
+	return count, reset, err
+}
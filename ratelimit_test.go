@@ -0,0 +1,98 @@
+// Testing for rate limiting
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestMemoryRateStore(t *testing.T) {
+	s := newMemoryRateStore()
+	for i := int64(1); i <= 3; i++ {
+		n, reset, err := s.Hit("a", 50*time.Millisecond)
+		if err != nil || n != i || reset.Before(time.Now()) {
+			t.Fatalf("[RateLimit] Hit %v counted as %v\n", i, n)
+		}
+	}
+	if n, _, _ := s.Hit("b", time.Minute); n != 1 {
+		t.Fatalf("[RateLimit] Keys share counters: %v\n", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if n, _, _ := s.Hit("a", 50*time.Millisecond); n != 1 {
+		t.Fatalf("[RateLimit] Window not reset: %v\n", n)
+	}
+}
+
+func TestRateProtect(t *testing.T) {
+	defer func(s RateStore) { rateStore = s }(rateStore)
+	rateStore = newMemoryRateStore()
+
+	calls := 0
+	h := rateProtect(func(w http.ResponseWriter, r *http.Request,
+		ps httprouter.Params) {
+		calls++
+	})
+	send := func(phone string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/account/send_mobile_code",
+			strings.NewReader(url.Values{"phone_number": {phone}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Language", "en-US")
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		return w
+	}
+
+	// One code per phone number and minute
+	send("13800000000")
+	w := send("13800000000")
+	if calls != 1 || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("[RateLimit] Second code not refused: %v\n", w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra == "" || ra == "0" {
+		t.Fatalf("[RateLimit] Bad Retry-After: %q\n", ra)
+	}
+	var ret map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &ret)
+	if ret["result"] != float64(ResultFail) ||
+		!strings.HasPrefix(ret["error"].(string), "Too many requests") {
+		t.Fatalf("[RateLimit] Bad error response: %v\n", w.Body.String())
+	}
+
+	// Other numbers are limited by ip only, refused requests count too
+	for i := 0; i < 8; i++ {
+		send("1380000010" + string('0'+rune(i)))
+	}
+	if calls != 9 {
+		t.Fatalf("[RateLimit] Other numbers refused: %v calls\n", calls)
+	}
+	if send("13900000000").Code != http.StatusTooManyRequests {
+		t.Fatal("[RateLimit] Ip limit not applied\n")
+	}
+}
+
+func TestRateByAccount(t *testing.T) {
+	rl := rateByAccount("email", 10, time.Minute)
+	key := func(v string) string {
+		r := httptest.NewRequest("POST", "/account/login?phone_region=CN",
+			strings.NewReader(url.Values{"email": {v}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return rl.key(r)
+	}
+	// Every spelling of a number shares its counter
+	for _, v := range []string{"13800000000", "138 0000 0000",
+		"+86 138-0000-0000"} {
+		if k := key(v); k != "+8613800000000" {
+			t.Fatalf("[RateLimit] Bad key of %q: %v\n", v, k)
+		}
+	}
+	if k := key(" Someone@Example.com "); k != "someone@example.com" {
+		t.Fatalf("[RateLimit] Bad key of email: %v\n", k)
+	}
+}
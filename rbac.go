@@ -0,0 +1,180 @@
+// Admin roles for MarketX
+// Admins act through named roles granting permissions, every /admin route
+// declares the permission it needs in newServerRouter. Fields such as SSNs
+// and bank numbers are removed from admin responses unless the caller also
+// holds the permission guarding them.
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Permission is an action on the admin api
+type Permission string
+
+const (
+	PermUsersRead       Permission = "users:read"
+	PermUsersWrite      Permission = "users:write"
+	PermUsersDelete     Permission = "users:delete"
+	PermPhotoIdsRead    Permission = "photo_ids:read"
+	PermPhotoIdsWrite   Permission = "photo_ids:write"
+	PermSensitiveRead   Permission = "sensitive:read"
+	PermCompaniesRead   Permission = "companies:read"
+	PermCompaniesWrite  Permission = "companies:write"
+	PermCompaniesDelete Permission = "companies:delete"
+	PermDealsRead       Permission = "deals:read"
+	PermDealsWrite      Permission = "deals:write"
+	PermDealsDelete     Permission = "deals:delete"
+	PermRolesManage     Permission = "roles:manage"
+	PermApiKeysManage   Permission = "api_keys:manage"
+	PermLoginManage     Permission = "login:manage"
+)
+
+const (
+	RoleSuperAdmin         = "super_admin"
+	RoleComplianceReviewer = "compliance_reviewer"
+	RoleDealManager        = "deal_manager"
+	RoleContentEditor      = "content_editor"
+	RoleAuditor            = "auditor"
+)
+
+// Roles are the permissions granted by each role
+var Roles = map[string][]Permission{
+	RoleSuperAdmin: []Permission{PermUsersRead, PermUsersWrite,
+		PermUsersDelete, PermPhotoIdsRead, PermPhotoIdsWrite,
+		PermSensitiveRead, PermCompaniesRead, PermCompaniesWrite,
+		PermCompaniesDelete, PermDealsRead, PermDealsWrite, PermDealsDelete,
+		PermRolesManage, PermApiKeysManage, PermLoginManage},
+	RoleComplianceReviewer: []Permission{PermUsersRead, PermUsersWrite,
+		PermPhotoIdsRead, PermPhotoIdsWrite, PermSensitiveRead,
+		PermCompaniesRead, PermDealsRead},
+	RoleDealManager: []Permission{PermUsersRead, PermCompaniesRead,
+		PermDealsRead, PermDealsWrite, PermDealsDelete},
+	RoleContentEditor: []Permission{PermCompaniesRead, PermCompaniesWrite,
+		PermDealsRead},
+	RoleAuditor: []Permission{PermUsersRead, PermCompaniesRead,
+		PermDealsRead},
+}
+
+// sensitiveFields are admin response fields and the permission needed to
+// see them, photo_id is the download token of the photo id
+var sensitiveFields = map[string]Permission{
+	"ssn":            PermSensitiveRead,
+	"id_card_number": PermSensitiveRead,
+	"dob":            PermSensitiveRead,
+	"routing_number": PermSensitiveRead,
+	"account_number": PermSensitiveRead,
+	"photo_id":       PermPhotoIdsRead,
+	"email_token":    PermUsersWrite,
+}
+
+// rolePermissions returns the permissions granted by roles
+func rolePermissions(roles []string) map[Permission]bool {
+	perms := map[Permission]bool{}
+	for _, role := range roles {
+		for _, p := range Roles[role] {
+			perms[p] = true
+		}
+	}
+	return perms
+}
+
+// parseRoles reads a comma separated list of role names
+func parseRoles(s string) ([]string, bool) {
+	roles := []string{}
+	seen := map[string]bool{}
+	for _, role := range strings.Split(s, ",") {
+		role = strings.TrimSpace(role)
+		if role == "" || seen[role] {
+			continue
+		}
+		if _, ok := Roles[role]; !ok {
+			return nil, false
+		}
+		seen[role] = true
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles, true
+}
+
+// userRoles returns the role names of a user
+func userRoles(userId uint) ([]string, error) {
+	roles := []string{}
+	err := dbConn.Model(&UserRole{}).Where("user_id = ?", userId).
+		Order("role").Pluck("role", &roles).Error
+	return roles, err
+}
+
+// setUserRoles replaces the roles of a user, who is an admin as long as it
+// has any
+func setUserRoles(userId uint, roles []string, grantedBy uint) error {
+	tx := dbConn.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Exec(`DELETE FROM "user_roles" WHERE "user_id" = ?`,
+		userId).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, role := range roles {
+		if err := tx.Create(&UserRole{UserID: userId, Role: role,
+			GrantedBy: grantedBy}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	level := UserLevelNormal
+	if len(roles) > 0 {
+		level = UserLevelAdmin
+	}
+	if err := tx.Model(&User{}).Where("id = ?", userId).
+		UpdateColumn("user_level", level).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// otherSuperAdmins counts the super admins other than a user, so the last
+// one cannot be removed
+func otherSuperAdmins(userId uint) (int, error) {
+	var n int
+	err := dbConn.Model(&UserRole{}).
+		Joins(`JOIN "users" ON "users".id = "user_roles".user_id AND `+
+			`"users".deleted_at IS NULL`).
+		Where("role = ? AND user_id <> ?", RoleSuperAdmin, userId).
+		Count(&n).Error
+	return n, err
+}
+
+// hasPermission checks whether the admin of r holds p
+func hasPermission(r *http.Request, p Permission) bool {
+	return getRequestContext(r).perms[p]
+}
+
+// filterSensitive removes the sensitive fields perms does not allow from
+// v and everything nested in it
+func filterSensitive(v interface{}, perms map[Permission]bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if p, ok := sensitiveFields[k]; ok && !perms[p] {
+				delete(t, k)
+				continue
+			}
+			filterSensitive(e, perms)
+		}
+	case []map[string]interface{}:
+		for _, e := range t {
+			filterSensitive(e, perms)
+		}
+	case []interface{}:
+		for _, e := range t {
+			filterSensitive(e, perms)
+		}
+	}
+}
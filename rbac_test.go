@@ -0,0 +1,75 @@
+// Testing for admin roles
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRolePermissions(t *testing.T) {
+	// Every permission belongs to the super admin
+	super := rolePermissions([]string{RoleSuperAdmin})
+	for role, perms := range Roles {
+		for _, p := range perms {
+			if !super[p] {
+				t.Fatalf("[Roles] %v of %v is not in super admin\n", p, role)
+			}
+		}
+	}
+
+	perms := rolePermissions([]string{RoleComplianceReviewer})
+	if !perms[PermPhotoIdsWrite] || perms[PermCompaniesDelete] ||
+		perms[PermDealsWrite] || perms[PermRolesManage] {
+		t.Fatalf("[Roles] Bad compliance reviewer permissions %v\n", perms)
+	}
+	perms = rolePermissions([]string{RoleAuditor, RoleContentEditor})
+	if !perms[PermCompaniesWrite] || perms[PermSensitiveRead] ||
+		perms[PermUsersWrite] {
+		t.Fatalf("[Roles] Bad combined permissions %v\n", perms)
+	}
+	if len(rolePermissions([]string{"unknown"})) != 0 {
+		t.Fatal("[Roles] Unknown role grants permissions\n")
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+	roles, ok := parseRoles(" deal_manager,auditor,,deal_manager")
+	if !ok || !reflect.DeepEqual(roles, []string{RoleAuditor,
+		RoleDealManager}) {
+		t.Fatalf("[Roles] Bad parsed roles %v\n", roles)
+	}
+	if roles, ok := parseRoles(""); !ok || len(roles) != 0 {
+		t.Fatalf("[Roles] Empty roles refused %v\n", roles)
+	}
+	if _, ok := parseRoles("auditor,root"); ok {
+		t.Fatal("[Roles] Unknown role accepted\n")
+	}
+}
+
+func TestFilterSensitive(t *testing.T) {
+	ie := map[string]interface{}{
+		"ssn":   "123-45-6789",
+		"email": "a@example.com",
+		"users": []map[string]interface{}{
+			{"id": 1, "photo_id": "token", "email_token": "token"}},
+		"sell": map[string]interface{}{"account_number": "1234",
+			"routing_number": "5678", "price": 10},
+	}
+	filterSensitive(ie, rolePermissions([]string{RoleAuditor}))
+	if _, ok := ie["ssn"]; ok || ie["email"] == nil {
+		t.Fatalf("[Roles] Bad filtered fields %v\n", ie)
+	}
+	if u := ie["users"].([]map[string]interface{})[0]; len(u) != 1 {
+		t.Fatalf("[Roles] Nested list not filtered %v\n", u)
+	}
+	if s := ie["sell"].(map[string]interface{}); len(s) != 1 {
+		t.Fatalf("[Roles] Nested map not filtered %v\n", s)
+	}
+
+	ie = map[string]interface{}{"ssn": "123-45-6789", "photo_id": "token"}
+	filterSensitive(ie, rolePermissions([]string{RoleComplianceReviewer}))
+	if len(ie) != 2 {
+		t.Fatalf("[Roles] Allowed fields filtered %v\n", ie)
+	}
+	filterSensitive(nil, nil)
+}
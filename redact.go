@@ -0,0 +1,279 @@
+// Log redaction for MarketX
+// Request forms, multipart uploads, json responses and outbound integration
+// calls all pass through here before being written to the server log, so
+// passwords, SSNs, bank numbers and other PII never reach the log files.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const redactMask = "[REDACTED]"
+
+// redactFields are always masked regardless of route or policy mode
+var redactFields = map[string]bool{
+	"password":          true,
+	"old_password":      true,
+	"new_password":      true,
+	"ssn":               true,
+	"routing_number":    true,
+	"account_number":    true,
+	"id_card_number":    true,
+	"code":              true,
+	"token":             true,
+	"confirm":           true,
+	"email_token":       true,
+	"photo_id":          true,
+	"access_token":      true,
+	"refresh_token":     true,
+	"docusign_sign_url": true,
+	"otp":               true,
+	"secret":            true,
+	"uri":               true,
+	"recovery_codes":    true,
+	"key":               true,
+}
+
+// redactPolicy decides which fields are masked before being logged
+// In deny mode only the listed (and global) fields are masked, in allow
+// mode every field is masked unless it is explicitly listed.
+type redactPolicy struct {
+	allowMode bool
+	fields    map[string]bool
+}
+
+// redactDeny creates a deny-list policy masking the given fields
+func redactDeny(fields ...string) *redactPolicy {
+	p := &redactPolicy{fields: map[string]bool{}}
+	for _, f := range fields {
+		p.fields[f] = true
+	}
+	return p
+}
+
+// redactAllow creates an allow-list policy only keeping the given fields
+func redactAllow(fields ...string) *redactPolicy {
+	p := redactDeny(fields...)
+	p.allowMode = true
+	return p
+}
+
+// masked returns true if field f should not be logged in plain text
+func (p *redactPolicy) masked(f string) bool {
+	if redactFields[f] {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	if p.allowMode {
+		return !p.fields[f]
+	}
+	return p.fields[f]
+}
+
+// redactRoute binds request and response policies to a route pattern
+type redactRoute struct {
+	request  *redactPolicy
+	response *redactPolicy
+}
+
+// redactRoutes are the per-route policies keyed by httprouter pattern,
+// routes not listed here only have the global fields masked
+var redactRoutes = map[string]redactRoute{
+	"/deal/:id/sell/bank_info": {
+		request: redactAllow("nick_name", "account_type")},
+	"/deal/:id/buy/bank_info": {
+		request: redactAllow("nick_name", "account_type")},
+	"/user/kyc": {
+		request: redactDeny("dob", "address1", "address2", "zip",
+			"phone_number")},
+	"/user/kyc_check": {
+		request: redactDeny("ans1", "ans2", "ans3", "ans4", "ans5")},
+	"/user": {
+		request: redactDeny("dob", "address1", "address2", "zip",
+			"phone_number"),
+		response: redactDeny("dob", "address1", "address2", "zip",
+			"phone_number")},
+	"/admin/user/:id": {
+		request: redactDeny("dob", "address1", "address2", "zip",
+			"phone_number"),
+		response: redactDeny("dob", "address1", "address2", "zip",
+			"phone_number")},
+	"/user/wechat": {
+		response: redactDeny("nickname", "avatar")},
+}
+
+// Outbound integration policies
+var (
+	transactRedact = redactDeny("clientID", "developerAPIKey",
+		"socialSecurityNumber", "dob", "emailAddress", "firstName",
+		"lastName", "investorAccountName", "accountFullName",
+		"addressline1", "addressline2", "city", "zip", "createdIpAddress",
+		"qns1", "qns2", "qns3", "qns4", "qns5",
+		"ans1", "ans2", "ans3", "ans4", "ans5")
+	docusignRedact = redactDeny("email", "userName", "name",
+		"clientUserId", "value", "url")
+	hellosignRedact = redactDeny("email_address", "name")
+)
+
+// routePattern rebuilds the httprouter pattern of a request path from its
+// matched params, e.g. /deal/12/sell -> /deal/:id/sell
+func routePattern(p string, ps httprouter.Params) string {
+	segs := strings.Split(p, "/")
+	i := 0
+	for j, s := range segs {
+		if i >= len(ps) {
+			break
+		}
+		if s == ps[i].Value {
+			segs[j] = ":" + ps[i].Key
+			i++
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// redactPath masks path params that are sensitive, e.g. download tokens
+func redactPath(p string, ps httprouter.Params, policy *redactPolicy) string {
+	segs := strings.Split(routePattern(p, ps), "/")
+	orig := strings.Split(p, "/")
+	for j, s := range segs {
+		if !strings.HasPrefix(s, ":") {
+			continue
+		}
+		if policy.masked(s[1:]) {
+			segs[j] = redactMask
+		} else {
+			segs[j] = orig[j]
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// redactValues encodes form values like url.Values.Encode with masked
+// fields replaced by redactMask
+func redactValues(vs url.Values, policy *redactPolicy) string {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(vs))
+	for k := range vs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range vs[k] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(url.QueryEscape(k))
+			buf.WriteByte('=')
+			if policy.masked(k) {
+				buf.WriteString(redactMask)
+			} else {
+				buf.WriteString(url.QueryEscape(v))
+			}
+		}
+	}
+	return buf.String()
+}
+
+// redactFiles describes multipart file uploads without their client-side
+// file names, which often contain people's names or id numbers
+func redactFiles(r *http.Request) string {
+	if r.MultipartForm == nil || len(r.MultipartForm.File) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(r.MultipartForm.File))
+	for k := range r.MultipartForm.File {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var fs []string
+	for _, k := range keys {
+		for _, fh := range r.MultipartForm.File[k] {
+			fs = append(fs, fmt.Sprintf("%v=<%v %v>", k, redactMask,
+				fh.Header.Get("Content-Type")))
+		}
+	}
+	return strings.Join(fs, "&")
+}
+
+// redactJsonValue walks a decoded json value and masks fields in place
+func redactJsonValue(v interface{}, policy *redactPolicy) interface{} {
+	switch vt := v.(type) {
+	case map[string]interface{}:
+		for k, e := range vt {
+			if policy.masked(k) {
+				vt[k] = redactMask
+			} else {
+				vt[k] = redactJsonValue(e, policy)
+			}
+		}
+	case []interface{}:
+		for i, e := range vt {
+			vt[i] = redactJsonValue(e, policy)
+		}
+	}
+	return v
+}
+
+// redactJson returns a json representation of v with fields masked
+// On encoding errors a placeholder is returned so logging never fails
+func redactJson(v interface{}, policy *redactPolicy) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "?"
+	}
+	return redactJsonBytes(b, policy)
+}
+
+// redactJsonBytes is the encoded version of redactJson
+func redactJsonBytes(b []byte, policy *redactPolicy) string {
+	d := json.NewDecoder(bytes.NewReader(b))
+	// Keep numbers intact for ids
+	d.UseNumber()
+	var data interface{}
+	if err := d.Decode(&data); err != nil {
+		return "?"
+	}
+	ret, err := json.Marshal(redactJsonValue(data, policy))
+	if err != nil {
+		return "?"
+	}
+	return string(ret)
+}
+
+// redactBody formats a raw response body for logging, bodies that are not
+// json cannot be inspected field by field and only have their size logged
+func redactBody(b []byte, policy *redactPolicy) string {
+	s := redactJsonBytes(b, policy)
+	if s == "?" {
+		return fmt.Sprintf("<%v bytes>", len(b))
+	}
+	return s
+}
+
+// redactRequest formats the loggable part of a request
+func redactRequest(r *http.Request, ps httprouter.Params) string {
+	rr := redactRoutes[routePattern(r.URL.Path, ps)]
+	s := redactPath(r.URL.Path, ps, rr.request) + "?" +
+		redactValues(r.Form, rr.request)
+	if fs := redactFiles(r); fs != "" {
+		s += "&" + fs
+	}
+	return s
+}
+
+// redactResponse formats the loggable part of a json response
+func redactResponse(r *http.Request, ps httprouter.Params, b []byte) string {
+	rr := redactRoutes[routePattern(r.URL.Path, ps)]
+	return redactJsonBytes(b, rr.response)
+}
@@ -0,0 +1,96 @@
+// Testing for log redaction
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRoutePattern(t *testing.T) {
+	ps := httprouter.Params{
+		httprouter.Param{Key: "id", Value: "12"},
+		httprouter.Param{Key: "token", Value: "abcd"},
+	}
+	p := routePattern("/deal/12/sell/share_certificate/abcd", ps)
+	if p != "/deal/:id/sell/share_certificate/:token" {
+		t.Fatalf("[Redact] routePattern gives wrong pattern: %v\n", p)
+	}
+	p = redactPath("/deal/12/sell/share_certificate/abcd", ps, nil)
+	if p != "/deal/12/sell/share_certificate/"+redactMask {
+		t.Fatalf("[Redact] redactPath does not mask token: %v\n", p)
+	}
+}
+
+func TestRedactValues(t *testing.T) {
+	vs := url.Values{
+		"email":    []string{"a@b.com"},
+		"password": []string{"secret"},
+		"ssn":      []string{"112-22-3333"},
+	}
+	s := redactValues(vs, nil)
+	if strings.Contains(s, "secret") || strings.Contains(s, "112-22") {
+		t.Fatalf("[Redact] redactValues leaks global fields: %v\n", s)
+	}
+	if !strings.Contains(s, "email=a%40b.com") {
+		t.Fatalf("[Redact] redactValues masks too much: %v\n", s)
+	}
+	s = redactValues(vs, redactDeny("email"))
+	if strings.Contains(s, "a%40b.com") {
+		t.Fatalf("[Redact] redactValues ignores deny list: %v\n", s)
+	}
+	vs = url.Values{
+		"nick_name": []string{"Checking"},
+		"full_name": []string{"John Smith"},
+	}
+	s = redactValues(vs, redactAllow("nick_name"))
+	if strings.Contains(s, "John") || !strings.Contains(s, "Checking") {
+		t.Fatalf("[Redact] redactValues ignores allow list: %v\n", s)
+	}
+}
+
+func TestRedactJson(t *testing.T) {
+	s := redactJson(map[string]interface{}{
+		"id":    uint64(1<<62 + 1),
+		"token": "jwt",
+		"users": []map[string]interface{}{
+			{"ssn": "112-22-3333", "first_name": "John"},
+		},
+	}, redactDeny("first_name"))
+	if strings.Contains(s, "jwt") || strings.Contains(s, "112-22") ||
+		strings.Contains(s, "John") {
+		t.Fatalf("[Redact] redactJson leaks fields: %v\n", s)
+	}
+	if !strings.Contains(s, "4611686018427387905") {
+		t.Fatalf("[Redact] redactJson loses number precision: %v\n", s)
+	}
+	s = redactJson(map[string]string{
+		"firstName": "John", "accountFullName": "John Smith",
+		"city": "Springfield", "zip": "12345", "qns2": "Maple Street",
+	}, transactRedact)
+	for _, v := range []string{"John", "Springfield", "12345", "Maple"} {
+		if strings.Contains(s, v) {
+			t.Fatalf("[Redact] Transact calls leak %v: %v\n", v, s)
+		}
+	}
+	if redactBody([]byte("<html>"), nil) != "<6 bytes>" {
+		t.Fatal("[Redact] redactBody logs non-json bodies\n")
+	}
+}
+
+func TestRedactFiles(t *testing.T) {
+	body := "--b\r\nContent-Disposition: form-data; name=\"photo_id\"; " +
+		"filename=\"john_smith_passport.png\"\r\nContent-Type: image/png" +
+		"\r\n\r\ndata\r\n--b--\r\n"
+	r, _ := http.NewRequest("POST", "/user/upload_id",
+		strings.NewReader(body))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+	r.ParseMultipartForm(0)
+	s := redactRequest(r, nil)
+	if strings.Contains(s, "john_smith") || !strings.Contains(s, "image/png") {
+		t.Fatalf("[Redact] redactRequest logs file names: %v\n", s)
+	}
+}
@@ -0,0 +1,216 @@
+// Encryption key rotation for MarketX
+// Re-encrypts the encrypted database fields with a new text key and the
+// uploaded files under the data directory with a new file key. Files are
+// written next to the originals first and only swapped in once the
+// database transaction has been committed.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const rotateSuffix = ".rotate"
+
+// rotateFileDirs are the data directory folders holding encrypted files
+var rotateFileDirs = []string{"user", "wechat", "deal"}
+
+// rotateColumns are the database columns holding encrypted text
+var rotateColumns = []struct {
+	table  string
+	column string
+}{
+	{"users", "ssn_encrypted"},
+	{"users", "totp_secret_encrypted"},
+	{"banks", "routing_number_encrypted"},
+	{"banks", "account_number_encrypted"},
+}
+
+// reencryptString decrypts ct with the old key and encrypts it with the new
+func reencryptString(oldKey, newKey []byte, ct string) (string, error) {
+	if ct == "" {
+		return "", nil
+	}
+	pt, err := DecryptString(oldKey, ct)
+	if err != nil {
+		return "", err
+	}
+	return EncryptString(newKey, pt)
+}
+
+// rotateTextKey re-encrypts every encrypted column within tx, including
+// soft-deleted rows, and returns the number of values changed
+func rotateTextKey(tx *gorm.DB, oldKey, newKey []byte) (int, error) {
+	n := 0
+	for _, rc := range rotateColumns {
+		rows, err := tx.Raw(fmt.Sprintf(`SELECT "id", "%v" FROM "%v" `+
+			`WHERE "%v" <> ''`, rc.column, rc.table, rc.column)).Rows()
+		if err != nil {
+			return n, err
+		}
+		values := map[uint]string{}
+		for rows.Next() {
+			var id uint
+			var ct string
+			if err := rows.Scan(&id, &ct); err != nil {
+				rows.Close()
+				return n, err
+			}
+			values[id] = ct
+		}
+		rows.Close()
+
+		for id, ct := range values {
+			nct, err := reencryptString(oldKey, newKey, ct)
+			if err != nil {
+				return n, fmt.Errorf("%v.%v of %v: %v", rc.table, rc.column,
+					id, err)
+			}
+			if err := tx.Exec(fmt.Sprintf(`UPDATE "%v" SET "%v" = ? `+
+				`WHERE "id" = ?`, rc.table, rc.column), nct,
+				id).Error; err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// rotateFile writes the re-encrypted copy of file p next to it
+func rotateFile(p string, oldKey, newKey []byte) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pt, err := DecryptStreamBytes(oldKey, f)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := EncryptStreamBytes(newKey, pt, &buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p+rotateSuffix, buf.Bytes(), 0666)
+}
+
+// rotateFileKey re-encrypts every file under the encrypted folders of dir
+// into a copy, and returns the original paths of the copies written
+func rotateFileKey(dir string, oldKey, newKey []byte) ([]string, error) {
+	var done []string
+	for _, d := range rotateFileDirs {
+		err := filepath.Walk(path.Join(dir, d),
+			func(p string, fi os.FileInfo, err error) error {
+				if os.IsNotExist(err) && p == path.Join(dir, d) {
+					return filepath.SkipDir
+				}
+				if err != nil {
+					return err
+				}
+				if !fi.Mode().IsRegular() ||
+					strings.HasSuffix(p, rotateSuffix) {
+					return nil
+				}
+				if err := rotateFile(p, oldKey, newKey); err != nil {
+					return fmt.Errorf("%v: %v", p, err)
+				}
+				done = append(done, p)
+				return nil
+			})
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// swapRotatedFiles replaces the originals by their re-encrypted copies
+func swapRotatedFiles(ps []string) error {
+	for i, p := range ps {
+		if err := os.Rename(p+rotateSuffix, p); err != nil {
+			return fmt.Errorf("%v of %v files swapped, %v: %v", i, len(ps),
+				p, err)
+		}
+	}
+	return nil
+}
+
+// discardRotatedFiles removes the re-encrypted copies after a failure
+func discardRotatedFiles(ps []string) {
+	for _, p := range ps {
+		os.Remove(p + rotateSuffix)
+	}
+}
+
+// runRotateKeys is the rotate-keys command
+func runRotateKeys(args []string) error {
+	if len(args) > 0 {
+		return usageError("unexpected argument " + args[0])
+	}
+	newTextKey := os.Getenv("MX_NEW_AES_TEXT_KEY")
+	newFileKey := os.Getenv("MX_NEW_AES_FILE_KEY")
+	if newTextKey == "" && newFileKey == "" {
+		return usageError("set MX_NEW_AES_TEXT_KEY and/or MX_NEW_AES_FILE_KEY")
+	}
+	if err := checkSchema(dbConn); err != nil {
+		return err
+	}
+
+	// Files first, they are only swapped in after the database commit
+	var files []string
+	if newFileKey != "" {
+		key, err := decodeHexKey("MX_NEW_AES_FILE_KEY", newFileKey,
+			16, 24, 32)
+		if err != nil {
+			return err
+		}
+		files, err = rotateFileKey(dataDir, aesFileSecret, key)
+		if err != nil {
+			discardRotatedFiles(files)
+			return err
+		}
+	}
+
+	if newTextKey != "" {
+		key, err := decodeHexKey("MX_NEW_AES_TEXT_KEY", newTextKey,
+			16, 24, 32)
+		if err != nil {
+			discardRotatedFiles(files)
+			return err
+		}
+		tx := dbConn.Begin()
+		if tx.Error != nil {
+			discardRotatedFiles(files)
+			return tx.Error
+		}
+		n, err := rotateTextKey(tx, aesTextSecret, key)
+		if err != nil {
+			tx.Rollback()
+			discardRotatedFiles(files)
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			discardRotatedFiles(files)
+			return err
+		}
+		fmt.Printf("Re-encrypted %v database values, set MX_AES_TEXT_KEY "+
+			"to the new key\n", n)
+	}
+
+	if err := swapRotatedFiles(files); err != nil {
+		return err
+	}
+	if newFileKey != "" {
+		fmt.Printf("Re-encrypted %v files, set MX_AES_FILE_KEY to the "+
+			"new key\n", len(files))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Testing for encryption key rotation
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRotateTotpSecret(t *testing.T) {
+	rotated := false
+	for _, rc := range rotateColumns {
+		rotated = rotated ||
+			(rc.table == "users" && rc.column == "totp_secret_encrypted")
+	}
+	if !rotated {
+		t.Fatal("[Rotate] Authenticator secrets are not rotated\n")
+	}
+
+	defer func(k []byte) { aesTextSecret = k }(aesTextSecret)
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	// Enroll under the old key and rotate to the new one
+	aesTextSecret = oldKey
+	secret := newTotpSecret()
+	ct := encField(secret)
+	nct, err := reencryptString(oldKey, newKey, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aesTextSecret = newKey
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Now()
+	if _, ok := checkTotp(decField(nct), totpCode(key, now.Unix()/totpPeriod),
+		now, 0); !ok {
+		t.Fatal("[Rotate] Code refused after rotation\n")
+	}
+	if decField(ct) == secret {
+		t.Fatal("[Rotate] Secret still readable with the retired key\n")
+	}
+}
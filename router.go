@@ -11,12 +11,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"reflect"
 	"strings"
 	"time"
 
@@ -26,7 +24,6 @@ import (
 
 var (
 	jwtSigningSecret, _ = hex.DecodeString(jwtSecretKey)
-	jwtSigningMethod    = jwt.SigningMethodHS512
 	aesTextSecret, _    = hex.DecodeString(aesTextKey)
 	aesFileSecret, _    = hex.DecodeString(aesFileKey)
 	companySecret       = compSecretPrefix
@@ -34,8 +31,7 @@ var (
 )
 
 const (
-	jwtSigningDuration = time.Hour * 24 * 7
-	maxRequestBody     = 10 * 1024 * 1024
+	maxRequestBody = 10 * 1024 * 1024
 )
 
 // formatReturnJson returns a json-formatted http response to client
@@ -51,7 +47,7 @@ func formatReturnJson(w http.ResponseWriter, r *http.Request,
 		args["result"] = ResultSuccess
 	} else {
 		args["result"] = ResultFail
-		reqLang := ps[len(ps)-2].Value
+		reqLang := requestLang(r)
 		ecs := ErrorCodes[reqLang][ec]
 		if eci != "" {
 			args["error"] = fmt.Sprintf(ecs, eci)
@@ -70,12 +66,15 @@ func formatReturnJson(w http.ResponseWriter, r *http.Request,
 	} else {
 		rs = string(ret)
 	}
-	fmt.Fprintf(w, rs)
+	fmt.Fprint(w, rs)
 
-	// Log the response (the only exit point)
-	reqId := ps[len(ps)-1].Value
-	serverLog.Printf("[MXAPI] (%v) |%v| RETURN: %v\n", reqId,
-		getIp(r), rs)
+	// Keep the response (the only exit point) for the request log without
+	// sensitive fields
+	if err == nil {
+		rs = redactResponse(r, ps, ret)
+	}
+	rc := getRequestContext(r)
+	rc.returned, rc.errorCode, rc.response = true, ec, rs
 }
 
 // formatReturnInfo is a wrapper for formatReturnJson that is only available
@@ -234,46 +233,30 @@ func checkAuth(r *http.Request) (*User, ErrorCode) {
 	}
 
 	// Check jwt validity
-	token, err := jwt.Parse(auth[7:], func(token *jwt.Token) (interface{},
-		error) {
-		if reflect.ValueOf(token.Method).Pointer() !=
-			reflect.ValueOf(jwtSigningMethod).Pointer() {
-			return nil, fmt.Errorf("Unexpected signing method: %v",
-				token.Header["alg"])
-		}
-		return jwtSigningSecret, nil
-	})
+	token, err := jwtParser.Parse(auth[7:], jwtKeys.verifyKey)
 	if err != nil || !token.Valid {
 		return nil, ErrorCodeJwtError
 	}
 
-	// Check for jwt expiration
-	claims := token.Claims.(jwt.MapClaims)
-	expire, found := claims["expire"]
-	if !found {
-		return nil, ErrorCodeJwtStoreError
-	}
-	exp, ok := expire.(float64)
-	if !ok {
-		return nil, ErrorCodeJwtStoreError
-	}
-	if time.Now().After(time.Unix(int64(exp), 0)) {
-		return nil, ErrorCodeJwtExpired
+	// Check for jwt expiration and user id, standard or legacy claims
+	ac, ec := parseAuthClaims(token.Claims.(jwt.MapClaims), time.Now())
+	if ec != ErrorCodeNone {
+		return nil, ec
 	}
 
-	// Check user id value availability
-	userId, found := claims["user_id"]
-	if !found {
-		return nil, ErrorCodeJwtStoreError
-	}
-	uid, ok := userId.(float64)
-	if !ok {
-		return nil, ErrorCodeJwtStoreError
+	// Tokens from before sessions carry no session and run out by expire
+	if ac.session != 0 {
+		s, ec := checkSession(ac.session)
+		if ec != ErrorCodeNone {
+			return nil, ec
+		}
+		rc := getRequestContext(r)
+		rc.session, rc.twoFactor = s.ID, s.TwoFactor
 	}
 
 	// Check user availability
 	var currentUser User
-	if dbConn.First(&currentUser, int64(uid)).RecordNotFound() {
+	if dbConn.First(&currentUser, ac.userId).RecordNotFound() {
 		return nil, ErrorCodeUserUnknown
 	}
 
@@ -297,13 +280,14 @@ func authProtect(h mxHandle) httprouter.Handle {
 		}
 
 		// Passed all checks, continue
+		getRequestContext(r).user = u
 		h(w, r, ps, u)
 	}
 }
 
 // adminProtect checks user credentials and only allows
-// admin-level users to proceed, otherwise return failure
-func adminProtect(h mxHandle) httprouter.Handle {
+// admins whose roles grant perm to proceed, otherwise return failure
+func adminProtect(perm Permission, h mxHandle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request,
 		ps httprouter.Params) {
 		u, ec := checkAuth(r)
@@ -317,36 +301,55 @@ func adminProtect(h mxHandle) httprouter.Handle {
 			return
 		}
 
+		// Admins need an enrolled authenticator and a login verified by it
+		if twoFactorRequired(u) {
+			if !u.TotpEnabled {
+				formatReturn(w, r, ps, ErrorCodeTwoFactorSetupRequired,
+					false, nil)
+				return
+			}
+			if !getRequestContext(r).twoFactor {
+				formatReturn(w, r, ps, ErrorCodeTwoFactorRequired, false, nil)
+				return
+			}
+		}
+
+		roles, err := userRoles(u.ID)
+		if err != nil {
+			formatReturn(w, r, ps, ErrorCodeAdminError, false, nil)
+			return
+		}
+		perms := rolePermissions(roles)
+		if !perms[perm] {
+			formatReturn(w, r, ps, ErrorCodeNoPermission, false, nil)
+			return
+		}
+
 		// Passed all checks, continue
+		rc := getRequestContext(r)
+		rc.user, rc.perms = u, perms
 		h(w, r, ps, u)
 	}
 }
 
-// tokenProtect checks whether the access token of the api call
-// is valid and returns failure result + error message
-func tokenProtect(h httprouter.Handle, tokens []string) httprouter.Handle {
+// tokenProtect checks whether the api key of the call is valid and
+// carries scope, otherwise return failure result + error message
+func tokenProtect(scope string, h httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request,
 		ps httprouter.Params) {
-		// token is a required field
-		token, ok := CheckLength(true, r.FormValue("token"),
-			TokenMinMax, TokenMinMax)
-		if !ok {
-			formatReturnJson(w, r, ps, ErrorCodeTokenError, "",
-				LoginNone, nil)
+		rc := getRequestContext(r)
+		k, ec := checkApiKey(requestApiKey(r), scope, rc.ip)
+		if ec != ErrorCodeNone {
+			formatReturnJson(w, r, ps, ec, "", LoginNone, nil)
 			return
 		}
-		for _, t := range tokens {
-			if token == t {
-				h(w, r, ps)
-				return
-			}
-		}
-		formatReturnJson(w, r, ps, ErrorCodeTokenError, "", LoginNone, nil)
+		rc.apiKey = k
+		h(w, r, ps)
 	}
 }
 
-// saveLogin is called after login is successful and a new jwt is created
-// if on initial (login) call api (register/login/recover)
+// saveLogin is called after login is successful and a new session is
+// opened if on initial (login) call api (register/login/recover)
 // Now serves as a common "success" return point after login
 func saveLogin(w http.ResponseWriter, r *http.Request,
 	ps httprouter.Params, initial bool, u *User,
@@ -361,23 +364,21 @@ func saveLogin(w http.ResponseWriter, r *http.Request,
 		ie = map[string]interface{}{}
 	}
 	if initial {
-		token := jwt.New(jwtSigningMethod)
-		// Set claims for user id and expiration
-		claims := token.Claims.(jwt.MapClaims)
-		claims["user_id"] = u.ID
-		claims["expire"] = time.Now().Add(jwtSigningDuration).Unix()
-		tokenString, err := token.SignedString(jwtSigningSecret)
+		tokens, err := newSession(r, u)
 		if err != nil {
 			formatReturn(w, r, ps, ErrorCodeJwtError, false, nil)
 			return
 		}
 		// Save for return
-		ie["token"] = tokenString
+		for k, v := range tokens {
+			ie[k] = v
+		}
 	}
 
 	// TODO: Probably need to merge this somewhere to save one db save
 	u.LastIpAddress = getIp(r)
-	u.LastLanguage = ps[len(ps)-2].Value
+	u.LastUserAgent = userAgent(r)
+	u.LastLanguage = requestLang(r)
 	// Do not fail on ip address save
 	dbConn.Save(u)
 
@@ -399,39 +400,47 @@ func saveAdmin(w http.ResponseWriter, r *http.Request,
 	// Do not fail on ip address save
 	dbConn.Save(u)
 
+	// Only show what the roles of the admin allow
+	filterSensitive(ie, getRequestContext(r).perms)
 	formatReturn(w, r, ps, ErrorCodeNone, true, ie)
 }
 
-// getIpAddress reads in a concatenated ip:port from http.Request
-// and returns the ip address if available, "" otherwise
-func getIp(r *http.Request) string {
-	i := strings.LastIndex(r.RemoteAddr, ":")
-	if i < 0 {
-		return ""
-	}
-	return strings.Trim(r.RemoteAddr[:i], "[]")
-}
-
 // logProtect wraps REST-like requests with properly searchable
-// logging so we don't log everything such as static files
+// logging and metrics so we don't log everything such as static files
 func logProtect(h httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request,
 		ps httprouter.Params) {
+		rc := newRequestContext(r)
+		r = withRequestContext(r, rc)
+		w.Header().Set(RequestIdHeader, rc.id)
 		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
 		r.ParseMultipartForm(0)
-		reqId := fmt.Sprintf("%v", rand.Int63())
-		serverLog.Printf("[MXAPI] (%v) |%v| %v: %v?%v\n", reqId,
-			getIp(r), r.Method, r.URL, r.Form.Encode())
-		// Store current language (default to English)
-		reqLang := r.Header.Get("Language")
-		if reqLang != "en-US" && reqLang != "zh-CN" {
-			reqLang = "en-US"
-		}
-		// Store request language as a hack in httprouter params
-		ps = append(ps, httprouter.Param{Key: "", Value: reqLang})
-		// Store request id as a hack in httprouter params
-		ps = append(ps, httprouter.Param{Key: "", Value: reqId})
+		route := routePattern(r.URL.Path, ps)
+		reqLog := serverLog.With(LogFields{"request_id": rc.id,
+			"route": route})
+		reqLog.Info("request", LogFields{"ip": rc.ip, "method": r.Method,
+			"lang": rc.lang, "request": redactRequest(r, ps)})
 		h(w, r, ps)
+
+		latency := time.Since(rc.start)
+		result := MetricResultNone
+		f := LogFields{"latency_ms": logMillis(latency)}
+		if rc.returned {
+			result = MetricResultSuccess
+			if rc.errorCode != ErrorCodeNone {
+				result = fmt.Sprintf("%v", rc.errorCode)
+				f["error_code"] = rc.errorCode
+			}
+			f["response"] = rc.response
+		}
+		if rc.user != nil {
+			f["user_id"] = rc.user.ID
+		}
+		if rc.apiKey != nil {
+			f["api_key_id"] = rc.apiKey.ID
+		}
+		reqLog.Info("response", f)
+		observeRequest(r.Method, route, result, latency)
 	}
 }
 
@@ -447,25 +456,38 @@ func (w GzipResponseWriter) Write(b []byte) (int, error) {
 
 // newServerRouter returns a valid router to handle
 func newServerRouter() *httprouter.Router {
-	// Init rand seed for request ids
-	rand.Seed(time.Now().UTC().UnixNano())
-
 	router := httprouter.New()
 
+	// --- Health ---
+	router.GET("/healthz", healthzHandler)
+	router.GET("/readyz", readyzHandler)
+	router.GET("/metrics", metricsTokenProtect(metricsHandler))
+	router.GET("/.well-known/jwks.json", jwksHandler)
+
 	// --- Account ---
-	router.POST("/account/send_mobile_code", logProtect(mobileSendVerificationCodeHandler))
-	router.POST("/account/verify_mobile_code", logProtect(mobileCheckVerificationCodeHandler))
-	router.POST("/account/register", logProtect(accountRegisterHandler))
-	router.POST("/account/login", logProtect(accountLoginHandler))
+	router.POST("/account/send_mobile_code", logProtect(rateProtect(mobileSendVerificationCodeHandler)))
+	router.POST("/account/verify_mobile_code", logProtect(rateProtect(mobileCheckVerificationCodeHandler)))
+	router.POST("/account/register", logProtect(rateProtect(accountRegisterHandler)))
+	router.POST("/account/login", logProtect(rateProtect(accountLoginHandler)))
+	router.POST("/account/login_link", logProtect(rateProtect(accountLoginLinkHandler)))
 	router.POST("/account/confirm", logProtect(authProtect(accountConfirmHandler)))
 	router.POST("/account/recover", logProtect(accountRecoverHandler))
-	router.POST("/account/forget", logProtect(accountForgetHandler))
+	router.POST("/account/forget", logProtect(rateProtect(accountForgetHandler)))
+	router.POST("/account/unlock", logProtect(rateProtect(accountUnlockHandler)))
+	router.POST("/account/refresh", logProtect(rateProtect(accountRefreshHandler)))
+	router.POST("/account/logout", logProtect(authProtect(accountLogoutHandler)))
+	router.POST("/account/logout_all", logProtect(authProtect(accountLogoutAllHandler)))
+	router.GET("/account/2fa", logProtect(authProtect(accountTwoFactorHandler)))
+	router.POST("/account/2fa/setup", logProtect(authProtect(accountTwoFactorSetupHandler)))
+	router.POST("/account/2fa/enable", logProtect(rateProtect(authProtect(accountTwoFactorEnableHandler))))
+	router.POST("/account/2fa/disable", logProtect(rateProtect(authProtect(accountTwoFactorDisableHandler))))
+	router.POST("/account/2fa/recovery_codes", logProtect(rateProtect(authProtect(accountRecoveryCodesHandler))))
 	router.POST("/account/change", logProtect(authProtect(accountChangeHandler)))
 
 	router.PUT("/account/stateupdate", logProtect(authProtect(accountStateUpdate)))
 
-	router.PUT("/account/wxlogin", logProtect(wechatLoginHandler))
-	router.PUT("/account/wxbind", logProtect(wechatBindHandler))
+	router.PUT("/account/wxlogin", logProtect(rateProtect(wechatLoginHandler)))
+	router.PUT("/account/wxbind", logProtect(rateProtect(wechatBindHandler)))
 
 	// --- User ---
 	router.PUT("/user/nda", logProtect(authProtect(userNdaHandler)))
@@ -486,6 +508,18 @@ func newServerRouter() *httprouter.Router {
 	router.GET("/user/photo_id/:token", logProtect(userPhotoIdTokenHandler))
 	router.GET("/user/sells", logProtect(authProtect(userSellsHandler)))
 	router.GET("/user/buys", logProtect(authProtect(userBuysHandler)))
+	router.GET("/user/sessions", logProtect(authProtect(userSessionsHandler)))
+	router.GET("/user/wechat", logProtect(authProtect(userWechatHandler)))
+	router.PUT("/user/wechat",
+		logProtect(authProtect(userWechatBindHandler)))
+	router.DELETE("/user/wechat",
+		logProtect(authProtect(userWechatUnbindHandler)))
+	router.POST("/user/phone/send_code",
+		logProtect(rateProtect(authProtect(userPhoneSendCodeHandler))))
+	router.PUT("/user/phone",
+		logProtect(rateProtect(authProtect(userPhoneUpdateHandler))))
+	router.DELETE("/user/sessions/:id",
+		logProtect(authProtect(userSessionRevokeHandler)))
 
 	// --- Company ---
 	router.GET("/companies", logProtect(companiesHandler))
@@ -577,123 +611,163 @@ func newServerRouter() *httprouter.Router {
 		logProtect(authProtect(dealBuyDeSubscriptionCheckHandler)))
 
 	// --- Admin / User ---
-	router.GET("/admin/users", logProtect(adminProtect(adminUsersHandler)))
+	router.GET("/admin/users",
+		logProtect(adminProtect(PermUsersRead, adminUsersHandler)))
 	router.GET("/admin/user/:id",
-		logProtect(adminProtect(adminUserIdHandler)))
+		logProtect(adminProtect(PermUsersRead, adminUserIdHandler)))
 	router.PUT("/admin/user/:id",
-		logProtect(adminProtect(adminUserUpdateHandler)))
+		logProtect(adminProtect(PermUsersWrite, adminUserUpdateHandler)))
 	router.GET("/admin/user/:id/photo_id",
-		logProtect(adminProtect(adminUserPhotoIdHandler)))
+		logProtect(adminProtect(PermPhotoIdsRead, adminUserPhotoIdHandler)))
 	router.GET("/admin/user/:id/photo_id/:token",
 		logProtect(adminUserPhotoIdTokenHandler))
 	router.POST("/admin/user/:id/photo_id",
-		logProtect(adminProtect(adminUserPhotoIdUploadHandler)))
+		logProtect(adminProtect(PermPhotoIdsWrite,
+			adminUserPhotoIdUploadHandler)))
 	router.DELETE("/admin/user/:id",
-		logProtect(adminProtect(adminUserDeleteHandler)))
+		logProtect(adminProtect(PermUsersDelete, adminUserDeleteHandler)))
+	router.GET("/admin/roles",
+		logProtect(adminProtect(PermUsersRead, adminRolesHandler)))
+	router.GET("/admin/user/:id/roles",
+		logProtect(adminProtect(PermUsersRead, adminUserRolesHandler)))
+	router.PUT("/admin/user/:id/roles",
+		logProtect(adminProtect(PermRolesManage, adminUserRolesUpdateHandler)))
+
+	// --- Admin / Api Key ---
+	router.GET("/admin/api_keys",
+		logProtect(adminProtect(PermApiKeysManage, adminApiKeysHandler)))
+	router.POST("/admin/api_key",
+		logProtect(adminProtect(PermApiKeysManage, adminApiKeyAddHandler)))
+	router.POST("/admin/api_key/:id/rotate",
+		logProtect(adminProtect(PermApiKeysManage, adminApiKeyRotateHandler)))
+	router.DELETE("/admin/api_key/:id",
+		logProtect(adminProtect(PermApiKeysManage, adminApiKeyDeleteHandler)))
+
+	// --- Admin / Login Method ---
+	router.GET("/admin/login_methods",
+		logProtect(adminProtect(PermLoginManage, adminLoginMethodsHandler)))
+	router.PUT("/admin/login_method",
+		logProtect(adminProtect(PermLoginManage, adminLoginMethodUpdateHandler)))
 
 	// --- Admin / Company ---
 	router.GET("/admin/companies",
-		logProtect(adminProtect(adminCompaniesHandler)))
+		logProtect(adminProtect(PermCompaniesRead, adminCompaniesHandler)))
 	router.GET("/admin/company_tags",
-		logProtect(adminProtect(adminCompanyTagsHandler)))
+		logProtect(adminProtect(PermCompaniesRead, adminCompanyTagsHandler)))
 	router.GET("/admin/company/:id",
-		logProtect(adminProtect(adminCompanyIdHandler)))
+		logProtect(adminProtect(PermCompaniesRead, adminCompanyIdHandler)))
 	router.GET("/admin/company_tag/:id",
-		logProtect(adminProtect(adminCompanyTagIdHandler)))
+		logProtect(adminProtect(PermCompaniesRead, adminCompanyTagIdHandler)))
 	router.PUT("/admin/company/:id",
-		logProtect(adminProtect(adminCompanyUpdateHandler)))
+		logProtect(adminProtect(PermCompaniesWrite, adminCompanyUpdateHandler)))
 	router.POST("/admin/company",
-		logProtect(adminProtect(adminCompanyAddHandler)))
+		logProtect(adminProtect(PermCompaniesWrite, adminCompanyAddHandler)))
 	router.POST("/admin/company/:id/logo",
-		logProtect(adminProtect(adminCompanyLogoUpdateHandler)))
+		logProtect(adminProtect(PermCompaniesWrite,
+			adminCompanyLogoUpdateHandler)))
 	router.POST("/admin/company/:id/bg",
-		logProtect(adminProtect(adminCompanyBgUpdateHandler)))
+		logProtect(adminProtect(PermCompaniesWrite,
+			adminCompanyBgUpdateHandler)))
 	router.POST("/admin/company/:id/slide_en/:slide_id",
-		logProtect(adminProtect(adminCompanySlideEnUpdateHandler)))
+		logProtect(adminProtect(PermCompaniesWrite,
+			adminCompanySlideEnUpdateHandler)))
 	router.POST("/admin/company/:id/slide_zh/:slide_id",
-		logProtect(adminProtect(adminCompanySlideZhUpdateHandler)))
+		logProtect(adminProtect(PermCompaniesWrite,
+			adminCompanySlideZhUpdateHandler)))
 	router.PUT("/admin/company_tag/:id",
-		logProtect(adminProtect(adminCompanyTagUpdateHandler)))
+		logProtect(adminProtect(PermCompaniesWrite,
+			adminCompanyTagUpdateHandler)))
 	router.POST("/admin/company_tag",
-		logProtect(adminProtect(adminCompanyTagAddHandler)))
+		logProtect(adminProtect(PermCompaniesWrite, adminCompanyTagAddHandler)))
 	router.DELETE("/admin/company/:id",
-		logProtect(adminProtect(adminCompanyDeleteHandler)))
+		logProtect(adminProtect(PermCompaniesDelete,
+			adminCompanyDeleteHandler)))
 
 	// --- Admin / Deal ---
-	router.GET("/admin/deals", logProtect(adminProtect(adminDealsHandler)))
+	router.GET("/admin/deals",
+		logProtect(adminProtect(PermDealsRead, adminDealsHandler)))
 	router.GET("/admin/deal/:id",
-		logProtect(adminProtect(adminDealIdHandler)))
+		logProtect(adminProtect(PermDealsRead, adminDealIdHandler)))
 	router.PUT("/admin/deal/:id",
-		logProtect(adminProtect(adminDealUpdateHandler)))
-	router.POST("/admin/deal", logProtect(adminProtect(adminDealAddHandler)))
+		logProtect(adminProtect(PermDealsWrite, adminDealUpdateHandler)))
+	router.POST("/admin/deal",
+		logProtect(adminProtect(PermDealsWrite, adminDealAddHandler)))
 	router.DELETE("/admin/deal/:id",
-		logProtect(adminProtect(adminDealDeleteHandler)))
+		logProtect(adminProtect(PermDealsDelete, adminDealDeleteHandler)))
 
 	// --- Admin / Deal / Sell ---
 	router.GET("/admin/deal/:id/sells",
-		logProtect(adminProtect(adminDealSellsHandler)))
+		logProtect(adminProtect(PermDealsRead, adminDealSellsHandler)))
 	router.GET("/admin/deal/:id/sell/:sell_id",
-		logProtect(adminProtect(adminDealSellHandler)))
+		logProtect(adminProtect(PermDealsRead, adminDealSellHandler)))
 	router.GET("/admin/deal/:id/sell/:sell_id/share_certificate",
-		logProtect(adminProtect(adminDealSellShareCertificateHandler)))
+		logProtect(adminProtect(PermDealsRead,
+			adminDealSellShareCertificateHandler)))
 	router.GET("/admin/deal/:id/sell/:sell_id/share_certificate/:token",
 		logProtect(adminDealSellShareCertificateTokenHandler))
 	router.GET("/admin/deal/:id/sell/:sell_id/company_by_laws",
-		logProtect(adminProtect(adminDealSellCompanyByLawsHandler)))
+		logProtect(adminProtect(PermDealsRead,
+			adminDealSellCompanyByLawsHandler)))
 	router.GET("/admin/deal/:id/sell/:sell_id/company_by_laws/:token",
 		logProtect(adminDealSellCompanyByLawsTokenHandler))
 	router.GET("/admin/deal/:id/sell/:sell_id/shareholder_agreement",
-		logProtect(adminProtect(adminDealSellShareholderAgreementHandler)))
+		logProtect(adminProtect(PermDealsRead,
+			adminDealSellShareholderAgreementHandler)))
 	router.GET("/admin/deal/:id/sell/:sell_id/shareholder_agreement/:token",
 		logProtect(adminDealSellShareholderAgreementTokenHandler))
 	router.GET("/admin/deal/:id/sell/:sell_id/stock_option_plan",
-		logProtect(adminProtect(adminDealSellStockOptionPlanHandler)))
+		logProtect(adminProtect(PermDealsRead,
+			adminDealSellStockOptionPlanHandler)))
 	router.GET("/admin/deal/:id/sell/:sell_id/stock_option_plan/:token",
 		logProtect(adminDealSellStockOptionPlanTokenHandler))
 	router.GET("/admin/deal/:id/sell/:sell_id/engagement_letter",
-		logProtect(adminProtect(adminDealSellEngagementLetterHandler)))
+		logProtect(adminProtect(PermDealsRead,
+			adminDealSellEngagementLetterHandler)))
 	router.GET("/admin/deal/:id/sell/:sell_id/engagement_letter/:token",
 		logProtect(adminDealSellEngagementLetterTokenHandler))
 	router.POST("/admin/deal/:id/sell/:sell_id",
-		logProtect(adminProtect(adminDealSellUpdateHandler)))
+		logProtect(adminProtect(PermDealsWrite, adminDealSellUpdateHandler)))
 	router.DELETE("/admin/deal/:id/sell/:sell_id",
-		logProtect(adminProtect(adminDealSellDeleteHandler)))
+		logProtect(adminProtect(PermDealsDelete, adminDealSellDeleteHandler)))
 
 	// --- Admin / Deal / Buy ---
 	router.GET("/admin/deal/:id/buys",
-		logProtect(adminProtect(adminDealBuysHandler)))
+		logProtect(adminProtect(PermDealsRead, adminDealBuysHandler)))
 	router.GET("/admin/deal/:id/buy/:buy_id",
-		logProtect(adminProtect(adminDealBuyHandler)))
+		logProtect(adminProtect(PermDealsRead, adminDealBuyHandler)))
 	router.GET("/admin/deal/:id/buy/:buy_id/engagement_letter",
-		logProtect(adminProtect(adminDealBuyEngagementLetterHandler)))
+		logProtect(adminProtect(PermDealsRead,
+			adminDealBuyEngagementLetterHandler)))
 	router.GET("/admin/deal/:id/buy/:buy_id/engagement_letter/:token",
 		logProtect(adminDealBuyEngagementLetterTokenHandler))
 	router.GET("/admin/deal/:id/buy/:buy_id/summary_terms",
-		logProtect(adminProtect(adminDealBuySummaryTermsHandler)))
+		logProtect(adminProtect(PermDealsRead,
+			adminDealBuySummaryTermsHandler)))
 	router.GET("/admin/deal/:id/buy/:buy_id/summary_terms/:token",
 		logProtect(adminDealBuySummaryTermsTokenHandler))
 	router.GET("/admin/deal/:id/buy/:buy_id/de_ppm",
-		logProtect(adminProtect(adminDealBuyDePpmHandler)))
+		logProtect(adminProtect(PermDealsRead, adminDealBuyDePpmHandler)))
 	router.GET("/admin/deal/:id/buy/:buy_id/de_ppm/:token",
 		logProtect(adminDealBuyDePpmTokenHandler))
 	router.GET("/admin/deal/:id/buy/:buy_id/de_operating",
-		logProtect(adminProtect(adminDealBuyDeOperatingHandler)))
+		logProtect(adminProtect(PermDealsRead, adminDealBuyDeOperatingHandler)))
 	router.GET("/admin/deal/:id/buy/:buy_id/de_operating/:token",
 		logProtect(adminDealBuyDeOperatingTokenHandler))
 	router.GET("/admin/deal/:id/buy/:buy_id/de_subscription",
-		logProtect(adminProtect(adminDealBuyDeSubscriptionHandler)))
+		logProtect(adminProtect(PermDealsRead,
+			adminDealBuyDeSubscriptionHandler)))
 	router.GET("/admin/deal/:id/buy/:buy_id/de_subscription/:token",
 		logProtect(adminDealBuyDeSubscriptionTokenHandler))
 	router.POST("/admin/deal/:id/buy/:buy_id",
-		logProtect(adminProtect(adminDealBuyUpdateHandler)))
+		logProtect(adminProtect(PermDealsWrite, adminDealBuyUpdateHandler)))
 	router.DELETE("/admin/deal/:id/buy/:buy_id",
-		logProtect(adminProtect(adminDealBuyDeleteHandler)))
+		logProtect(adminProtect(PermDealsDelete, adminDealBuyDeleteHandler)))
 
 	// --- Wechat ---
 	router.POST("/wechat",
-		logProtect(tokenProtect(wechatAddHandler, wechatTokens)))
+		logProtect(tokenProtect(ScopeWechatWrite, wechatAddHandler)))
 	router.GET("/wechat/:id",
-		logProtect(tokenProtect(wechatIdHandler, wechatTokens)))
+		logProtect(tokenProtect(ScopeWechatRead, wechatIdHandler)))
 
 	// Redirect not found to home page
 	router.HandleMethodNotAllowed = false
@@ -702,7 +776,8 @@ func newServerRouter() *httprouter.Router {
 	// Loop the (static) client dir and add relevant handlers
 	files, err := ioutil.ReadDir(clientDir)
 	if err != nil {
-		serverLog.Println("[MX] Cannot read client directory")
+		serverLog.Error("cannot read client directory",
+			LogFields{"dir": clientDir, "error": err})
 	} else {
 		// Mimic httprouter behavior of serving static files
 		// without all the panics
@@ -761,7 +836,7 @@ func newServerRouter() *httprouter.Router {
 			}
 			router.GET(name, rh)
 		}
-		serverLog.Println("[MX] Mounted client file handlers")
+		serverLog.Info("mounted client file handlers", nil)
 	}
 
 	return router
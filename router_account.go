@@ -4,53 +4,123 @@ package main
 import (
 	crand "crypto/rand"
 	"fmt"
+	"math"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/hashicorp/golang-lru"
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var cache, ignore = lru.NewARC(1000)
+// verifyPurpose reads the purpose form field of a code request, which
+// defaults to registering
+func verifyPurpose(r *http.Request) (string, bool) {
+	purpose := r.FormValue("purpose")
+	if purpose == "" {
+		return VerifyPurposeRegister, true
+	}
+	// Email link codes are only sent in login links
+	return purpose, VerifyPurposes[purpose] &&
+		purpose != VerifyPurposeEmailLink
+}
+
+// formatVerifyWait refuses a code request made before the resend delay
+func formatVerifyWait(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, wait time.Duration, login bool) {
+	secs := int64(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", fmt.Sprintf("%v", secs))
+	w.WriteHeader(http.StatusTooManyRequests)
+	formatReturnInfo(w, r, ps, ErrorFmtCodeVerifyCodeWait,
+		fmt.Sprintf("%v", secs), login, nil)
+}
+
+// sendVerifyCode sends a new code of purpose to phoneNumber and answers the
+// request, refusing when a code was sent too recently
+func sendVerifyCode(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, purpose, phoneNumber string, login bool) {
+	code, wait, err := issueVerifyCode(purpose, phoneNumber, getIp(r))
+	if err != nil {
+		serverLog.Error("verification code not issued", LogFields{
+			"request_id": requestId(r), "purpose": purpose, "error": err})
+		formatReturn(w, r, ps, ErrorCodeSmsError, login, nil)
+		return
+	}
+	if wait > 0 {
+		formatVerifyWait(w, r, ps, wait, login)
+		return
+	}
+
+	if sendSms(r, phoneNumber, SmsTextVerifyCode, code,
+		int64(verifyCodeTtl/time.Minute)) != nil {
+		// Let the user ask again right away
+		cancelVerifyCode(purpose, phoneNumber)
+		formatReturn(w, r, ps, ErrorCodeSmsError, login, nil)
+		return
+	}
+
+	formatReturn(w, r, ps, ErrorCodeNone, login, map[string]interface{}{
+		"phone_number": phoneNumber,
+		"purpose":      purpose,
+		"expires_in":   int64(verifyCodeTtl.Seconds()),
+		"resend_in":    int64(verifyCodeResend.Seconds()),
+	})
+}
 
 func mobileSendVerificationCodeHandler(w http.ResponseWriter, r *http.Request,
 	ps httprouter.Params) {
-	phoneNumber, of := CheckLengthForm("", r, "phone_number",
-		PhoneMin, PhoneMax)
+	phoneNumber, of := CheckPhoneForm("", r, "phone_number")
+	purpose, ok := verifyPurpose(r)
+	// Phone changes go through /user/phone/send_code
+	if of == "" && (!ok || purpose == VerifyPurposePhoneChange) {
+		of = "purpose"
+	}
 
 	if of != "" {
 		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
 		return
 	}
 
-	code := generateCode()
-	cache.Add(phoneNumber, code)
-	success, resp := send(phoneNumber, code)
-
-	if success {
-		formatReturn(w, r, ps, ErrorCodeNone, false,
-			map[string]interface{}{"phone_number": phoneNumber})
-	} else {
-		formatReturnInfo(w, r, ps, ErrorCodeUnknown, resp, false, nil)
+	var currentUser User
+	registered := !dbConn.First(&currentUser, "phone_number = ?",
+		phoneNumber).RecordNotFound()
+	if purpose == VerifyPurposeRegister && registered {
+		formatReturn(w, r, ps, ErrorCodePhoneExists, false, nil)
+		return
 	}
+	if purpose == VerifyPurposeLogin {
+		if !registered {
+			formatReturn(w, r, ps, ErrorCodePhoneUnknown, false, nil)
+			return
+		}
+		if !loginMethodEnabled(currentUser.RoleType, LoginMethodSms) {
+			formatReturn(w, r, ps, ErrorCodeLoginMethodDisabled, false, nil)
+			return
+		}
+	}
+
+	sendVerifyCode(w, r, ps, purpose, phoneNumber, false)
 }
 
 func mobileCheckVerificationCodeHandler(w http.ResponseWriter, r *http.Request,
 	ps httprouter.Params) {
-	phoneNumber, of := CheckLengthForm("", r, "phone_number", PhoneMin, PhoneMax)
+	phoneNumber, of := CheckPhoneForm("", r, "phone_number")
 	code, of := CheckFieldForm(of, r, "code")
+	purpose, ok := verifyPurpose(r)
+	if of == "" && !ok {
+		of = "purpose"
+	}
 
 	if of != "" {
 		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
 		return
 	}
 
-	val, found := cache.Get(phoneNumber)
-
-	if !found || code != val {
-		formatReturn(w, r, ps, ErrorCodePhoneCodeError, false, nil)
+	// The code is only checked here, it is used up by the request it is
+	// meant for
+	if ec := checkVerifyCode(purpose, phoneNumber, code,
+		false); ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, false, nil)
 		return
 	}
 
@@ -58,36 +128,32 @@ func mobileCheckVerificationCodeHandler(w http.ResponseWriter, r *http.Request,
 }
 
 func wechatLoginHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	openid, of := CheckFieldForm("", r, "openid")
-	unionid, of := CheckFieldForm(of, r, "unionid")
-
-	if of != "" {
-		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
+	// The authorization code is exchanged for the WeChat identity
+	p, ec := exchangeWechatCode(r)
+	if ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, false, nil)
 		return
 	}
 
-	// Email must match
-	var currentUser User
+	currentUser, found := wechatUser(p)
+	if !found {
+		formatReturn(w, r, ps, ErrorCodeWechatUnbound, false, nil)
+		return
+	}
 
-	if unionid != "" {
-		if dbConn.First(&currentUser, "wx_open_id = ?", openid).RecordNotFound() {
-			formatReturn(w, r, ps, ErrorCodePhoneUnknown, false, nil)
-			return
-		}
-	} else {
-		if dbConn.First(&currentUser, "wx_union_id = ?", unionid).RecordNotFound() {
-			formatReturn(w, r, ps, ErrorCodeEmailUnknown, false, nil)
-			return
-		}
+	if !checkLoginTwoFactor(w, r, ps, currentUser) {
+		return
 	}
 
-	saveLogin(w, r, ps, true, &currentUser, nil)
+	// Keep the profile current
+	currentUser.WxNickname = p.Nickname
+	currentUser.WxHeadImgUrl = p.HeadImgUrl
+
+	saveLogin(w, r, ps, true, currentUser, nil)
 }
 
 func wechatBindHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	openid, of := CheckFieldForm("", r, "openid")
-	unionid, of := CheckFieldForm(of, r, "unionid")
-	password, of := CheckLengthForm(of, r, "password", PasswordMinMax, PasswordMinMax)
+	password, of := CheckLengthForm("", r, "password", PasswordMinMax, PasswordMinMax)
 
 	if of != "" {
 		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
@@ -97,7 +163,7 @@ func wechatBindHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	email, of := CheckEmailForm(of, r, "email")
 	phoneNumber := ""
 	if of != "" {
-		phoneNumber, of = CheckLengthForm("", r, "email", PhoneMin, PhoneMax)
+		phoneNumber, of = CheckPhoneForm("", r, "email")
 	}
 	if of != "" {
 		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
@@ -119,21 +185,43 @@ func wechatBindHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 		}
 	}
 
+	// Locked accounts cannot even try until the lock is lifted
+	if locked, minutes := loginLocked(&currentUser); locked {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeAccountLocked,
+			fmt.Sprintf("%v", minutes), false, nil)
+		return
+	}
+
 	// Password must match hash
 	mismatch := bcrypt.CompareHashAndPassword([]byte(currentUser.PasswordHash),
 		[]byte(password))
 	if mismatch != nil {
+		loginFailed(r, &currentUser)
 		formatReturn(w, r, ps, ErrorCodeBadPassword, false, nil)
 		return
 	}
+	if !checkLoginTwoFactor(w, r, ps, &currentUser) {
+		return
+	}
+	loginSucceeded(r, &currentUser)
 
-	if currentUser.WxOpenID != "" || currentUser.WxUnionID != "" {
-		formatReturn(w, r, ps, ErrorCodeWechatBinded, false, nil)
+	// Only exchange the single use code once the user is known
+	p, ec := exchangeWechatCode(r)
+	if ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, false, nil)
 		return
 	}
 
-	currentUser.WxUnionID = unionid
-	currentUser.WxOpenID = openid
+	// Switching to another WeChat account goes through /user/wechat
+	if (currentUser.WxOpenID != "" && currentUser.WxOpenID != p.OpenID) ||
+		(currentUser.WxUnionID != "" && currentUser.WxUnionID != p.UnionID) {
+		formatReturn(w, r, ps, ErrorCodeWechatBinded, false, nil)
+		return
+	}
+	if ec := bindWechat(&currentUser, p); ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, false, nil)
+		return
+	}
 
 	saveLogin(w, r, ps, true, &currentUser, nil)
 }
@@ -146,23 +234,22 @@ func accountRegisterHandler(w http.ResponseWriter, r *http.Request, ps httproute
 
 	var phoneNumber = ""
 	var email = ""
+	var code = ""
 
 	if citizenType == CitizenTypeOther {
-		phoneNumber, of = CheckLengthForm(of, r, "phone_number", PhoneMin, PhoneMax)
-		code, of := CheckFieldForm(of, r, "code")
+		phoneNumber, of = CheckPhoneForm(of, r, "phone_number")
+		code, of = CheckFieldForm(of, r, "code")
 		if of != "" {
 			formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
 			return
 		}
 
-		val, found := cache.Get(phoneNumber)
-
-		if !found || code != val {
-			formatReturn(w, r, ps, ErrorCodePhoneCodeError, false, nil)
+		// Only used up once the account can be created
+		if ec := checkVerifyCode(VerifyPurposeRegister, phoneNumber, code,
+			false); ec != ErrorCodeNone {
+			formatReturn(w, r, ps, ec, false, nil)
 			return
 		}
-		// phone verification code okay, just remove it.
-		cache.Remove(phoneNumber)
 
 	} else {
 		email, of = CheckEmailForm(of, r, "email")
@@ -233,6 +320,15 @@ func accountRegisterHandler(w http.ResponseWriter, r *http.Request, ps httproute
 		CitizenType:       citizenType,
 		Country:           country,
 		CreationIpAddress: getIp(r)}
+
+	// Use up the code so it cannot register twice
+	if citizenType == CitizenTypeOther {
+		if ec := useVerifyCode(VerifyPurposeRegister, phoneNumber,
+			code); ec != ErrorCodeNone {
+			formatReturn(w, r, ps, ec, false, nil)
+			return
+		}
+	}
 	if dbConn.Create(&newUser).Error != nil {
 		formatReturnInfo(w, r, ps, ErrorCodeRegisterError, dbConn.Create(&newUser).Error.Error(), false, nil)
 		//formatReturn(w, r, ps, ErrorCodeRegisterError, false, nil)
@@ -241,7 +337,7 @@ func accountRegisterHandler(w http.ResponseWriter, r *http.Request, ps httproute
 
 	if citizenType != CitizenTypeOther {
 		// Now send activation email non-blocking
-		reqLang := ps[len(ps)-2].Value
+		reqLang := requestLang(r)
 		author := EmailTexts[reqLang][EmailTextName]
 		subject := EmailTexts[reqLang][EmailTextSubjectRegister]
 		link := fmt.Sprintf(emailConfirmLink, serverDomain, emailToken)
@@ -316,13 +412,23 @@ func accountLoginHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	// Passwordless logins with a login link or a texted code
+	if r.FormValue("link") != "" {
+		loginLinkLogin(w, r, ps)
+		return
+	}
+	if r.FormValue("code") != "" {
+		smsCodeLogin(w, r, ps)
+		return
+	}
+
 	var phoneNumber = ""
 
 	email, of := CheckEmailForm("", r, "email")
 	// If error, try parse as phone number
 	if of != "" {
 		of = ""
-		phoneNumber, of = CheckLengthForm("", r, "email", PhoneMin, PhoneMax)
+		phoneNumber, of = CheckPhoneForm("", r, "email")
 	}
 
 	password, of := CheckLengthForm(of, r, "password",
@@ -350,17 +456,180 @@ func accountLoginHandler(w http.ResponseWriter, r *http.Request,
 		}
 	}
 
+	// Locked accounts cannot even try until the lock is lifted
+	if locked, minutes := loginLocked(&currentUser); locked {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeAccountLocked,
+			fmt.Sprintf("%v", minutes), false, nil)
+		return
+	}
+
 	// Password must match hash
 	mismatch := bcrypt.CompareHashAndPassword([]byte(currentUser.PasswordHash),
 		[]byte(password))
 	if mismatch != nil {
+		loginFailed(r, &currentUser)
 		formatReturn(w, r, ps, ErrorCodeBadPassword, false, nil)
 		return
 	}
+	if !checkLoginTwoFactor(w, r, ps, &currentUser) {
+		return
+	}
+	loginSucceeded(r, &currentUser)
+
+	saveLogin(w, r, ps, true, &currentUser, nil)
+}
+
+// smsCodeLogin signs in the user of a phone number with a code sent by
+// /account/send_mobile_code for login
+func smsCodeLogin(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	phoneNumber, of := CheckPhoneForm("", r, "phone_number")
+	code, of := CheckFieldForm(of, r, "code")
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
+		return
+	}
+
+	var currentUser User
+	if dbConn.First(&currentUser, "phone_number = ?",
+		phoneNumber).RecordNotFound() {
+		formatReturn(w, r, ps, ErrorCodePhoneUnknown, false, nil)
+		return
+	}
+	if !loginMethodEnabled(currentUser.RoleType, LoginMethodSms) {
+		formatReturn(w, r, ps, ErrorCodeLoginMethodDisabled, false, nil)
+		return
+	}
+	if locked, minutes := loginLocked(&currentUser); locked {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeAccountLocked,
+			fmt.Sprintf("%v", minutes), false, nil)
+		return
+	}
+
+	// The code is only used up once two-factor passes, so a missing otp
+	// does not cost a new code
+	if ec := checkVerifyCode(VerifyPurposeLogin, phoneNumber, code,
+		false); ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, false, nil)
+		return
+	}
+	if !checkLoginTwoFactor(w, r, ps, &currentUser) {
+		return
+	}
+	if ec := useVerifyCode(VerifyPurposeLogin, phoneNumber,
+		code); ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, false, nil)
+		return
+	}
+	loginSucceeded(r, &currentUser)
+	serverLog.Info("passwordless login", LogFields{
+		"request_id": requestId(r), "user_id": currentUser.ID,
+		"method": LoginMethodSms})
 
 	saveLogin(w, r, ps, true, &currentUser, nil)
 }
 
+// loginLinkLogin signs in the user of a link sent by /account/login_link
+func loginLinkLogin(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	uid, email, code, ok := parseLoginLinkToken(r.FormValue("link"),
+		time.Now())
+
+	// The link is for the email the user had when it was sent
+	var currentUser User
+	if !ok || dbConn.First(&currentUser, uid).RecordNotFound() ||
+		currentUser.Email != email {
+		formatReturn(w, r, ps, ErrorCodeLoginLinkInvalid, false, nil)
+		return
+	}
+	if !loginMethodEnabled(currentUser.RoleType, LoginMethodEmailLink) {
+		formatReturn(w, r, ps, ErrorCodeLoginMethodDisabled, false, nil)
+		return
+	}
+	if locked, minutes := loginLocked(&currentUser); locked {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeAccountLocked,
+			fmt.Sprintf("%v", minutes), false, nil)
+		return
+	}
+
+	if checkVerifyCode(VerifyPurposeEmailLink, email, code,
+		false) != ErrorCodeNone {
+		formatReturn(w, r, ps, ErrorCodeLoginLinkInvalid, false, nil)
+		return
+	}
+	if !checkLoginTwoFactor(w, r, ps, &currentUser) {
+		return
+	}
+	if useVerifyCode(VerifyPurposeEmailLink, email,
+		code) != ErrorCodeNone {
+		formatReturn(w, r, ps, ErrorCodeLoginLinkInvalid, false, nil)
+		return
+	}
+	loginSucceeded(r, &currentUser)
+	serverLog.Info("passwordless login", LogFields{
+		"request_id": requestId(r), "user_id": currentUser.ID,
+		"method": LoginMethodEmailLink})
+
+	saveLogin(w, r, ps, true, &currentUser, nil)
+}
+
+func accountLoginLinkHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	email, of := CheckEmailForm("", r, "email")
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
+		return
+	}
+
+	var currentUser User
+	email = strings.ToLower(email)
+	if dbConn.First(&currentUser, "email = ?", email).RecordNotFound() {
+		formatReturn(w, r, ps, ErrorCodeEmailUnknown, false, nil)
+		return
+	}
+	if !loginMethodEnabled(currentUser.RoleType, LoginMethodEmailLink) {
+		formatReturn(w, r, ps, ErrorCodeLoginMethodDisabled, false, nil)
+		return
+	}
+
+	code, wait, err := issueVerifyCode(VerifyPurposeEmailLink,
+		currentUser.Email, getIp(r))
+	if err != nil {
+		serverLog.Error("login link not issued", LogFields{
+			"request_id": requestId(r), "user_id": currentUser.ID,
+			"error": err})
+		formatReturn(w, r, ps, ErrorCodeLoginLinkError, false, nil)
+		return
+	}
+	if wait > 0 {
+		formatVerifyWait(w, r, ps, wait, false)
+		return
+	}
+	token, err := newLoginLinkToken(&currentUser, code, time.Now())
+	if err != nil {
+		cancelVerifyCode(VerifyPurposeEmailLink, currentUser.Email)
+		formatReturn(w, r, ps, ErrorCodeLoginLinkError, false, nil)
+		return
+	}
+
+	// Now send login link email non-blocking
+	reqLang := requestLang(r)
+	link := fmt.Sprintf(emailLoginLink, serverDomain, token)
+	body := fmt.Sprintf(EmailTexts[reqLang][EmailTextBodyLoginLink],
+		currentUser.FullName, int64(verifyCodeTtl/time.Minute), link, link)
+	sendMailBackground(EmailTexts[reqLang][EmailTextName], currentUser.Email,
+		currentUser.FullName, EmailTexts[reqLang][EmailTextSubjectLoginLink],
+		body)
+
+	formatReturn(w, r, ps, ErrorCodeNone, false, map[string]interface{}{
+		"email":      email,
+		"expires_in": int64(verifyCodeTtl.Seconds()),
+		"resend_in":  int64(verifyCodeResend.Seconds()),
+	})
+}
+
 func accountConfirmHandler(w http.ResponseWriter, r *http.Request,
 	ps httprouter.Params, u *User) {
 	// If user state isn't inactive there is nothing to confirm
@@ -381,13 +650,13 @@ func accountConfirmHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Now send activation email non-blocking
-	reqLang := ps[len(ps)-2].Value
+	reqLang := requestLang(r)
 	author := EmailTexts[reqLang][EmailTextName]
 	subject := EmailTexts[reqLang][EmailTextSubjectRegister]
 	link := fmt.Sprintf(emailConfirmLink, serverDomain, emailToken)
 	body := fmt.Sprintf(EmailTexts[reqLang][EmailTextBodyRegister],
 		u.FullName, link, link)
-	go sendMail(author, u.Email, u.FullName, subject, body)
+	sendMailBackground(author, u.Email, u.FullName, subject, body)
 
 	saveLogin(w, r, ps, false, u, nil)
 }
@@ -421,6 +690,12 @@ func accountRecoverHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	// A reset link alone does not get past two-factor
+	if !getRequestContext(r).twoFactor &&
+		!checkLoginTwoFactor(w, r, ps, &currentUser) {
+		return
+	}
+
 	// Try to generate new password
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password),
 		bcrypt.DefaultCost)
@@ -439,9 +714,233 @@ func accountRecoverHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	// Whoever knew the old password is signed out
+	revokeUserSessions(currentUser.ID)
+
 	saveLogin(w, r, ps, true, &currentUser, nil)
 }
 
+func accountUnlockHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	confirm, of := CheckLengthForm("", r, "confirm",
+		TokenMinMax, TokenMinMax)
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
+		return
+	}
+
+	// The link only works while the account is locked
+	var currentUser User
+	if dbConn.First(&currentUser,
+		"unlock_token = ?", confirm).RecordNotFound() {
+		formatReturn(w, r, ps, ErrorCodeUnlockTokenInvalid, false, nil)
+		return
+	}
+	if locked, _ := loginLocked(&currentUser); !locked {
+		formatReturn(w, r, ps, ErrorCodeUnlockTokenInvalid, false, nil)
+		return
+	}
+
+	if unlockUser(&currentUser) != nil {
+		formatReturn(w, r, ps, ErrorCodeUnlockTokenInvalid, false, nil)
+		return
+	}
+
+	formatReturn(w, r, ps, ErrorCodeNone, false, nil)
+}
+
+func accountRefreshHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params) {
+	refresh, of := CheckLengthForm("", r, "refresh_token",
+		TokenMinMax, TokenMinMax)
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, false, nil)
+		return
+	}
+
+	u, tokens, ec := refreshSession(r, refresh)
+	if ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, false, nil)
+		return
+	}
+
+	saveLogin(w, r, ps, false, u, tokens)
+}
+
+func accountLogoutHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	// Tokens from before sessions just run out
+	if sid := getRequestContext(r).session; sid != 0 &&
+		revokeSession(sid) != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+
+	formatReturn(w, r, ps, ErrorCodeNone, false, nil)
+}
+
+func accountLogoutAllHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	if revokeUserSessions(u.ID) != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+
+	formatReturn(w, r, ps, ErrorCodeNone, false, nil)
+}
+
+func accountTwoFactorHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	saveLogin(w, r, ps, false, u, map[string]interface{}{
+		"two_factor_enabled":  u.TotpEnabled,
+		"two_factor_required": twoFactorRequired(u),
+		"recovery_codes_left": recoveryCodesLeft(u),
+	})
+}
+
+func accountTwoFactorSetupHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	if u.TotpEnabled {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorEnabled, true, nil)
+		return
+	}
+
+	// Pending until confirmed with a first code
+	secret := newTotpSecret()
+	u.TotpSecretEncrypted = encField(secret)
+	u.TotpLastStep = 0
+	if dbConn.Save(u).Error != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+
+	account := u.Email
+	if account == "" {
+		account = u.PhoneNumber
+	}
+	saveLogin(w, r, ps, false, u, map[string]interface{}{
+		"secret": secret,
+		"uri":    totpUri(account, secret),
+	})
+}
+
+func accountTwoFactorEnableHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	otp, of := CheckLengthForm("", r, "otp", totpDigits, totpDigits)
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, true, nil)
+		return
+	}
+
+	if u.TotpEnabled {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorEnabled, true, nil)
+		return
+	}
+	if u.TotpSecretEncrypted == "" {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorNotEnabled, true, nil)
+		return
+	}
+	if !useTotpCode(u, otp) {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorInvalid, true, nil)
+		return
+	}
+
+	u.TotpEnabled = true
+	if dbConn.Save(u).Error != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+	codes, err := newRecoveryCodes(u.ID)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+
+	// This session proved the factor, any other one has to log in again
+	sid := getRequestContext(r).session
+	verifySession(sid)
+	revokeOtherSessions(u.ID, sid)
+
+	saveLogin(w, r, ps, false, u,
+		map[string]interface{}{"recovery_codes": codes})
+}
+
+func accountTwoFactorDisableHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	password, of := CheckLengthForm("", r, "password",
+		PasswordMinMax, PasswordMinMax)
+	otp, of := CheckFieldForm(of, r, "otp")
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, true, nil)
+		return
+	}
+
+	if twoFactorRequired(u) {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorMandatory, true, nil)
+		return
+	}
+	if !u.TotpEnabled {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorNotEnabled, true, nil)
+		return
+	}
+
+	// Both factors are needed to remove one
+	mismatch := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash),
+		[]byte(password))
+	if mismatch != nil {
+		formatReturn(w, r, ps, ErrorCodeBadPassword, true, nil)
+		return
+	}
+	if !verifyTwoFactor(u, otp) {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorInvalid, true, nil)
+		return
+	}
+
+	u.TotpEnabled = false
+	u.TotpSecretEncrypted = ""
+	u.TotpLastStep = 0
+	if dbConn.Save(u).Error != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+	dbConn.Exec(`DELETE FROM "recovery_codes" WHERE "user_id" = ?`, u.ID)
+
+	saveLogin(w, r, ps, false, u, nil)
+}
+
+func accountRecoveryCodesHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	otp, of := CheckFieldForm("", r, "otp")
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, true, nil)
+		return
+	}
+
+	if !u.TotpEnabled {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorNotEnabled, true, nil)
+		return
+	}
+	if !verifyTwoFactor(u, otp) {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorInvalid, true, nil)
+		return
+	}
+
+	// Old codes stop working
+	codes, err := newRecoveryCodes(u.ID)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+
+	saveLogin(w, r, ps, false, u,
+		map[string]interface{}{"recovery_codes": codes})
+}
+
 func accountForgetHandler(w http.ResponseWriter, r *http.Request,
 	ps httprouter.Params) {
 	email, of := CheckEmailForm("", r, "email")
@@ -471,13 +970,13 @@ func accountForgetHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Now send reset email non-blocking
-	reqLang := ps[len(ps)-2].Value
+	reqLang := requestLang(r)
 	author := EmailTexts[reqLang][EmailTextName]
 	subject := EmailTexts[reqLang][EmailTextSubjectForgetPassword]
 	link := fmt.Sprintf(emailForgetLink, serverDomain, passwordToken)
 	body := fmt.Sprintf(EmailTexts[reqLang][EmailTextBodyForgetPassword],
 		currentUser.FullName, link)
-	go sendMail(author, email, currentUser.FullName, subject, body)
+	sendMailBackground(author, email, currentUser.FullName, subject, body)
 
 	// Not logged in
 	formatReturn(w, r, ps, ErrorCodeNone, false, nil)
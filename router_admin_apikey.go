@@ -0,0 +1,117 @@
+// Router branch for /admin/api_key/ operations
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func adminApiKeysHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	var ks []ApiKey
+	if dbConn.Order("id desc").Find(&ks).Error != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+
+	now := time.Now()
+	keys := []map[string]interface{}{}
+	for i := range ks {
+		keys = append(keys, apiKeyInfo(&ks[i], now))
+	}
+	saveAdmin(w, r, ps, u, map[string]interface{}{"api_keys": keys})
+}
+
+func adminApiKeyAddHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	name, of := CheckFieldForm("", r, "name")
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, true, nil)
+		return
+	}
+	scopes, ok := parseScopes(r.FormValue("scopes"))
+	if !ok {
+		formatReturn(w, r, ps, ErrorCodeApiKeyScopeError, true, nil)
+		return
+	}
+
+	// Optional expiry as a unix time, keys without one never expire
+	var expiresAt *time.Time
+	if r.FormValue("expires_at") != "" {
+		exp, ok := CheckRange(true, r.FormValue("expires_at"), TimeMax)
+		t := time.Unix(int64(exp), 0)
+		if !ok || !t.After(time.Now()) {
+			formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, "expires_at",
+				true, nil)
+			return
+		}
+		expiresAt = &t
+	}
+
+	k, key, err := createApiKey(name, scopes, expiresAt, u.ID)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	serverLog.Info("api key created by admin", LogFields{
+		"request_id": requestId(r), "api_key_id": k.ID, "name": k.Name,
+		"scopes": k.Scopes, "admin_id": u.ID})
+
+	ie := apiKeyInfo(k, time.Now())
+	ie["key"] = key
+	saveAdmin(w, r, ps, u, ie)
+}
+
+func adminApiKeyRotateHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeApiKeyUnknown, true, nil)
+		return
+	}
+
+	var old ApiKey
+	if dbConn.First(&old, id).RecordNotFound() ||
+		!apiKeyActive(&old, time.Now()) {
+		formatReturn(w, r, ps, ErrorCodeApiKeyUnknown, true, nil)
+		return
+	}
+
+	k, key, err := rotateApiKey(&old, u.ID)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	serverLog.Info("api key rotated by admin", LogFields{
+		"request_id": requestId(r), "api_key_id": k.ID,
+		"old_api_key_id": old.ID, "admin_id": u.ID})
+
+	ie := apiKeyInfo(k, time.Now())
+	ie["key"] = key
+	saveAdmin(w, r, ps, u, ie)
+}
+
+func adminApiKeyDeleteHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeApiKeyUnknown, true, nil)
+		return
+	}
+
+	revoked, err := revokeApiKey(uint(id))
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	if !revoked {
+		formatReturn(w, r, ps, ErrorCodeApiKeyUnknown, true, nil)
+		return
+	}
+	serverLog.Info("api key revoked by admin", LogFields{
+		"request_id": requestId(r), "api_key_id": id, "admin_id": u.ID})
+
+	saveAdmin(w, r, ps, u, nil)
+}
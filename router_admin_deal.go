@@ -1350,7 +1350,7 @@ func adminDealBuyUpdateHandler(w http.ResponseWriter, r *http.Request,
 			EmailTexts[user.
 				LastLanguage][EmailTextBodyWireTransferAccount],
 			user.FullName, name, formatRoman(deal.FundNum))
-		go sendMail(author, user.Email, user.FullName, subject, body)
+		sendMailBackground(author, user.Email, user.FullName, subject, body)
 	}
 
 	// Save bank info - separate from above
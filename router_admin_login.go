@@ -0,0 +1,47 @@
+// Router branch for /admin/login_method operations
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+func adminLoginMethodsHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	settings, err := loginMethodSettings()
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	saveAdmin(w, r, ps, u, map[string]interface{}{"login_methods": settings})
+}
+
+func adminLoginMethodUpdateHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	roleType, of := CheckRangeForm("", r, "role_type", RoleTypeInvestor)
+	method, of := CheckFieldForm(of, r, "method")
+	enabled, of := CheckRangeForm(of, r, "enabled", 1)
+	if of == "" && !loginMethodKnown(method) {
+		of = "method"
+	}
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, true, nil)
+		return
+	}
+
+	if setLoginMethod(roleType, method, enabled == 1, u.ID) != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	serverLog.Info("login method set by admin", LogFields{
+		"request_id": requestId(r), "role_type": roleType, "method": method,
+		"enabled": enabled == 1, "admin_id": u.ID})
+
+	settings, err := loginMethodSettings()
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	saveAdmin(w, r, ps, u, map[string]interface{}{"login_methods": settings})
+}
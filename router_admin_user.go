@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"time"
 )
 
 func adminUsersHandler(w http.ResponseWriter, r *http.Request,
@@ -78,6 +79,23 @@ func adminUserIdHandler(w http.ResponseWriter, r *http.Request,
 		}
 	}
 
+	// Lockout is only reported while in effect
+	var lockedUntil int64
+	if locked, _ := loginLocked(&user); locked {
+		lockedUntil = user.LockedUntil.Unix()
+	}
+
+	sessions, err := userSessions(user.ID, 0)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+
 	// Return all allowed information about user
 	saveAdmin(w, r, ps, u, map[string]interface{}{
 		"user_state":                  user.UserState,
@@ -120,6 +138,11 @@ func adminUserIdHandler(w http.ResponseWriter, r *http.Request,
 		"work_with_financial_advisors": user.WorkWithFinancialAdvisors,
 		"investor_type":                user.InvestorType,
 		"investor_situation":           user.InvestorSituation,
+		"failed_login_count":           user.FailedLoginCount,
+		"locked_until":                 lockedUntil,
+		"two_factor_enabled":           user.TotpEnabled,
+		"sessions":                     sessions,
+		"roles":                        roles,
 	})
 }
 
@@ -145,11 +168,14 @@ func adminUserUpdateHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	// Change user-specific states
+	// Change user-specific states, admin access follows the roles set with
+	// PUT /admin/user/:id/roles and is not changed here
 	userLevel, ok := CheckRange(true, r.FormValue("user_level"),
 		UserLevelAdmin)
-	if ok {
-		user.UserLevel = userLevel
+	if ok && userLevel != user.UserLevel {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, "user_level",
+			true, nil)
+		return
 	}
 	roleType, ok := CheckRange(true, r.FormValue("role_type"),
 		RoleTypeInvestor)
@@ -215,12 +241,58 @@ func adminUserUpdateHandler(w http.ResponseWriter, r *http.Request,
 		user.InvestorSituation = investorSituation
 	}
 
+	// Clear a login lockout
+	unlock, ok := CheckRange(true, r.FormValue("unlock"), 1)
+	if ok && unlock == 1 {
+		user.FailedLoginCount = 0
+		user.UnlockToken = ""
+		user.LockedUntil = time.Time{}
+	}
+
+	// Remove a lost authenticator, the user enrolls again on next login.
+	// Only those granting roles can do so for admins.
+	resetTwoFactor, ok := CheckRange(true, r.FormValue("reset_two_factor"), 1)
+	if ok && resetTwoFactor == 1 {
+		roles, err := userRoles(user.ID)
+		if err != nil {
+			formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+			return
+		}
+		if (len(roles) > 0 || user.UserLevel == UserLevelAdmin) &&
+			!hasPermission(r, PermRolesManage) {
+			formatReturn(w, r, ps, ErrorCodeNoPermission, true, nil)
+			return
+		}
+		user.TotpEnabled = false
+		user.TotpSecretEncrypted = ""
+		user.TotpLastStep = 0
+	}
+
 	// Save however many changed
 	if dbConn.Save(&user).Error != nil {
 		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
 		return
 	}
 
+	if resetTwoFactor == 1 {
+		dbConn.Exec(`DELETE FROM "recovery_codes" WHERE "user_id" = ?`,
+			user.ID)
+	}
+
+	// Sign out every session on request, when banning and when the
+	// authenticator is reset
+	logout, ok := CheckRange(true, r.FormValue("logout"), 1)
+	if (ok && logout == 1) || user.UserState == UserStateBanned ||
+		resetTwoFactor == 1 {
+		if revokeUserSessions(user.ID) != nil {
+			formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+			return
+		}
+		serverLog.Info("user signed out by admin", LogFields{
+			"request_id": requestId(r), "user_id": user.ID,
+			"admin_id": u.ID})
+	}
+
 	// Send approval notification if necessary
 	if ua {
 		// Notify user of the account information
@@ -249,7 +321,7 @@ func adminUserUpdateHandler(w http.ResponseWriter, r *http.Request,
 		}
 
 		author := EmailTexts[user.LastLanguage][EmailTextName]
-		go sendMail(author, user.Email, user.FullName, subject, body)
+		sendMailBackground(author, user.Email, user.FullName, subject, body)
 	}
 
 	// Make sure we refresh current state
@@ -349,3 +421,83 @@ func adminUserDeleteHandler(w http.ResponseWriter, r *http.Request,
 	// Success
 	saveAdmin(w, r, ps, u, nil)
 }
+
+func adminRolesHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	saveAdmin(w, r, ps, u, map[string]interface{}{"roles": Roles})
+}
+
+func adminUserRolesHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	uid, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeUserUnknown, true, nil)
+		return
+	}
+
+	var user User
+	if dbConn.First(&user, uid).RecordNotFound() {
+		formatReturn(w, r, ps, ErrorCodeUserUnknown, true, nil)
+		return
+	}
+
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	saveAdmin(w, r, ps, u, map[string]interface{}{"roles": roles})
+}
+
+func adminUserRolesUpdateHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	uid, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeUserUnknown, true, nil)
+		return
+	}
+
+	var user User
+	if dbConn.First(&user, uid).RecordNotFound() {
+		formatReturn(w, r, ps, ErrorCodeUserUnknown, true, nil)
+		return
+	}
+
+	// Comma separated role names, empty removes admin access
+	roles, ok := parseRoles(r.FormValue("roles"))
+	if !ok {
+		formatReturn(w, r, ps, ErrorCodeRoleUnknown, true, nil)
+		return
+	}
+
+	// Someone must be left to grant roles
+	super := false
+	for _, role := range roles {
+		super = super || role == RoleSuperAdmin
+	}
+	if !super {
+		n, err := otherSuperAdmins(user.ID)
+		if err != nil {
+			formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+			return
+		}
+		if n == 0 {
+			formatReturn(w, r, ps, ErrorCodeRoleLastSuperAdmin, true, nil)
+			return
+		}
+	}
+
+	if setUserRoles(user.ID, roles, u.ID) != nil {
+		formatReturn(w, r, ps, ErrorCodeAdminError, true, nil)
+		return
+	}
+	serverLog.Info("user roles changed by admin", LogFields{
+		"request_id": requestId(r), "user_id": user.ID, "admin_id": u.ID,
+		"roles": roles})
+
+	// Make sure we refresh current state
+	if u.ID == user.ID {
+		dbConn.First(u, u.ID)
+	}
+	saveAdmin(w, r, ps, u, map[string]interface{}{"roles": roles})
+}
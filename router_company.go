@@ -104,7 +104,7 @@ func companyIdHandler(w http.ResponseWriter, r *http.Request,
 	sort.Sort(CompanyUpdateSort(updates))
 
 	// Process language-specific returns
-	reqLang := ps[len(ps)-2].Value
+	reqLang := requestLang(r)
 	var desc, tagss string
 	if reqLang == "zh-CN" {
 		desc = c.DescriptionCn
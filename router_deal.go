@@ -40,7 +40,7 @@ func dealsHandler(w http.ResponseWriter, r *http.Request,
 	dbConn.Find(&closedDeals, "deal_state = ?", DealStateClosed)
 
 	// Read language once
-	reqLang := ps[len(ps)-2].Value
+	reqLang := requestLang(r)
 	var processDeals = func(deals []Deal) []map[string]interface{} {
 		ds := []map[string]interface{}{}
 		for _, d := range deals {
@@ -273,8 +273,8 @@ func dealSellEngagementLetterSignHandler(w http.ResponseWriter,
 		if u.Address2 != "" {
 			address += " " + u.Address2
 		}
-		reqLang := ps[len(ps)-2].Value
-		eid, et, err := serverDocusign.CreateEnvelopeWithTemplate(
+		reqLang := requestLang(r)
+		eid, et, err := serverDocusign.forRequest(r).CreateEnvelopeWithTemplate(
 			docusignSellEngagementLetter,
 			"client", uid, SignTexts[reqLang][SignSellEngagementLetter],
 			u.Email, u.FullName,
@@ -299,7 +299,7 @@ func dealSellEngagementLetterSignHandler(w http.ResponseWriter,
 	}
 
 	// Now create embedded url
-	url, err := serverDocusign.CreateEmbeddedRecipientUrl(r.Host,
+	url, err := serverDocusign.forRequest(r).CreateEmbeddedRecipientUrl(r.Host,
 		envId, uid, u.Email, u.FullName)
 	if err != nil {
 		formatReturn(w, r, ps, ErrorCodeDealDocusignRecipientError,
@@ -400,7 +400,8 @@ func dealSellEngagementLetterCheckHandler(w http.ResponseWriter,
 
 	// Check if document is completed
 	eid := dsh.EngagementLetterSignId
-	completed, terminal, err := serverDocusign.GetEnvelopeStatus(eid)
+	completed, terminal, err :=
+		serverDocusign.forRequest(r).GetEnvelopeStatus(eid)
 	if err != nil || !terminal {
 		dsh.EngagementLetterSignCheck = time.Now().Add(docusignStatusDelay)
 	} else {
@@ -424,7 +425,7 @@ func dealSellEngagementLetterCheckHandler(w http.ResponseWriter,
 	// Download file and save
 	pifc := path.Join(dataDir, "deal", fmt.Sprintf("%v", d.ID),
 		fmt.Sprintf("%v", u.ID), "sell_engagement_letter")
-	err = serverDocusign.DownloadEnvelopeDocument(eid, pifc)
+	err = serverDocusign.forRequest(r).DownloadEnvelopeDocument(eid, pifc)
 	if err != nil {
 		// Must save state on leave
 		if dbConn.Save(dsh).Error != nil {
@@ -1187,8 +1188,8 @@ func dealBuyEngagementLetterSignHandler(w http.ResponseWriter,
 		if u.Address2 != "" {
 			address += " " + u.Address2
 		}
-		reqLang := ps[len(ps)-2].Value
-		eid, et, err := serverDocusign.CreateEnvelopeWithTemplate(
+		reqLang := requestLang(r)
+		eid, et, err := serverDocusign.forRequest(r).CreateEnvelopeWithTemplate(
 			docusignBuyEngagementLetter,
 			"client", uid, SignTexts[reqLang][SignBuyEngagementLetter],
 			u.Email, u.FullName,
@@ -1213,7 +1214,7 @@ func dealBuyEngagementLetterSignHandler(w http.ResponseWriter,
 	}
 
 	// Now create embedded url
-	url, err := serverDocusign.CreateEmbeddedRecipientUrl(r.Host,
+	url, err := serverDocusign.forRequest(r).CreateEmbeddedRecipientUrl(r.Host,
 		envId, uid, u.Email, u.FullName)
 	if err != nil {
 		formatReturn(w, r, ps, ErrorCodeDealDocusignRecipientError,
@@ -1312,7 +1313,8 @@ func dealBuyEngagementLetterCheckHandler(w http.ResponseWriter,
 
 	// Check if document is completed
 	eid := di.EngagementLetterSignId
-	completed, terminal, err := serverDocusign.GetEnvelopeStatus(eid)
+	completed, terminal, err :=
+		serverDocusign.forRequest(r).GetEnvelopeStatus(eid)
 	if err != nil || !terminal {
 		di.EngagementLetterSignCheck = time.Now().Add(docusignStatusDelay)
 	} else {
@@ -1336,7 +1338,7 @@ func dealBuyEngagementLetterCheckHandler(w http.ResponseWriter,
 	// Download file and save
 	pifc := path.Join(dataDir, "deal", fmt.Sprintf("%v", d.ID),
 		fmt.Sprintf("%v", u.ID), "buy_engagement_letter")
-	err = serverDocusign.DownloadEnvelopeDocument(eid, pifc)
+	err = serverDocusign.forRequest(r).DownloadEnvelopeDocument(eid, pifc)
 	if err != nil {
 		// Must save state on leave
 		if dbConn.Save(di).Error != nil {
@@ -1531,7 +1533,7 @@ func dealBuyHandler(w http.ResponseWriter, r *http.Request,
 
 	// Check if wire information can be displayed
 	if di.DealInvestorState >= DealInvestorStateWaitingFundTransfer {
-		reqLang := ps[len(ps)-2].Value
+		reqLang := requestLang(r)
 		if reqLang == "zh-CN" {
 			args["wire"] = d.EscrowAccountCn
 		} else {
@@ -1688,8 +1690,8 @@ func dealBuySummaryTermsSignHandler(w http.ResponseWriter, r *http.Request,
 			formatReturn(w, r, ps, ErrorCodeDealDocusignError, true, nil)
 			return
 		}
-		reqLang := ps[len(ps)-2].Value
-		eid, et, err := serverDocusign.CreateEnvelopeWithTemplate(
+		reqLang := requestLang(r)
+		eid, et, err := serverDocusign.forRequest(r).CreateEnvelopeWithTemplate(
 			docusignBuySummaryOfTerms,
 			"client", uid, SignTexts[reqLang][SignBuySummaryOfTerms],
 			u.Email, u.FullName,
@@ -1716,7 +1718,7 @@ func dealBuySummaryTermsSignHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Now create embedded url
-	url, err := serverDocusign.CreateEmbeddedRecipientUrl(r.Host,
+	url, err := serverDocusign.forRequest(r).CreateEmbeddedRecipientUrl(r.Host,
 		envId, uid, u.Email, u.FullName)
 	if err != nil {
 		formatReturn(w, r, ps, ErrorCodeDealDocusignRecipientError,
@@ -1783,7 +1785,8 @@ func dealBuySummaryTermsCheckHandler(w http.ResponseWriter, r *http.Request,
 
 	// Check if document is completed
 	eid := di.SummaryOfTermsSignId
-	completed, terminal, err := serverDocusign.GetEnvelopeStatus(eid)
+	completed, terminal, err :=
+		serverDocusign.forRequest(r).GetEnvelopeStatus(eid)
 	if err != nil || !terminal {
 		di.SummaryOfTermsSignCheck = time.Now().Add(docusignStatusDelay)
 	} else {
@@ -1807,7 +1810,7 @@ func dealBuySummaryTermsCheckHandler(w http.ResponseWriter, r *http.Request,
 	// Download file and save
 	pifc := path.Join(dataDir, "deal", fmt.Sprintf("%v", d.ID),
 		fmt.Sprintf("%v", u.ID), "summary_of_terms")
-	err = serverDocusign.DownloadEnvelopeDocument(eid, pifc)
+	err = serverDocusign.forRequest(r).DownloadEnvelopeDocument(eid, pifc)
 	if err != nil {
 		// Must save state on leave
 		if dbConn.Save(di).Error != nil {
@@ -1940,8 +1943,8 @@ func dealBuyDePpmSignHandler(w http.ResponseWriter, r *http.Request,
 			formatReturn(w, r, ps, ErrorCodeDealDocusignError, true, nil)
 			return
 		}
-		reqLang := ps[len(ps)-2].Value
-		eid, et, err := serverDocusign.CreateEnvelopeWithTemplate(
+		reqLang := requestLang(r)
+		eid, et, err := serverDocusign.forRequest(r).CreateEnvelopeWithTemplate(
 			docusignBuyDePpm,
 			"client", uid, SignTexts[reqLang][SignBuyDePpm],
 			u.Email, u.FullName,
@@ -1970,7 +1973,7 @@ func dealBuyDePpmSignHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Now create embedded url
-	url, err := serverDocusign.CreateEmbeddedRecipientUrl(r.Host,
+	url, err := serverDocusign.forRequest(r).CreateEmbeddedRecipientUrl(r.Host,
 		envId, uid, u.Email, u.FullName)
 	if err != nil {
 		formatReturn(w, r, ps, ErrorCodeDealDocusignRecipientError,
@@ -2037,7 +2040,8 @@ func dealBuyDePpmCheckHandler(w http.ResponseWriter, r *http.Request,
 
 	// Check if document is completed
 	eid := di.DePpmSignId
-	completed, terminal, err := serverDocusign.GetEnvelopeStatus(eid)
+	completed, terminal, err :=
+		serverDocusign.forRequest(r).GetEnvelopeStatus(eid)
 	if err != nil || !terminal {
 		di.DePpmSignCheck = time.Now().Add(docusignStatusDelay)
 	} else {
@@ -2061,7 +2065,7 @@ func dealBuyDePpmCheckHandler(w http.ResponseWriter, r *http.Request,
 	// Download file and save
 	pifc := path.Join(dataDir, "deal", fmt.Sprintf("%v", d.ID),
 		fmt.Sprintf("%v", u.ID), "de_ppm")
-	err = serverDocusign.DownloadEnvelopeDocument(eid, pifc)
+	err = serverDocusign.forRequest(r).DownloadEnvelopeDocument(eid, pifc)
 	if err != nil {
 		// Must save state on leave
 		if dbConn.Save(di).Error != nil {
@@ -2115,8 +2119,8 @@ func dealBuyDeOperatingSignHandler(w http.ResponseWriter, r *http.Request,
 			formatReturn(w, r, ps, ErrorCodeDealDocusignError, true, nil)
 			return
 		}
-		reqLang := ps[len(ps)-2].Value
-		eid, et, err := serverDocusign.CreateEnvelopeWithTemplate(
+		reqLang := requestLang(r)
+		eid, et, err := serverDocusign.forRequest(r).CreateEnvelopeWithTemplate(
 			docusignBuyDeOperatingAgreement,
 			"client", uid, SignTexts[reqLang][SignBuyDeOperatingAgreement],
 			u.Email, u.FullName,
@@ -2143,7 +2147,7 @@ func dealBuyDeOperatingSignHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Now create embedded url
-	url, err := serverDocusign.CreateEmbeddedRecipientUrl(r.Host,
+	url, err := serverDocusign.forRequest(r).CreateEmbeddedRecipientUrl(r.Host,
 		envId, uid, u.Email, u.FullName)
 	if err != nil {
 		formatReturn(w, r, ps, ErrorCodeDealDocusignRecipientError,
@@ -2210,7 +2214,8 @@ func dealBuyDeOperatingCheckHandler(w http.ResponseWriter, r *http.Request,
 
 	// Check if document is completed
 	eid := di.DeOperatingAgreementSignId
-	completed, terminal, err := serverDocusign.GetEnvelopeStatus(eid)
+	completed, terminal, err :=
+		serverDocusign.forRequest(r).GetEnvelopeStatus(eid)
 	if err != nil || !terminal {
 		di.DeOperatingAgreementSignCheck = time.Now().Add(docusignStatusDelay)
 	} else {
@@ -2234,7 +2239,7 @@ func dealBuyDeOperatingCheckHandler(w http.ResponseWriter, r *http.Request,
 	// Download file and save
 	pifc := path.Join(dataDir, "deal", fmt.Sprintf("%v", d.ID),
 		fmt.Sprintf("%v", u.ID), "de_operating_agreement")
-	err = serverDocusign.DownloadEnvelopeDocument(eid, pifc)
+	err = serverDocusign.forRequest(r).DownloadEnvelopeDocument(eid, pifc)
 	if err != nil {
 		// Must save state on leave
 		if dbConn.Save(di).Error != nil {
@@ -2296,8 +2301,8 @@ func dealBuyDeSubscriptionSignHandler(w http.ResponseWriter, r *http.Request,
 		amountp := di.SharesBuyAmount
 		amounte := uint64(float64(amountp) * 0.05)
 		amountt := amountp + amounte
-		reqLang := ps[len(ps)-2].Value
-		eid, et, err := serverDocusign.CreateEnvelopeWithTemplate(
+		reqLang := requestLang(r)
+		eid, et, err := serverDocusign.forRequest(r).CreateEnvelopeWithTemplate(
 			docusignBuyDeSubscriptionAgreement,
 			"client", uid, SignTexts[reqLang][SignBuyDeSubscriptionAgreement],
 			u.Email, u.FullName,
@@ -2328,7 +2333,7 @@ func dealBuyDeSubscriptionSignHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Now create embedded url
-	url, err := serverDocusign.CreateEmbeddedRecipientUrl(r.Host,
+	url, err := serverDocusign.forRequest(r).CreateEmbeddedRecipientUrl(r.Host,
 		envId, uid, u.Email, u.FullName)
 	if err != nil {
 		formatReturn(w, r, ps, ErrorCodeDealDocusignRecipientError,
@@ -2395,7 +2400,8 @@ func dealBuyDeSubscriptionCheckHandler(w http.ResponseWriter, r *http.Request,
 
 	// Check if document is completed
 	eid := di.DeSubscriptionAgreementSignId
-	completed, terminal, err := serverDocusign.GetEnvelopeStatus(eid)
+	completed, terminal, err :=
+		serverDocusign.forRequest(r).GetEnvelopeStatus(eid)
 	if err != nil || !terminal {
 		di.DeSubscriptionAgreementSignCheck =
 			time.Now().Add(docusignStatusDelay)
@@ -2420,7 +2426,7 @@ func dealBuyDeSubscriptionCheckHandler(w http.ResponseWriter, r *http.Request,
 	// Download file and save
 	pifc := path.Join(dataDir, "deal", fmt.Sprintf("%v", d.ID),
 		fmt.Sprintf("%v", u.ID), "de_subscription_agreement")
-	err = serverDocusign.DownloadEnvelopeDocument(eid, pifc)
+	err = serverDocusign.forRequest(r).DownloadEnvelopeDocument(eid, pifc)
 	if err != nil {
 		// Must save state on leave
 		if dbConn.Save(di).Error != nil {
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/crypto/bcrypt"
@@ -189,7 +190,13 @@ func userKycFieldCheck(r *http.Request, u *User,
 		allof = of
 	}
 
-	phoneNumber, of := CheckLengthForm("", r, "phone_number", PhoneMin, PhoneMax)
+	phoneNumber, of := CheckPhoneForm("", r, "phone_number")
+	// Numbers are unique, one taken by another user is refused
+	if of == "" && phoneNumber != u.PhoneNumber &&
+		!dbConn.First(&User{}, "phone_number = ?",
+			phoneNumber).RecordNotFound() {
+		of = "phone_number"
+	}
 	if of == "" {
 		u.PhoneNumber = phoneNumber
 	} else if allof == "" {
@@ -365,8 +372,8 @@ func userKycHandler(w http.ResponseWriter, r *http.Request,
 
 	message := fmt.Sprintf(registerConfirmEmailTemplate, u.FirstName, u.LastName, u.Email, u.PhoneNumber)
 
-	go sendMail(supportEmailUsername, supportEmail, supportEmailUsername, "New Request Access on themarketx.com", message)
-	go sendMail(supportEmailUsername, "han.lai@themarketx.com", supportEmailUsername, "New Request Access on themarketx.com", message)
+	sendMailBackground(supportEmailUsername, supportEmail, supportEmailUsername, "New Request Access on themarketx.com", message)
+	sendMailBackground(supportEmailUsername, "han.lai@themarketx.com", supportEmailUsername, "New Request Access on themarketx.com", message)
 	saveLogin(w, r, ps, false, u, nil)
 }
 
@@ -395,7 +402,7 @@ func userKycQuestionsHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Step 1: setup investor record
-	err := serverTransact.CreateInvestorRecord(kycUser)
+	err := serverTransact.forRequest(r).CreateInvestorRecord(kycUser)
 	if err != nil {
 		ec := ErrorCodeKycRecordError
 		// Ineligible for kyc (hard fail, should be more specific)
@@ -407,7 +414,7 @@ func userKycQuestionsHandler(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Step 2: setup investor account: get questions!
-	ques, err := serverTransact.CreateInvestorAccount(kycUser)
+	ques, err := serverTransact.forRequest(r).CreateInvestorAccount(kycUser)
 	if err != nil {
 		ec := ErrorCodeKycAccountError
 		// Ineligible for kyc (hard fail, should be more specific)
@@ -479,7 +486,7 @@ func userKycCheckHandler(w http.ResponseWriter, r *http.Request,
 
 	var fail ErrorCode = ErrorCodeNone
 	// Check KYC questions
-	err := serverTransact.KycStatus(u, ans)
+	err := serverTransact.forRequest(r).KycStatus(u, ans)
 	if err != nil {
 		fail = ErrorCodeKycCheckQuestions
 	}
@@ -961,3 +968,145 @@ func userBuysHandler(w http.ResponseWriter, r *http.Request,
 
 	saveLogin(w, r, ps, false, u, map[string]interface{}{"buys": buys})
 }
+
+func userSessionsHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	sessions, err := userSessions(u.ID, getRequestContext(r).session)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+
+	saveLogin(w, r, ps, false, u,
+		map[string]interface{}{"sessions": sessions})
+}
+
+func userSessionRevokeHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	sid, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil {
+		formatReturn(w, r, ps, ErrorCodeSessionUnknown, true, nil)
+		return
+	}
+
+	// Users can only sign out their own sessions
+	var s Session
+	if dbConn.First(&s, "id = ? AND user_id = ?", sid,
+		u.ID).RecordNotFound() {
+		formatReturn(w, r, ps, ErrorCodeSessionUnknown, true, nil)
+		return
+	}
+
+	if revokeSession(s.ID) != nil {
+		formatReturn(w, r, ps, ErrorCodeServerInternal, true, nil)
+		return
+	}
+
+	// Signing out the current session ends the login
+	if s.ID == getRequestContext(r).session {
+		formatReturn(w, r, ps, ErrorCodeNone, false, nil)
+		return
+	}
+	saveLogin(w, r, ps, false, u, nil)
+}
+
+func userWechatHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	formatReturn(w, r, ps, ErrorCodeNone, true, map[string]interface{}{
+		"bound":    u.WxOpenID != "",
+		"nickname": u.WxNickname,
+		"avatar":   u.WxHeadImgUrl,
+	})
+}
+
+func userWechatBindHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	// Binds or replaces the binding with the WeChat account of the code
+	p, ec := exchangeWechatCode(r)
+	if ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, true, nil)
+		return
+	}
+	if ec := bindWechat(u, p); ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, true, nil)
+		return
+	}
+	serverLog.Info("wechat bound", LogFields{"request_id": requestId(r),
+		"user_id": u.ID})
+
+	formatReturn(w, r, ps, ErrorCodeNone, true, map[string]interface{}{
+		"bound":    true,
+		"nickname": u.WxNickname,
+		"avatar":   u.WxHeadImgUrl,
+	})
+}
+
+func userWechatUnbindHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	if u.WxOpenID == "" && u.WxUnionID == "" {
+		formatReturn(w, r, ps, ErrorCodeWechatUnbound, true, nil)
+		return
+	}
+	if unbindWechat(u) != nil {
+		formatReturn(w, r, ps, ErrorCodeWechatError, true, nil)
+		return
+	}
+	serverLog.Info("wechat unbound", LogFields{"request_id": requestId(r),
+		"user_id": u.ID})
+
+	formatReturn(w, r, ps, ErrorCodeNone, true, nil)
+}
+
+func userPhoneSendCodeHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	phoneNumber, of := CheckPhoneForm("", r, "phone_number")
+	if of == "" && phoneNumber == u.PhoneNumber {
+		of = "phone_number"
+	}
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, true, nil)
+		return
+	}
+	if !dbConn.First(&User{}, "phone_number = ?",
+		phoneNumber).RecordNotFound() {
+		formatReturn(w, r, ps, ErrorCodePhoneExists, true, nil)
+		return
+	}
+
+	sendVerifyCode(w, r, ps, VerifyPurposePhoneChange, phoneNumber, true)
+}
+
+func userPhoneUpdateHandler(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) {
+	phoneNumber, of := CheckPhoneForm("", r, "phone_number")
+	code, of := CheckFieldForm(of, r, "code")
+
+	if of != "" {
+		formatReturnInfo(w, r, ps, ErrorFmtCodeBadArgument, of, true, nil)
+		return
+	}
+	if !dbConn.First(&User{}, "phone_number = ?",
+		phoneNumber).RecordNotFound() {
+		formatReturn(w, r, ps, ErrorCodePhoneExists, true, nil)
+		return
+	}
+	if ec := checkVerifyCode(VerifyPurposePhoneChange, phoneNumber, code,
+		true); ec != ErrorCodeNone {
+		formatReturn(w, r, ps, ec, true, nil)
+		return
+	}
+
+	if dbConn.Model(u).UpdateColumn("phone_number",
+		phoneNumber).Error != nil {
+		formatReturn(w, r, ps, ErrorCodeUserUpdateError, true, nil)
+		return
+	}
+	serverLog.Info("phone number changed", LogFields{
+		"request_id": requestId(r), "user_id": u.ID,
+		"to": maskPhone(phoneNumber)})
+	u.PhoneNumber = phoneNumber
+
+	formatReturn(w, r, ps, ErrorCodeNone, true,
+		map[string]interface{}{"phone_number": phoneNumber})
+}
@@ -9,10 +9,6 @@ import (
 	"time"
 )
 
-var allTables = []interface{}{&User{}, &Company{}, &CompanyExecutive{},
-	&Funding{}, &CompanyUpdate{}, &Tag{}, &Bank{}, &Offer{}, &Deal{},
-	&DealShareholder{}, &DealInvestor{}, &Wechat{}}
-
 // encField makes writing field easier by ignoring errors
 func encField(f string) string {
 	ef, err := EncryptString(aesTextSecret, f)
@@ -186,6 +182,8 @@ type User struct {
 	WxOpenID                           string `sql:"index"`
 	WxUnionID                          string `sql:"index"`
 	WxAccessToken                      string
+	WxNickname                         string
+	WxHeadImgUrl                       string
 	UserState                          uint64
 	UserLevel                          uint64
 	FirstName                          string
@@ -244,6 +242,13 @@ type User struct {
 	TransactApiKycID                   uint64
 	TransactApiKycExpire               time.Time
 	TransactApiKycAttempts             uint64
+	FailedLoginCount                   uint64
+	LockedUntil                        time.Time
+	UnlockToken                        string `sql:"index"`
+	LastUserAgent                      string
+	TotpSecretEncrypted                string
+	TotpEnabled                        bool
+	TotpLastStep                       int64
 }
 
 type Company struct {
@@ -538,3 +543,78 @@ type Wechat struct {
 	GroupID       string `sql:"index"`
 	Remark        string
 }
+
+type Session struct {
+	gorm.Model
+	UserID     uint `sql:"index"`
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+	LastUsedAt time.Time
+	IpAddress  string
+	UserAgent  string
+	TwoFactor  bool
+}
+
+type RefreshToken struct {
+	gorm.Model
+	SessionID uint   `sql:"index"`
+	TokenHash string `sql:"unique_index"`
+	UsedAt    *time.Time
+}
+
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `sql:"index"`
+	CodeHash string `sql:"index"`
+	UsedAt   *time.Time
+}
+
+type UserRole struct {
+	gorm.Model
+	UserID    uint `sql:"index"`
+	Role      string
+	GrantedBy uint
+}
+
+type ApiKey struct {
+	gorm.Model
+	Name       string
+	Prefix     string
+	KeyHash    string `sql:"unique_index"`
+	Scopes     string
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+	LastUsedAt *time.Time
+	LastUsedIp string
+	CreatedBy  uint
+}
+
+type SmsDelivery struct {
+	gorm.Model
+	Provider    string
+	PhoneNumber string `sql:"index"`
+	Template    int
+	Lang        string
+	Success     bool
+	Response    string
+	RequestId   string
+}
+
+type VerificationCode struct {
+	gorm.Model
+	Purpose   string
+	Target    string
+	CodeHash  string
+	ExpiresAt time.Time
+	Attempts  int
+	UsedAt    *time.Time
+	IpAddress string
+}
+
+type LoginMethod struct {
+	gorm.Model
+	RoleType  uint64
+	Method    string
+	Enabled   bool
+	UpdatedBy uint
+}
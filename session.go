@@ -0,0 +1,220 @@
+// Login sessions for MarketX
+// A login opens a session and returns a short-lived access jwt with a
+// refresh token. Refresh tokens are single use: each refresh replaces the
+// token with a new one of the same session, and presenting a replaced token
+// again revokes the whole session since it must have leaked. Only sha256
+// hashes of refresh tokens are stored.
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sessionSweepEvery = 1000
+	sessionTouchEvery = time.Minute
+)
+
+var sessionsCreated uint64
+
+// hashRefreshToken returns the stored form of a refresh token
+func hashRefreshToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// newRefreshToken generates a random refresh token
+func newRefreshToken() string {
+	b := make([]byte, TokenMinMax/2)
+	crand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// sessionActive checks whether s can still be used at now
+func sessionActive(s *Session, now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// signAccessToken creates the access jwt of u in session s
+func signAccessToken(u *User, s *Session) (string, error) {
+	return jwtKeys.sign(newAccessClaims(u, s, time.Now()))
+}
+
+// sessionTokens returns the login response fields of session s
+func sessionTokens(u *User, s *Session,
+	refresh string) (map[string]interface{}, error) {
+	access, err := signAccessToken(u, s)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"token":         access,
+		"refresh_token": refresh,
+		"expires_in":    int64(accessTokenDuration.Seconds()),
+	}, nil
+}
+
+// newSession opens a session for u logging in with r and returns its
+// tokens
+func newSession(r *http.Request, u *User) (map[string]interface{}, error) {
+	if atomic.AddUint64(&sessionsCreated, 1)%sessionSweepEvery == 0 {
+		sweepSessions(time.Now())
+	}
+
+	now := time.Now()
+	s := Session{UserID: u.ID, ExpiresAt: now.Add(refreshTokenDuration),
+		LastUsedAt: now, IpAddress: getIp(r), UserAgent: userAgent(r),
+		TwoFactor: getRequestContext(r).twoFactor}
+	refresh := newRefreshToken()
+	tx := dbConn.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if err := tx.Create(&s).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Create(&RefreshToken{SessionID: s.ID,
+		TokenHash: hashRefreshToken(refresh)}).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return sessionTokens(u, &s, refresh)
+}
+
+// refreshSession replaces a refresh token with a new one and returns the
+// user and new tokens of its session
+func refreshSession(r *http.Request, refresh string) (*User,
+	map[string]interface{}, ErrorCode) {
+	now := time.Now()
+	var rt RefreshToken
+	if dbConn.First(&rt, "token_hash = ?",
+		hashRefreshToken(refresh)).RecordNotFound() {
+		return nil, nil, ErrorCodeRefreshTokenInvalid
+	}
+	var s Session
+	if dbConn.First(&s, rt.SessionID).RecordNotFound() ||
+		!sessionActive(&s, now) {
+		return nil, nil, ErrorCodeRefreshTokenInvalid
+	}
+
+	// Only one caller can use a token, anyone else holds a stolen copy
+	res := dbConn.Model(&RefreshToken{}).
+		Where("id = ? AND used_at IS NULL", rt.ID).Update("used_at", now)
+	if res.Error != nil {
+		return nil, nil, ErrorCodeServerInternal
+	}
+	if res.RowsAffected == 0 {
+		serverLog.Warn("refresh token reused", LogFields{
+			"request_id": requestId(r), "user_id": s.UserID,
+			"session_id": s.ID, "ip": getIp(r)})
+		revokeSession(s.ID)
+		return nil, nil, ErrorCodeRefreshTokenInvalid
+	}
+
+	var u User
+	if dbConn.First(&u, s.UserID).RecordNotFound() {
+		return nil, nil, ErrorCodeUserUnknown
+	}
+	if u.UserState == UserStateBanned {
+		revokeSession(s.ID)
+		return nil, nil, ErrorCodeUserBanned
+	}
+
+	next := newRefreshToken()
+	if dbConn.Create(&RefreshToken{SessionID: s.ID,
+		TokenHash: hashRefreshToken(next)}).Error != nil {
+		return nil, nil, ErrorCodeServerInternal
+	}
+	s.ExpiresAt = now.Add(refreshTokenDuration)
+	s.LastUsedAt = now
+	s.IpAddress = getIp(r)
+	s.UserAgent = userAgent(r)
+	dbConn.Save(&s)
+
+	tokens, err := sessionTokens(&u, &s, next)
+	if err != nil {
+		return nil, nil, ErrorCodeJwtError
+	}
+	return &u, tokens, ErrorCodeNone
+}
+
+// checkSession makes sure the session of an access token is still open
+// and records when it was last seen, at most every sessionTouchEvery
+func checkSession(id uint) (*Session, ErrorCode) {
+	now := time.Now()
+	var s Session
+	if dbConn.First(&s, id).RecordNotFound() || !sessionActive(&s, now) {
+		return nil, ErrorCodeSessionRevoked
+	}
+	if now.Sub(s.LastUsedAt) >= sessionTouchEvery {
+		dbConn.Model(&s).UpdateColumn("last_used_at", now)
+	}
+	return &s, ErrorCodeNone
+}
+
+// userSessions returns the open sessions of a user, most recently seen
+// first, marking the current one
+func userSessions(userId, current uint) ([]map[string]interface{}, error) {
+	var ss []Session
+	if err := dbConn.Where("user_id = ? AND revoked_at IS NULL AND "+
+		"expires_at > ?", userId, time.Now()).
+		Order("last_used_at desc").Find(&ss).Error; err != nil {
+		return nil, err
+	}
+	sessions := []map[string]interface{}{}
+	for _, s := range ss {
+		sessions = append(sessions, map[string]interface{}{
+			"id":           s.ID,
+			"ip_address":   s.IpAddress,
+			"user_agent":   s.UserAgent,
+			"created_at":   unixTime(s.CreatedAt),
+			"last_seen_at": unixTime(s.LastUsedAt),
+			"expires_at":   unixTime(s.ExpiresAt),
+			"current":      s.ID == current,
+		})
+	}
+	return sessions, nil
+}
+
+// verifySession records that a session passed two-factor
+func verifySession(id uint) error {
+	return dbConn.Model(&Session{}).Where("id = ?", id).
+		UpdateColumn("two_factor", true).Error
+}
+
+// revokeSession signs out a session
+func revokeSession(id uint) error {
+	return dbConn.Model(&Session{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeUserSessions signs out every session of a user
+func revokeUserSessions(userId uint) error {
+	return dbConn.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userId).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeOtherSessions signs out every session of a user but keep
+func revokeOtherSessions(userId, keep uint) error {
+	return dbConn.Model(&Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userId,
+			keep).
+		Update("revoked_at", time.Now()).Error
+}
+
+// sweepSessions deletes sessions that expired before now with their tokens
+func sweepSessions(now time.Time) {
+	dbConn.Exec(`DELETE FROM "refresh_tokens" WHERE "session_id" IN
+		(SELECT "id" FROM "sessions" WHERE "expires_at" <= ?)`, now)
+	dbConn.Exec(`DELETE FROM "sessions" WHERE "expires_at" <= ?`, now)
+}
@@ -0,0 +1,65 @@
+// Testing for login sessions
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRefreshToken(t *testing.T) {
+	a, b := newRefreshToken(), newRefreshToken()
+	if uint64(len(a)) != TokenMinMax || a == b {
+		t.Fatalf("[Session] Bad refresh tokens %v %v\n", a, b)
+	}
+	h := hashRefreshToken(a)
+	if len(h) != 64 || h == a || h != hashRefreshToken(a) ||
+		h == hashRefreshToken(b) {
+		t.Fatalf("[Session] Bad refresh token hash %v\n", h)
+	}
+}
+
+func TestSessionActive(t *testing.T) {
+	now := time.Now()
+	s := &Session{ExpiresAt: now.Add(time.Minute)}
+	if !sessionActive(s, now) {
+		t.Fatal("[Session] Open session is not active\n")
+	}
+	if sessionActive(s, now.Add(2*time.Minute)) {
+		t.Fatal("[Session] Expired session is active\n")
+	}
+	s.RevokedAt = &now
+	if sessionActive(s, now) {
+		t.Fatal("[Session] Revoked session is active\n")
+	}
+}
+
+func TestSessionTokens(t *testing.T) {
+	defer useTestKeyring(t)()
+	u := &User{}
+	u.ID = 7
+	s := &Session{}
+	s.ID = 42
+	ie, err := sessionTokens(u, s, "refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ie["refresh_token"] != "refresh" ||
+		ie["expires_in"] != int64(accessTokenDuration.Seconds()) {
+		t.Fatalf("[Session] Bad token fields %v\n", ie)
+	}
+	token, err := jwtParser.Parse(ie["token"].(string), jwtKeys.verifyKey)
+	if err != nil || !token.Valid {
+		t.Fatalf("[Session] Access token is invalid: %v\n", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["sub"] != "7" || claims["sid"] != float64(42) {
+		t.Fatalf("[Session] Bad access token claims %v\n", claims)
+	}
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	if exp.After(time.Now().Add(accessTokenDuration)) ||
+		exp.Before(time.Now().Add(accessTokenDuration-time.Minute)) {
+		t.Fatalf("[Session] Bad access token expiry %v\n", exp)
+	}
+}
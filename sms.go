@@ -1,33 +1,280 @@
+// Text messages for MarketX
+// Messages are rendered from the per-locale SmsTexts and delivered by the
+// provider chosen with MX_SMS_PROVIDER: Alidayu, a generic http api, or the
+// log and file drivers for development and tests. Every delivery attempt is
+// recorded in sms_deliveries, without the message text.
 package main
 
 import (
 	"alidayu"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
-var s1 = rand.NewSource(time.Now().UTC().UnixNano())
-var r1 = rand.New(s1)
+const (
+	SmsProviderAlidayu = "alidayu"
+	SmsProviderHttp    = "http"
+	SmsProviderLog     = "log"
+	SmsProviderFile    = "file"
+	smsResponseMax     = 512
+)
+
+var (
+	SmsErrorParams   = errors.New("Params error")
+	SmsErrorNetwork  = errors.New("Network error")
+	SmsErrorAPI      = errors.New("API call error")
+	SmsErrorProvider = errors.New("Unknown SMS provider")
+)
 
-func send(mobile string, code string) (bool, string) {
-	alidayu.AppKey = aliDayuAppKey
-	alidayu.AppSecret = aliDayuAppSecret
-	alidayu.UseHTTP = !useSsl
-	success, resp := alidayu.SendSMS(mobile, "源投金融", "SMS_26070193",
-		fmt.Sprintf(`{"product":"MarketX","code":"%v","timeout":"15分钟"}`, code))
+var smsTimeout = 10 * time.Second
 
-	if serverLog != nil {
-		serverLog.Println("Success:", success)
-		serverLog.Println(resp)
-	} else {
-		fmt.Println("Success:", success)
-		fmt.Println(resp)
+// smsSender is replaced by the configured provider when serving
+var smsSender SMSSender = &LogSMSSender{}
+
+// SMSMessage is a text message of an SmsTexts template
+type SMSMessage struct {
+	To       string
+	Lang     string
+	Template int
+	Args     []interface{}
+	Text     string
+}
+
+// SMSSender delivers text messages, returning the provider response
+type SMSSender interface {
+	Name() string
+	Send(m *SMSMessage) (string, error)
+}
+
+// AlidayuSMSSender sends through Alidayu, which renders its own templates
+// from the message arguments
+type AlidayuSMSSender struct {
+	appKey    string
+	appSecret string
+	signName  string
+	templates map[int]string
+	useHttp   bool
+}
+
+func (s *AlidayuSMSSender) Name() string {
+	return SmsProviderAlidayu
+}
+
+// alidayuParams returns the template parameters of m for Alidayu
+func alidayuParams(m *SMSMessage) (string, error) {
+	params := map[string]string{"product": "MarketX"}
+	switch m.Template {
+	case SmsTextVerifyCode:
+		if len(m.Args) != 2 {
+			return "", SmsErrorParams
+		}
+		params["code"] = fmt.Sprintf("%v", m.Args[0])
+		params["timeout"] = fmt.Sprintf("%v分钟", m.Args[1])
+	default:
+		return "", SmsErrorParams
 	}
+	b, err := json.Marshal(params)
+	return string(b), err
+}
 
-	return success, resp
+func (s *AlidayuSMSSender) Send(m *SMSMessage) (string, error) {
+	tc, ok := s.templates[m.Template]
+	if !ok {
+		return "", SmsErrorParams
+	}
+	params, err := alidayuParams(m)
+	if err != nil {
+		return "", err
+	}
+	alidayu.AppKey = s.appKey
+	alidayu.AppSecret = s.appSecret
+	alidayu.UseHTTP = s.useHttp
+	// Alidayu takes mainland numbers without the country code
+	success, resp := alidayu.SendSMS(strings.TrimPrefix(m.To, "+86"),
+		s.signName, tc, params)
+	if !success {
+		return resp, SmsErrorAPI
+	}
+	return resp, nil
+}
+
+// HttpSMSSender posts messages to an http api, the body is a text/template
+// of the message where the json function quotes values
+type HttpSMSSender struct {
+	url         string
+	token       string
+	contentType string
+	body        *template.Template
+}
+
+// newHttpSMSSender parses the body template of an http provider
+func newHttpSMSSender(url, token, contentType,
+	body string) (*HttpSMSSender, error) {
+	t, err := template.New("sms").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	return &HttpSMSSender{url: url, token: token, contentType: contentType,
+		body: t}, nil
+}
+
+func (s *HttpSMSSender) Name() string {
+	return SmsProviderHttp
 }
 
-func generateCode() string {
-	return fmt.Sprintf("%v%v%v%v", r1.Intn(10), r1.Intn(10), r1.Intn(10), r1.Intn(10))
+func (s *HttpSMSSender) Send(m *SMSMessage) (string, error) {
+	var body bytes.Buffer
+	if err := s.body.Execute(&body, m); err != nil {
+		return "", SmsErrorParams
+	}
+	req, err := http.NewRequest("POST", s.url, &body)
+	if err != nil {
+		return "", SmsErrorParams
+	}
+	req.Header.Set("Content-Type", s.contentType)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	client := &http.Client{Timeout: smsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err.Error(), SmsErrorNetwork
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return string(b), SmsErrorAPI
+	}
+	return string(b), nil
+}
+
+// LogSMSSender writes messages to the server log instead of sending them
+type LogSMSSender struct{}
+
+func (s *LogSMSSender) Name() string {
+	return SmsProviderLog
+}
+
+func (s *LogSMSSender) Send(m *SMSMessage) (string, error) {
+	serverLog.Info("sms message", LogFields{"to": m.To, "lang": m.Lang,
+		"text": m.Text})
+	return "logged", nil
+}
+
+// FileSMSSender appends messages to a file as json lines, e.g. for tests
+// to read the codes sent
+type FileSMSSender struct {
+	path string
+	lock sync.Mutex
+}
+
+func (s *FileSMSSender) Name() string {
+	return SmsProviderFile
+}
+
+func (s *FileSMSSender) Send(m *SMSMessage) (string, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"time": time.Now().UTC().Format(time.RFC3339), "to": m.To,
+		"lang": m.Lang, "template": m.Template, "text": m.Text})
+	if err != nil {
+		return "", SmsErrorParams
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err.Error(), SmsErrorAPI
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err.Error(), SmsErrorAPI
+	}
+	return "written", nil
+}
+
+// newSMSSender creates the sender of the configured provider
+func newSMSSender(provider string) (SMSSender, error) {
+	switch provider {
+	case SmsProviderAlidayu:
+		return &AlidayuSMSSender{appKey: aliDayuAppKey,
+			appSecret: aliDayuAppSecret, signName: aliDayuSignName,
+			templates: map[int]string{
+				SmsTextVerifyCode: aliDayuVerifyTemplate},
+			useHttp: !useSsl}, nil
+	case SmsProviderHttp:
+		return newHttpSMSSender(smsHttpUrl, smsHttpToken,
+			smsHttpContentType, smsHttpBody)
+	case SmsProviderLog:
+		return &LogSMSSender{}, nil
+	case SmsProviderFile:
+		return &FileSMSSender{path: smsFile}, nil
+	}
+	return nil, SmsErrorProvider
+}
+
+// renderSms returns the text of template tpl in lang, or the default
+// language if it has no texts
+func renderSms(lang string, tpl int, args ...interface{}) string {
+	texts, ok := SmsTexts[lang]
+	if !ok {
+		texts = SmsTexts[defaultLang]
+	}
+	return fmt.Sprintf(texts[tpl], args...)
+}
+
+// maskPhone keeps the last four digits of a phone number for logging
+func maskPhone(p string) string {
+	if len(p) <= 4 {
+		return strings.Repeat("*", len(p))
+	}
+	return strings.Repeat("*", len(p)-4) + p[len(p)-4:]
+}
+
+// sendSms sends template tpl to a phone number in the language of r and
+// records the delivery
+func sendSms(r *http.Request, to string, tpl int,
+	args ...interface{}) error {
+	lang := requestLang(r)
+	m := &SMSMessage{To: to, Lang: lang, Template: tpl, Args: args,
+		Text: renderSms(lang, tpl, args...)}
+	start := time.Now()
+	resp, err := smsSender.Send(m)
+	observeOutbound("sms", smsSender.Name(), start, err)
+	if len(resp) > smsResponseMax {
+		resp = resp[:smsResponseMax]
+	}
+
+	f := LogFields{"request_id": requestId(r),
+		"provider": smsSender.Name(), "to": maskPhone(to),
+		"template": tpl, "response": resp}
+	if err != nil {
+		f["error"] = err
+		serverLog.Error("sms not sent", f)
+	} else {
+		serverLog.Info("sms sent", f)
+	}
+
+	// The delivery is kept even if the message failed
+	if dbErr := dbConn.Create(&SmsDelivery{Provider: smsSender.Name(),
+		PhoneNumber: to, Template: tpl, Lang: lang, Success: err == nil,
+		Response: resp, RequestId: requestId(r)}).Error; dbErr != nil {
+		serverLog.Warn("sms delivery not recorded",
+			LogFields{"request_id": requestId(r), "error": dbErr})
+	}
+	return err
 }
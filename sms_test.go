@@ -0,0 +1,113 @@
+// Testing for text messages
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderSms(t *testing.T) {
+	s := renderSms("zh-CN", SmsTextVerifyCode, "1234", 15)
+	if !strings.Contains(s, "1234") || !strings.Contains(s, "15分钟") {
+		t.Fatalf("[Sms] Bad zh-CN text %v\n", s)
+	}
+	s = renderSms("fr-FR", SmsTextVerifyCode, "1234", 15)
+	if s != renderSms(defaultLang, SmsTextVerifyCode, "1234", 15) {
+		t.Fatalf("[Sms] Unknown language not defaulted %v\n", s)
+	}
+	for lang, texts := range SmsTexts {
+		if len(texts) != len(SmsTexts[defaultLang]) {
+			t.Fatalf("[Sms] %v texts are incomplete\n", lang)
+		}
+	}
+}
+
+func TestAlidayuParams(t *testing.T) {
+	p, err := alidayuParams(&SMSMessage{Template: SmsTextVerifyCode,
+		Args: []interface{}{"1234", 15}})
+	if err != nil || p != `{"code":"1234","product":"MarketX","timeout":"15分钟"}` {
+		t.Fatalf("[Sms] Bad alidayu params %v: %v\n", p, err)
+	}
+	_, err = alidayuParams(&SMSMessage{Template: SmsTextVerifyCode})
+	if err != SmsErrorParams {
+		t.Fatal("[Sms] Missing alidayu params accepted\n")
+	}
+}
+
+func TestHttpSMSSender(t *testing.T) {
+	var got map[string]string
+	status := http.StatusOK
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" ||
+			r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("[Sms] Bad http headers %v\n", r.Header)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+		w.Write([]byte("queued"))
+	}))
+	defer s.Close()
+
+	hs, err := newHttpSMSSender(s.URL, "secret", "application/json",
+		`{"to": {{json .To}}, "text": {{json .Text}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &SMSMessage{To: "+8613800000000", Text: `code "1234"`}
+	if resp, err := hs.Send(m); err != nil || resp != "queued" {
+		t.Fatalf("[Sms] Http send failed %v: %v\n", resp, err)
+	}
+	if got["to"] != m.To || got["text"] != m.Text {
+		t.Fatalf("[Sms] Bad http body %v\n", got)
+	}
+	status = http.StatusBadRequest
+	if _, err := hs.Send(m); err != SmsErrorAPI {
+		t.Fatalf("[Sms] Http error not reported: %v\n", err)
+	}
+	if _, err := newHttpSMSSender(s.URL, "", "", "{{"); err == nil {
+		t.Fatal("[Sms] Bad body template accepted\n")
+	}
+}
+
+func TestFileSMSSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := &FileSMSSender{path: filepath.Join(dir, "sms.log")}
+	for _, to := range []string{"13800000000", "13900000000"} {
+		if _, err := fs.Send(&SMSMessage{To: to, Text: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := ioutil.ReadFile(fs.path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var m map[string]interface{}
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &m) != nil ||
+		m["to"] != "13900000000" || m["text"] != "hi" {
+		t.Fatalf("[Sms] Bad file messages %v\n", lines)
+	}
+}
+
+func TestNewSMSSender(t *testing.T) {
+	for _, p := range []string{SmsProviderAlidayu, SmsProviderLog,
+		SmsProviderFile} {
+		if s, err := newSMSSender(p); err != nil || s.Name() != p {
+			t.Fatalf("[Sms] Provider %v not created: %v\n", p, err)
+		}
+	}
+	if _, err := newSMSSender("carrier-pigeon"); err != SmsErrorProvider {
+		t.Fatal("[Sms] Unknown provider created\n")
+	}
+	if maskPhone("13800001234") != "*******1234" || maskPhone("12") != "**" {
+		t.Fatal("[Sms] Bad phone mask\n")
+	}
+}
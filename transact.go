@@ -29,6 +29,7 @@ type Transact struct {
 	clientID        string
 	developerAPIKey string
 	quiet           bool
+	requestId       string
 }
 
 var (
@@ -72,22 +73,32 @@ var (
 	transactTimeout        = 10 * time.Second
 )
 
-// log checks to see if we should log to server or just stdout
-// for testing purposes
-func (t *Transact) log(format string, a ...interface{}) {
-	if t.quiet {
-		return
-	}
-	if serverLog != nil {
-		serverLog.Printf(format, a...)
-	} else {
-		fmt.Printf(format, a...)
-	}
+// logger returns the logger of an api call, which discards everything
+// when quiet for testing purposes
+func (t *Transact) logger(reqId int64) *Logger {
+	return outboundLogger(t.quiet, "transact", reqId, t.requestId)
 }
 
-// request takes a method, call and params to construct a call to TransactAPI
-// and parses response and returns response body for parsing
+// forRequest returns a copy of the client forwarding the request id of r
+// to Transact
+func (t *Transact) forRequest(r *http.Request) *Transact {
+	n := *t
+	n.requestId = requestId(r)
+	return &n
+}
+
+// request wraps doRequest with latency and outcome metrics
 func (t *Transact) request(method, call string,
+	params map[string]string) (map[string]interface{}, error) {
+	start := time.Now()
+	data, err := t.doRequest(method, call, params)
+	observeOutbound("transact", call, start, err)
+	return data, err
+}
+
+// doRequest takes a method, call and params to construct a call to
+// TransactAPI and parses response and returns response body for parsing
+func (t *Transact) doRequest(method, call string,
 	params map[string]string) (map[string]interface{}, error) {
 	form := url.Values{}
 	// Set common fields
@@ -99,22 +110,28 @@ func (t *Transact) request(method, call string,
 	}
 	args := form.Encode()
 	reqId := rand.Int63()
+	reqLog := t.logger(reqId)
 	url := t.url + "/" + call
-	// Log before any error will happen
-	t.log("[MXTAPI] (%v) %v: %v?%v\n", reqId, method, url, args)
+	// Log before any error will happen, without credentials and PII
+	reqLog.Info("request", LogFields{"method": method, "url": url,
+		"params": redactValues(form, transactRedact)})
 	req, err := http.NewRequest(method, url, strings.NewReader(args))
 	if err != nil {
-		t.log("[MXTAPI] (%v) REQ: %v\n", reqId, err)
+		reqLog.Error("request error", LogFields{"error": err})
 		return nil, TransactErrorRequest
 	}
 	// Always use url-encoded here
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Let the request be traced across services
+	if t.requestId != "" {
+		req.Header.Set(RequestIdHeader, t.requestId)
+	}
 
 	// Create client to push the request
 	client := &http.Client{Timeout: time.Duration(transactTimeout)}
 	resp, err := client.Do(req)
 	if err != nil {
-		t.log("[MXTAPI] (%v) NET: %v\n", reqId, err)
+		reqLog.Warn("network error", LogFields{"error": err})
 		return nil, TransactErrorNetwork
 	}
 	// Caller must close
@@ -122,11 +139,11 @@ func (t *Transact) request(method, call string,
 
 	// Ignore error while parsing, read as many
 	b, _ := ioutil.ReadAll(resp.Body)
-	body := string(b)
 
 	// If http response error, we should not parse the data structure at all
 	if resp.StatusCode != http.StatusOK {
-		t.log("[MXTAPI] (%v) API(%v): %v\n", reqId, resp.StatusCode, body)
+		reqLog.Warn("api error", LogFields{"status": resp.StatusCode,
+			"response": redactBody(b, transactRedact)})
 		return nil, TransactErrorAPI
 	}
 
@@ -134,18 +151,21 @@ func (t *Transact) request(method, call string,
 	var data map[string]interface{}
 	err = json.Unmarshal(b, &data)
 	if err != nil {
-		t.log("[MXTAPI] (%v) RES: %v\n", reqId, body)
+		reqLog.Warn("invalid response",
+			LogFields{"response": redactBody(b, transactRedact)})
 		return nil, TransactErrorResponse
 	}
 
 	// Now check for API function failure
 	sc, ok := data["statusCode"]
 	if !ok || sc != "101" {
-		t.log("[MXTAPI] (%v) CODE[%v]: %v\n", reqId, sc, body)
+		reqLog.Warn("call failed", LogFields{"status_code": sc,
+			"response": redactBody(b, transactRedact)})
 		return nil, TransactErrorFail
 	}
 
-	t.log("[MXTAPI] (%v) DONE: %v\n", reqId, data)
+	reqLog.Info("response",
+		LogFields{"response": redactJson(data, transactRedact)})
 	return data, nil
 }
 
@@ -153,6 +173,9 @@ func (t *Transact) request(method, call string,
 func (t *Transact) requestRetry(method, call string,
 	params map[string]string) (map[string]interface{}, error) {
 	for i := 0; i < 3; i++ {
+		if i > 0 {
+			outboundRetries.inc("transact", outboundCall(call))
+		}
 		data, err := t.request(method, call, params)
 		if err != TransactErrorNetwork {
 			return data, err
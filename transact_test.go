@@ -8,7 +8,8 @@ import (
 
 func TestKycGet(t *testing.T) {
 	// Setup api
-	mxt := Transact{transactUrl, transactId, transactKey, false}
+	mxt := Transact{url: transactUrl, clientID: transactId,
+		developerAPIKey: transactKey}
 
 	// Setup dummy user
 	u := DummyUser
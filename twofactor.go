@@ -0,0 +1,194 @@
+// Two-factor authentication for MarketX
+// Users enroll an RFC 6238 authenticator (30 second steps, 6 digit SHA1
+// codes) and get one-time recovery codes for when the device is lost.
+// Secrets are stored with encField and recovery codes as sha256 hashes.
+// Every code is accepted once: the last used time step is kept on the user.
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	totpSecretSize    = 20
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTotpSecret generates a base32 encoded authenticator secret
+func newTotpSecret() string {
+	b := make([]byte, totpSecretSize)
+	crand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode computes the code of secret for a time step
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+// checkTotp looks for code around now, allowing totpSkew steps of clock
+// drift, and returns its step if it is later than lastStep
+func checkTotp(secret, code string, now time.Time,
+	lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(key) == 0 || len(code) != totpDigits {
+		return 0, false
+	}
+	step := now.Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s > lastStep && hmac.Equal([]byte(totpCode(key, s)),
+			[]byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpUri is the provisioning uri of an authenticator, shown as a qr code
+func totpUri(account, secret string) string {
+	label := url.PathEscape(twoFactorIssuer) + ":" + url.PathEscape(account)
+	return fmt.Sprintf("otpauth://totp/%v?secret=%v&issuer=%v"+
+		"&algorithm=SHA1&digits=%v&period=%v", label, secret,
+		url.QueryEscape(twoFactorIssuer), totpDigits, totpPeriod)
+}
+
+// normalizeRecoveryCode drops the formatting of a typed recovery code
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(c rune) rune {
+		if c == '-' || c == ' ' {
+			return -1
+		}
+		return c
+	}, strings.ToLower(code))
+}
+
+// hashRecoveryCode returns the stored form of a recovery code
+func hashRecoveryCode(code string) string {
+	return fmt.Sprintf("%x", sha256.Sum256(
+		[]byte(normalizeRecoveryCode(code))))
+}
+
+// newRecoveryCodes replaces the recovery codes of a user and returns the
+// new ones, e.g. 1a2b3-c4d5e
+func newRecoveryCodes(userId uint) ([]string, error) {
+	tx := dbConn.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if err := tx.Exec(`DELETE FROM "recovery_codes" WHERE "user_id" = ?`,
+		userId).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	codes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeSize)
+		crand.Read(b)
+		h := fmt.Sprintf("%x", b)
+		code := h[:recoveryCodeSize] + "-" + h[recoveryCodeSize:]
+		if err := tx.Create(&RecoveryCode{UserID: userId,
+			CodeHash: hashRecoveryCode(code)}).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit().Error
+}
+
+// useTotpCode checks an authenticator code of u and burns its time step
+func useTotpCode(u *User, code string) bool {
+	step, ok := checkTotp(decField(u.TotpSecretEncrypted), code, time.Now(),
+		u.TotpLastStep)
+	if !ok {
+		return false
+	}
+	// Concurrent logins cannot both use the same code
+	res := dbConn.Model(&User{}).
+		Where("id = ? AND totp_last_step < ?", u.ID, step).
+		UpdateColumn("totp_last_step", step)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false
+	}
+	u.TotpLastStep = step
+	return true
+}
+
+// useRecoveryCode checks a recovery code of u and burns it
+func useRecoveryCode(u *User, code string) bool {
+	res := dbConn.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", u.ID,
+			hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+// verifyTwoFactor checks an authenticator or recovery code of u
+func verifyTwoFactor(u *User, code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return useTotpCode(u, code)
+	}
+	return code != "" && useRecoveryCode(u, code)
+}
+
+// recoveryCodesLeft counts the unused recovery codes of u
+func recoveryCodesLeft(u *User) int64 {
+	var n int64
+	dbConn.Model(&RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", u.ID).Count(&n)
+	return n
+}
+
+// twoFactorRequired checks whether the policy makes two-factor mandatory
+// for u
+func twoFactorRequired(u *User) bool {
+	return twoFactorRequireAdmin && u.UserLevel == UserLevelAdmin
+}
+
+// checkLoginTwoFactor asks users with two-factor enabled for a code in the
+// otp field and marks the new session as verified, returning false after
+// writing the failure
+func checkLoginTwoFactor(w http.ResponseWriter, r *http.Request,
+	ps httprouter.Params, u *User) bool {
+	if !u.TotpEnabled {
+		return true
+	}
+	otp := r.FormValue("otp")
+	if strings.TrimSpace(otp) == "" {
+		formatReturn(w, r, ps, ErrorCodeTwoFactorRequired, false, nil)
+		return false
+	}
+	if !verifyTwoFactor(u, otp) {
+		loginFailed(r, u)
+		formatReturn(w, r, ps, ErrorCodeTwoFactorInvalid, false, nil)
+		return false
+	}
+	getRequestContext(r).twoFactor = true
+	return true
+}
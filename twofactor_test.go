@@ -0,0 +1,76 @@
+// Testing for two-factor authentication
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTotpCode(t *testing.T) {
+	// RFC 6238 SHA1 test vectors truncated to 6 digits
+	key := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if c := totpCode(key, unix/totpPeriod); c != code {
+			t.Fatalf("[TwoFactor] Code at %v is %v, expected %v\n", unix, c,
+				code)
+		}
+	}
+}
+
+func TestCheckTotp(t *testing.T) {
+	secret := newTotpSecret()
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+
+	if s, ok := checkTotp(secret, totpCode(key, step), now, 0); !ok ||
+		s != step {
+		t.Fatal("[TwoFactor] Current code is refused\n")
+	}
+	if _, ok := checkTotp(secret, totpCode(key, step-1), now, 0); !ok {
+		t.Fatal("[TwoFactor] Previous code is refused\n")
+	}
+	if _, ok := checkTotp(secret, totpCode(key, step-2), now, 0); ok {
+		t.Fatal("[TwoFactor] Old code is accepted\n")
+	}
+	if _, ok := checkTotp(secret, totpCode(key, step), now, step); ok {
+		t.Fatal("[TwoFactor] Used code is accepted again\n")
+	}
+	if _, ok := checkTotp(strings.ToLower(secret), totpCode(key, step), now,
+		0); !ok {
+		t.Fatal("[TwoFactor] Lower case secret is refused\n")
+	}
+	if _, ok := checkTotp("", "000000", now, 0); ok {
+		t.Fatal("[TwoFactor] Empty secret is accepted\n")
+	}
+}
+
+func TestTotpUri(t *testing.T) {
+	uri := totpUri("a b@example.com", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/"+twoFactorIssuer+
+		":a%20b@example.com?secret=ABC&issuer="+twoFactorIssuer) {
+		t.Fatalf("[TwoFactor] Bad provisioning uri %v\n", uri)
+	}
+}
+
+func TestRecoveryCodeHash(t *testing.T) {
+	if hashRecoveryCode("1A2B3-C4D5E") != hashRecoveryCode(" 1a2b3c4d5e") {
+		t.Fatal("[TwoFactor] Recovery code formatting changes the hash\n")
+	}
+	if hashRecoveryCode("1a2b3-c4d5e") == hashRecoveryCode("1a2b3-c4d5f") {
+		t.Fatal("[TwoFactor] Different recovery codes share a hash\n")
+	}
+}
+
+func TestTwoFactorRequired(t *testing.T) {
+	if !twoFactorRequired(&User{UserLevel: UserLevelAdmin}) ||
+		twoFactorRequired(&User{UserLevel: UserLevelNormal}) {
+		t.Fatal("[TwoFactor] Policy does not apply to admins only\n")
+	}
+}
@@ -4,7 +4,6 @@
 package main
 
 import (
-	"fmt"
 	valid "github.com/asaskevich/govalidator"
 	"math"
 	"net/http"
@@ -160,6 +159,29 @@ func CheckLengthForm(of string, r *http.Request, f string,
 	return rs, f
 }
 
+// CheckPhone makes sure s is a phone number and returns it in E.164 form,
+// numbers without a country code are read in region
+func CheckPhone(ok bool, s, region string) (string, bool) {
+	if _, ok = CheckLength(ok, s, PhoneMin, PhoneMax); !ok {
+		return s, false
+	}
+	e, err := normalizePhone(s, region)
+	return e, err == nil
+}
+
+// CheckPhoneForm is the FormValue version of CheckPhone, in the phone
+// region of r
+func CheckPhoneForm(of string, r *http.Request, f string) (string, string) {
+	if of != "" {
+		return "", of
+	}
+	rs, ok := CheckPhone(true, r.FormValue(f), requestPhoneRegion(r))
+	if ok {
+		return rs, ""
+	}
+	return rs, f
+}
+
 // CheckRange is a specialized check of an uint64 declaration wrapped
 // inside a string, and returns a converted uint64 if possible
 func CheckRange(ok bool, s string, upper uint64) (uint64, bool) {
@@ -231,7 +253,6 @@ func checkIdCardNumber(str string) (string, bool) {
 	for k, v := range str {
 		var m = getCharMap(v)
 		if m == -1 {
-			fmt.Print("[utils-cnid] invalid char at [%d] in [%s]\n", k, str)
 			return str, false
 		}
 		sum += m * getWeightValue(k)
@@ -0,0 +1,244 @@
+// Verification codes for MarketX
+// Codes sent by text message or in login links are scoped to a purpose and
+// a phone number or email, expire after verifyCodeTtl and work once. Only
+// their hashes are stored in the database, so any instance can check them,
+// and wrong guesses are counted so a code stops working after
+// verifyCodeMaxAttempts.
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	VerifyPurposeRegister    = "register"
+	VerifyPurposeLogin       = "login"
+	VerifyPurposePhoneChange = "phone_change"
+	VerifyPurposeEmailLink   = "email_link"
+	// Expired codes are swept once every verifySweepEvery codes issued
+	verifySweepEvery = 1000
+	verifySweepAfter = 24 * time.Hour
+)
+
+// VerifyPurposes are the purposes codes can be issued for
+var VerifyPurposes = map[string]bool{
+	VerifyPurposeRegister:    true,
+	VerifyPurposeLogin:       true,
+	VerifyPurposePhoneChange: true,
+	VerifyPurposeEmailLink:   true,
+}
+
+var VerifyErrorPurpose = errors.New("Unknown verification purpose")
+
+var (
+	verifyIssued int64
+	verifyCodes  = newCounterVec("mx_verification_codes_total",
+		"Verification codes sent and checked by purpose and result.",
+		"purpose", "result")
+)
+
+// newVerifyCode generates a random code of n digits
+func newVerifyCode(n int) string {
+	b := make([]byte, n)
+	ten := big.NewInt(10)
+	for i := range b {
+		d, err := crand.Int(crand.Reader, ten)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = byte('0' + d.Int64())
+	}
+	return string(b)
+}
+
+// hashVerifyCode returns the stored form of a code, bound to its purpose
+// and target so it cannot be used for another
+func hashVerifyCode(purpose, target, code string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(purpose+"|"+target+"|"+
+		code)))
+}
+
+// verifyCodeWait returns how long to wait at now before sending another
+// code when the last one was sent at last
+func verifyCodeWait(last, now time.Time) time.Duration {
+	if wait := last.Add(verifyCodeResend).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// issueVerifyCode creates a code of purpose for target, which replaces the
+// earlier ones, or returns how long to wait if one was sent too recently
+// Issuing is serialized per purpose and target with a transaction lock, so
+// parallel requests cannot both pass the resend delay, even for a target
+// without codes yet.
+func issueVerifyCode(purpose, target, ip string) (string, time.Duration,
+	error) {
+	if !VerifyPurposes[purpose] {
+		return "", 0, VerifyErrorPurpose
+	}
+	tx := dbConn.Begin()
+	if tx.Error != nil {
+		return "", 0, tx.Error
+	}
+	if err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext(?))`,
+		"verify|"+purpose+"|"+target).Error; err != nil {
+		tx.Rollback()
+		return "", 0, err
+	}
+	now := time.Now()
+	var last VerificationCode
+	err := tx.Where("purpose = ? AND target = ?", purpose, target).
+		Order("created_at desc").First(&last).Error
+	if err == nil {
+		if wait := verifyCodeWait(last.CreatedAt, now); wait > 0 {
+			tx.Rollback()
+			verifyCodes.inc(purpose, "throttled")
+			return "", wait, nil
+		}
+	} else if err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return "", 0, err
+	}
+
+	code := newVerifyCode(int(verifyCodeLength))
+	if err := tx.Model(&VerificationCode{}).
+		Where("purpose = ? AND target = ? AND used_at IS NULL", purpose,
+			target).UpdateColumn("used_at", now).Error; err != nil {
+		tx.Rollback()
+		return "", 0, err
+	}
+	if err := tx.Create(&VerificationCode{Purpose: purpose, Target: target,
+		CodeHash:  hashVerifyCode(purpose, target, code),
+		ExpiresAt: now.Add(verifyCodeTtl), IpAddress: ip}).Error; err != nil {
+		tx.Rollback()
+		return "", 0, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return "", 0, err
+	}
+	verifyCodes.inc(purpose, "sent")
+
+	if atomic.AddInt64(&verifyIssued, 1)%verifySweepEvery == 0 {
+		goBackground(func() { sweepVerifyCodes(now.Add(-verifySweepAfter)) })
+	}
+	return code, 0, nil
+}
+
+// cancelVerifyCode removes the unused codes of purpose for target, e.g.
+// when the message could not be sent, so another can be requested at once
+func cancelVerifyCode(purpose, target string) error {
+	return dbConn.Unscoped().
+		Where("purpose = ? AND target = ? AND used_at IS NULL", purpose,
+			target).Delete(&VerificationCode{}).Error
+}
+
+// outstandingVerifyCodes counts the unused, unexpired codes by purpose,
+// nil when they cannot be counted
+func outstandingVerifyCodes(now time.Time) map[string]float64 {
+	if dbConn == nil {
+		return nil
+	}
+	rows, err := dbConn.Raw(`SELECT "purpose", count(*) FROM `+
+		`"verification_codes" WHERE "used_at" IS NULL AND "expires_at" > ? `+
+		`AND "deleted_at" IS NULL GROUP BY "purpose"`, now).Rows()
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	counts := map[string]float64{}
+	for p := range VerifyPurposes {
+		counts[p] = 0
+	}
+	for rows.Next() {
+		var p string
+		var n float64
+		if rows.Scan(&p, &n) != nil {
+			return nil
+		}
+		counts[p] = n
+	}
+	if rows.Err() != nil {
+		return nil
+	}
+	return counts
+}
+
+// sweepVerifyCodes removes the codes expired before t
+func sweepVerifyCodes(t time.Time) {
+	if err := dbConn.Unscoped().Where("expires_at < ?", t).
+		Delete(&VerificationCode{}).Error; err != nil {
+		serverLog.Warn("verification codes not swept",
+			LogFields{"error": err})
+	}
+}
+
+// checkVerifyCode checks code against the latest code of purpose for
+// target, using it up if consume is set. Every check counts as an attempt.
+func checkVerifyCode(purpose, target, code string, consume bool) ErrorCode {
+	now := time.Now()
+	var vc VerificationCode
+	if dbConn.Where("purpose = ? AND target = ? AND used_at IS NULL",
+		purpose, target).Order("created_at desc").
+		First(&vc).RecordNotFound() {
+		verifyCodes.inc(purpose, "invalid")
+		return ErrorCodePhoneCodeError
+	}
+	if !now.Before(vc.ExpiresAt) {
+		verifyCodes.inc(purpose, "expired")
+		return ErrorCodeVerifyCodeExpired
+	}
+
+	// The attempt is taken before comparing so parallel guesses cannot
+	// go over the limit
+	res := dbConn.Model(&VerificationCode{}).
+		Where("id = ? AND attempts < ?", vc.ID, verifyCodeMaxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+	if res.Error != nil {
+		return ErrorCodeUnknown
+	}
+	if res.RowsAffected == 0 {
+		verifyCodes.inc(purpose, "locked")
+		return ErrorCodeVerifyCodeLocked
+	}
+	if subtle.ConstantTimeCompare([]byte(hashVerifyCode(purpose, target,
+		code)), []byte(vc.CodeHash)) != 1 {
+		verifyCodes.inc(purpose, "invalid")
+		return ErrorCodePhoneCodeError
+	}
+
+	if consume {
+		res := dbConn.Model(&VerificationCode{}).
+			Where("id = ? AND used_at IS NULL", vc.ID).
+			UpdateColumn("used_at", now)
+		if res.Error != nil || res.RowsAffected == 0 {
+			verifyCodes.inc(purpose, "invalid")
+			return ErrorCodePhoneCodeError
+		}
+	}
+	verifyCodes.inc(purpose, "valid")
+	return ErrorCodeNone
+}
+
+// useVerifyCode uses up a code that passed checkVerifyCode, without
+// counting another attempt
+func useVerifyCode(purpose, target, code string) ErrorCode {
+	res := dbConn.Model(&VerificationCode{}).
+		Where("purpose = ? AND target = ? AND code_hash = ? AND "+
+			"used_at IS NULL AND expires_at > ?", purpose, target,
+			hashVerifyCode(purpose, target, code), time.Now()).
+		UpdateColumn("used_at", time.Now())
+	if res.Error != nil || res.RowsAffected == 0 {
+		return ErrorCodePhoneCodeError
+	}
+	return ErrorCodeNone
+}
@@ -0,0 +1,69 @@
+// Testing for verification codes
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		c := newVerifyCode(6)
+		if len(c) != 6 || strings.Trim(c, "0123456789") != "" {
+			t.Fatalf("[Verify] Bad code %q\n", c)
+		}
+		seen[c] = true
+	}
+	if len(seen) < 10 {
+		t.Fatalf("[Verify] Codes repeat: %v\n", seen)
+	}
+}
+
+func TestVerifyCodeHash(t *testing.T) {
+	h := hashVerifyCode(VerifyPurposeRegister, "13800000000", "123456")
+	if len(h) != 64 || strings.Contains(h, "123456") {
+		t.Fatalf("[Verify] Bad code hash %v\n", h)
+	}
+	if h != hashVerifyCode(VerifyPurposeRegister, "13800000000", "123456") {
+		t.Fatal("[Verify] Code hash is not stable\n")
+	}
+	// The same code of another purpose or phone must not match
+	if h == hashVerifyCode(VerifyPurposeLogin, "13800000000", "123456") ||
+		h == hashVerifyCode(VerifyPurposeRegister, "13800000001", "123456") {
+		t.Fatal("[Verify] Code hash is not scoped\n")
+	}
+}
+
+func TestVerifyCodeWait(t *testing.T) {
+	now := time.Now()
+	if w := verifyCodeWait(now.Add(-verifyCodeResend/2), now); w <= 0 ||
+		w > verifyCodeResend {
+		t.Fatalf("[Verify] Bad wait %v\n", w)
+	}
+	if w := verifyCodeWait(now.Add(-verifyCodeResend), now); w != 0 {
+		t.Fatalf("[Verify] Bad wait after resend delay %v\n", w)
+	}
+}
+
+func TestVerifyPurpose(t *testing.T) {
+	for form, want := range map[string]string{
+		"":              VerifyPurposeRegister,
+		"purpose=login": VerifyPurposeLogin,
+	} {
+		r := httptest.NewRequest("POST", "/account/send_mobile_code?"+form,
+			nil)
+		if p, ok := verifyPurpose(r); !ok || p != want {
+			t.Fatalf("[Verify] Bad purpose of %q: %v\n", form, p)
+		}
+	}
+	for _, bad := range []string{"reset", VerifyPurposeEmailLink} {
+		r := httptest.NewRequest("POST",
+			"/account/send_mobile_code?purpose="+bad, nil)
+		if _, ok := verifyPurpose(r); ok {
+			t.Fatalf("[Verify] Purpose %v accepted\n", bad)
+		}
+	}
+}
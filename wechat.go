@@ -0,0 +1,221 @@
+// WeChat OAuth for MarketX
+// Clients sign in with WeChat by sending the authorization code of the
+// WeChat login page, which is exchanged here for the openid, unionid and
+// profile of the user, so identities cannot be made up by the client.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WechatOAuth exchanges authorization codes for WeChat identities, tests
+// replace it with a client of a stub server
+type WechatOAuth interface {
+	Exchange(code, requestId string) (*WechatProfile, error)
+}
+
+// WechatProfile is the WeChat identity of a user
+type WechatProfile struct {
+	OpenID     string
+	UnionID    string
+	Nickname   string
+	HeadImgUrl string
+}
+
+type WechatClient struct {
+	url       string
+	appId     string
+	appSecret string
+	quiet     bool
+}
+
+var (
+	WechatErrorParams   = errors.New("Params error")
+	WechatErrorNetwork  = errors.New("Network error")
+	WechatErrorAPI      = errors.New("API call error")
+	WechatErrorResponse = errors.New("Response parsing error")
+	WechatErrorCode     = errors.New("Authorization code error")
+)
+
+var (
+	wechatTimeout = 10 * time.Second
+	// Errors of invalid, used and missing codes
+	wechatCodeErrors = map[float64]bool{40029: true, 40163: true, 41008: true}
+	wechatRedact     = redactDeny("openid", "unionid", "nickname",
+		"headimgurl")
+)
+
+// serverWechat is nil when no WeChat app is configured
+var serverWechat WechatOAuth
+
+// request wraps doRequest with latency and outcome metrics
+func (c *WechatClient) request(call string, params url.Values,
+	requestId string) (map[string]interface{}, error) {
+	start := time.Now()
+	data, err := c.doRequest(call, params, requestId)
+	observeOutbound("wechat", call, start, err)
+	return data, err
+}
+
+// doRequest calls the WeChat api, which reports errors with an errcode in
+// a 200 response
+func (c *WechatClient) doRequest(call string, params url.Values,
+	requestId string) (map[string]interface{}, error) {
+	reqLog := outboundLogger(c.quiet, "wechat", rand.Int63(), requestId)
+	// Only the call is logged, the query carries the app secret
+	reqLog.Info("request", LogFields{"method": "GET", "call": call})
+	req, err := http.NewRequest("GET", c.url+call+"?"+params.Encode(), nil)
+	if err != nil {
+		reqLog.Error("request error", LogFields{"error": err})
+		return nil, WechatErrorParams
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: wechatTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		reqLog.Warn("network error", LogFields{"error": err})
+		return nil, WechatErrorNetwork
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		reqLog.Warn("api error", LogFields{"status": resp.StatusCode,
+			"response": redactBody(b, wechatRedact)})
+		return nil, WechatErrorAPI
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		reqLog.Warn("invalid response",
+			LogFields{"response": redactBody(b, wechatRedact)})
+		return nil, WechatErrorResponse
+	}
+	if ec, ok := data["errcode"].(float64); ok && ec != 0 {
+		reqLog.Warn("api error",
+			LogFields{"response": redactJson(data, wechatRedact)})
+		if wechatCodeErrors[ec] {
+			return nil, WechatErrorCode
+		}
+		return nil, WechatErrorAPI
+	}
+
+	reqLog.Info("response",
+		LogFields{"response": redactJson(data, wechatRedact)})
+	return data, nil
+}
+
+// Exchange trades an authorization code for the access token and openid of
+// the user, then reads the profile when the code allows it
+func (c *WechatClient) Exchange(code, requestId string) (*WechatProfile,
+	error) {
+	if code == "" {
+		return nil, WechatErrorParams
+	}
+	data, err := c.request("/sns/oauth2/access_token", url.Values{
+		"appid": {c.appId}, "secret": {c.appSecret}, "code": {code},
+		"grant_type": {"authorization_code"}}, requestId)
+	if err != nil {
+		return nil, err
+	}
+	token, _ := data["access_token"].(string)
+	p := &WechatProfile{}
+	p.OpenID, _ = data["openid"].(string)
+	p.UnionID, _ = data["unionid"].(string)
+	if token == "" || p.OpenID == "" {
+		return nil, WechatErrorResponse
+	}
+
+	// Silent snsapi_base logins do not get the profile
+	if scope, _ := data["scope"].(string); !strings.Contains(scope,
+		"snsapi_userinfo") {
+		return p, nil
+	}
+	info, err := c.request("/sns/userinfo", url.Values{
+		"access_token": {token}, "openid": {p.OpenID}, "lang": {"zh_CN"}},
+		requestId)
+	if err != nil {
+		return nil, err
+	}
+	if id, _ := info["openid"].(string); id != p.OpenID {
+		return nil, WechatErrorResponse
+	}
+	if p.UnionID == "" {
+		p.UnionID, _ = info["unionid"].(string)
+	}
+	p.Nickname, _ = info["nickname"].(string)
+	p.HeadImgUrl, _ = info["headimgurl"].(string)
+	return p, nil
+}
+
+// wechatUser finds the user bound to a WeChat identity, by unionid when
+// WeChat gives one since it is shared by all apps of the account
+func wechatUser(p *WechatProfile) (*User, bool) {
+	var u User
+	if p.UnionID != "" {
+		if !dbConn.First(&u, "wx_union_id = ?", p.UnionID).RecordNotFound() {
+			return &u, true
+		}
+	}
+	if dbConn.First(&u, "wx_open_id = ?", p.OpenID).RecordNotFound() {
+		return nil, false
+	}
+	return &u, true
+}
+
+// bindWechat binds u to a WeChat identity, replacing an earlier binding,
+// unless another user is bound to it
+func bindWechat(u *User, p *WechatProfile) ErrorCode {
+	if o, found := wechatUser(p); found && o.ID != u.ID {
+		return ErrorCodeWechatBinded
+	}
+	fields := map[string]interface{}{"wx_open_id": p.OpenID,
+		"wx_union_id": p.UnionID, "wx_access_token": "",
+		"wx_nickname": p.Nickname, "wx_head_img_url": p.HeadImgUrl}
+	if dbConn.Model(u).UpdateColumns(fields).Error != nil {
+		return ErrorCodeWechatError
+	}
+	// Keep u current for later saves
+	u.WxOpenID, u.WxUnionID, u.WxAccessToken = p.OpenID, p.UnionID, ""
+	u.WxNickname, u.WxHeadImgUrl = p.Nickname, p.HeadImgUrl
+	return ErrorCodeNone
+}
+
+// unbindWechat removes the WeChat binding of u
+func unbindWechat(u *User) error {
+	if err := dbConn.Model(u).UpdateColumns(map[string]interface{}{
+		"wx_open_id": "", "wx_union_id": "", "wx_access_token": "",
+		"wx_nickname": "", "wx_head_img_url": ""}).Error; err != nil {
+		return err
+	}
+	u.WxOpenID, u.WxUnionID, u.WxAccessToken = "", "", ""
+	u.WxNickname, u.WxHeadImgUrl = "", ""
+	return nil
+}
+
+// exchangeWechatCode exchanges the code field of r, returning the error
+// code to answer with on failure
+func exchangeWechatCode(r *http.Request) (*WechatProfile, ErrorCode) {
+	if serverWechat == nil {
+		return nil, ErrorCodeWechatUnavailable
+	}
+	code, ok := CheckField(true, r.FormValue("code"))
+	if !ok {
+		return nil, ErrorCodeWechatCodeError
+	}
+	p, err := serverWechat.Exchange(code, requestId(r))
+	switch err {
+	case nil:
+		return p, ErrorCodeNone
+	case WechatErrorCode:
+		return nil, ErrorCodeWechatCodeError
+	}
+	return nil, ErrorCodeWechatError
+}
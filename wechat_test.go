@@ -0,0 +1,120 @@
+// Testing for WeChat OAuth
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newWechatStub serves the WeChat oauth api for code "good" with scope,
+// every other code is invalid
+func newWechatStub(t *testing.T, scope string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		q := r.URL.Query()
+		var res map[string]interface{}
+		switch r.URL.Path {
+		case "/sns/oauth2/access_token":
+			if q.Get("appid") != "app" || q.Get("secret") != "secret" ||
+				q.Get("grant_type") != "authorization_code" {
+				t.Errorf("[Wechat] Bad token request %v\n", q)
+			}
+			res = map[string]interface{}{"errcode": 40029,
+				"errmsg": "invalid code"}
+			if q.Get("code") == "good" {
+				res = map[string]interface{}{"access_token": "token",
+					"expires_in": 7200, "openid": "open", "scope": scope}
+			}
+		case "/sns/userinfo":
+			if q.Get("access_token") != "token" || q.Get("openid") != "open" {
+				t.Errorf("[Wechat] Bad userinfo request %v\n", q)
+			}
+			res = map[string]interface{}{"openid": "open",
+				"unionid": "union", "nickname": "Nick",
+				"headimgurl": "https://example.com/a.png"}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+}
+
+func TestWechatExchange(t *testing.T) {
+	s := newWechatStub(t, "snsapi_userinfo")
+	defer s.Close()
+	c := &WechatClient{url: s.URL, appId: "app", appSecret: "secret",
+		quiet: true}
+
+	p, err := c.Exchange("good", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.OpenID != "open" || p.UnionID != "union" || p.Nickname != "Nick" ||
+		p.HeadImgUrl != "https://example.com/a.png" {
+		t.Fatalf("[Wechat] Bad profile %v\n", p)
+	}
+	if _, err := c.Exchange("bad", ""); err != WechatErrorCode {
+		t.Fatalf("[Wechat] Invalid code not reported: %v\n", err)
+	}
+	if _, err := c.Exchange("", ""); err != WechatErrorParams {
+		t.Fatalf("[Wechat] Empty code exchanged: %v\n", err)
+	}
+
+	c.url = s.URL + "/missing"
+	if _, err := c.Exchange("good", ""); err != WechatErrorAPI {
+		t.Fatalf("[Wechat] Api error not reported: %v\n", err)
+	}
+}
+
+func TestWechatExchangeBase(t *testing.T) {
+	// Silent logins only get the openid
+	s := newWechatStub(t, "snsapi_base")
+	defer s.Close()
+	c := &WechatClient{url: s.URL, appId: "app", appSecret: "secret",
+		quiet: true}
+	p, err := c.Exchange("good", "")
+	if err != nil || p.OpenID != "open" || p.Nickname != "" {
+		t.Fatalf("[Wechat] Bad base profile %v: %v\n", p, err)
+	}
+}
+
+// wechatStatic is a WechatOAuth answering every code with one result
+type wechatStatic struct {
+	p   *WechatProfile
+	err error
+}
+
+func (s *wechatStatic) Exchange(code, requestId string) (*WechatProfile,
+	error) {
+	return s.p, s.err
+}
+
+func TestExchangeWechatCode(t *testing.T) {
+	defer func(c WechatOAuth) { serverWechat = c }(serverWechat)
+	r := httptest.NewRequest("PUT", "/account/wxlogin?code=abc", nil)
+
+	serverWechat = nil
+	if _, ec := exchangeWechatCode(r); ec != ErrorCodeWechatUnavailable {
+		t.Fatalf("[Wechat] Login without app: %v\n", ec)
+	}
+	serverWechat = &wechatStatic{err: WechatErrorCode}
+	if _, ec := exchangeWechatCode(r); ec != ErrorCodeWechatCodeError {
+		t.Fatalf("[Wechat] Bad code error: %v\n", ec)
+	}
+	serverWechat = &wechatStatic{err: WechatErrorNetwork}
+	if _, ec := exchangeWechatCode(r); ec != ErrorCodeWechatError {
+		t.Fatalf("[Wechat] Bad network error: %v\n", ec)
+	}
+	serverWechat = &wechatStatic{p: &WechatProfile{OpenID: "open"}}
+	if p, ec := exchangeWechatCode(r); ec != ErrorCodeNone ||
+		p.OpenID != "open" {
+		t.Fatalf("[Wechat] Exchange failed: %v\n", ec)
+	}
+	r = httptest.NewRequest("PUT", "/account/wxlogin", nil)
+	if _, ec := exchangeWechatCode(r); ec != ErrorCodeWechatCodeError {
+		t.Fatalf("[Wechat] Missing code accepted: %v\n", ec)
+	}
+}